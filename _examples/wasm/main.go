@@ -8,7 +8,6 @@ import (
 	"syscall/js"
 
 	"github.com/skx/evalfilter/v2"
-	"github.com/skx/evalfilter/v2/object"
 )
 
 // Replace the value of the given field with the specified text.
@@ -25,37 +24,15 @@ func append(i js.Value, val string) {
 	js.Global().Get("document").Call("getElementById", i.String()).Set("value", cur)
 }
 
-// fnSprintf is the implementation of our `sprintf` function.
-func fnSprintf(args []object.Object) object.Object {
-
-	// We expect 1+ arguments
-	if len(args) < 1 {
-		return &object.Null{}
-	}
-
-	// Type-check
-	if args[0].Type() != object.STRING {
-		return &object.Null{}
-	}
-
-	// Get the format-string.
-	fs := args[0].(*object.String).Value
-
-	// Convert the arguments to something go's sprintf
-	// code will understand.
-	argLen := len(args)
-	fmtArgs := make([]interface{}, argLen-1)
-
-	// Here we convert and assign.
-	for i, v := range args[1:] {
-		fmtArgs[i] = v.ToInterface()
-	}
-
-	// Call the helper
-	out := fmt.Sprintf(fs, fmtArgs...)
+// fieldWriter is an io.Writer which appends to the given field.
+type fieldWriter struct {
+	field js.Value
+}
 
-	// And now return the value.
-	return &object.String{Value: out}
+// Write appends the given text to the field.
+func (f fieldWriter) Write(p []byte) (int, error) {
+	append(f.field, string(p))
+	return len(p), nil
 }
 
 // run takes the script in 0 and outputs the result to 1
@@ -77,21 +54,9 @@ func run(this js.Value, i []js.Value) interface{} {
 		return nil
 	}
 
-	// ensure that print works
-	eval.AddFunction("print",
-		func(args []object.Object) object.Object {
-			for _, e := range args {
-				append(i[1], fmt.Sprintf("%s", e.Inspect()))
-			}
-			return &object.Void{}
-		})
-	eval.AddFunction("printf",
-		func(args []object.Object) object.Object {
-			out := fnSprintf(args)
-			append(i[1], fmt.Sprintf("%s", out.Inspect()))
-
-			return &object.Void{}
-		})
+	// ensure that print and printf write to the output-field
+	eval.SetOutput(fieldWriter{field: i[1]})
+
 	// call the script
 	ret, err := eval.Execute(nil)
 	if err != nil {
@@ -30,3 +30,34 @@ func (as *AssignStatement) String() string {
 	out.WriteString(as.Value.String())
 	return out.String()
 }
+
+// IndexAssignStatement is used for assigning to an element of an array
+// or hash, such as `a[1] = 3`, `h["name"] = "steve"`, or `h.name = "steve"`.
+type IndexAssignStatement struct {
+	Token token.Token
+
+	// Target is the element being assigned to, which is either an
+	// IndexExpression, or an InfixExpression using the `.` operator.
+	Target Expression
+
+	// Value is the value to store.
+	Value Expression
+}
+
+func (ias *IndexAssignStatement) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (ias *IndexAssignStatement) TokenLiteral() string { return ias.Token.Literal }
+
+// String returns this object as a string.
+func (ias *IndexAssignStatement) String() string {
+	if ias == nil {
+		return ""
+	}
+
+	var out bytes.Buffer
+	out.WriteString(ias.Target.String())
+	out.WriteString("=")
+	out.WriteString(ias.Value.String())
+	return out.String()
+}
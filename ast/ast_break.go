@@ -0,0 +1,22 @@
+package ast
+
+import "github.com/skx/evalfilter/v2/token"
+
+// BreakStatement terminates the innermost loop.
+type BreakStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+
+// String returns this object as a string.
+func (bs *BreakStatement) String() string {
+	if bs == nil {
+		return ""
+	}
+	return "break;"
+}
@@ -0,0 +1,22 @@
+package ast
+
+import "github.com/skx/evalfilter/v2/token"
+
+// ContinueStatement skips to the next iteration of the innermost loop.
+type ContinueStatement struct {
+	// Token contains the literal token.
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode() {}
+
+// TokenLiteral returns the literal token.
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+
+// String returns this object as a string.
+func (cs *ContinueStatement) String() string {
+	if cs == nil {
+		return ""
+	}
+	return "continue;"
+}
@@ -0,0 +1,29 @@
+package ast
+
+import (
+	"time"
+
+	"github.com/skx/evalfilter/v2/token"
+)
+
+// DurationLiteral holds a duration, such as "2h" or "1m30s".
+type DurationLiteral struct {
+	// Token is the literal token
+	Token token.Token
+
+	// Value holds the duration.
+	Value time.Duration
+}
+
+func (dl *DurationLiteral) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (dl *DurationLiteral) TokenLiteral() string { return dl.Token.Literal }
+
+// String returns this object as a string.
+func (dl *DurationLiteral) String() string {
+	if dl == nil {
+		return ""
+	}
+	return dl.Token.Literal
+}
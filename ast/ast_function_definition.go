@@ -50,3 +50,43 @@ func (fd *FunctionDefinition) String() string {
 	out.WriteString(fd.Body.String())
 	return out.String()
 }
+
+// FunctionLiteral holds an anonymous function, such as `function(x) { .. }`,
+// which is an expression that may be stored in a variable, or passed to
+// another function.
+type FunctionLiteral struct {
+
+	// Token holds the `function` keyword.
+	Token token.Token
+
+	// Parameters holds the function parameters.
+	Parameters []*Identifier
+
+	// Body holds the set of statements in the functions' body.
+	Body *BlockStatement
+}
+
+func (fl *FunctionLiteral) expressionNode() {}
+
+// TokenLiteral returns the literal token.
+func (fl *FunctionLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+
+// String returns this object as a string.
+func (fl *FunctionLiteral) String() string {
+	if fl == nil {
+		return ""
+	}
+
+	var out bytes.Buffer
+	params := make([]string, 0)
+	for _, p := range fl.Parameters {
+		params = append(params, p.String())
+	}
+	out.WriteString("function(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(")")
+	out.WriteString(fl.Body.String())
+	return out.String()
+}
@@ -216,3 +216,92 @@ return ( result == 3628800 );`)
 		b.Fail()
 	}
 }
+
+// Benchmark_evalfilter_locals - This benchmark measures the cost of
+// local variables, which are used by foreach-loops and functions.
+func Benchmark_evalfilter_locals(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`
+function total(items) {
+  local sum;
+  sum = 0;
+  foreach i, item in items {
+    foreach j, x in 1..5 {
+      sum = sum + item * x;
+    }
+  }
+  return sum;
+}
+
+return ( total(1..20) == 3150 );`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	var ret bool
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ret, err = eval.Run(nil)
+	}
+	b.StopTimer()
+
+	if err != nil {
+		b.Fatal(err)
+	}
+	if !ret {
+		b.Fail()
+	}
+}
+
+// Benchmark_evalfilter_parallel - This benchmark runs a single prepared
+// script from multiple goroutines at once.
+func Benchmark_evalfilter_parallel(b *testing.B) {
+
+	//
+	// Prepare the script
+	//
+	eval := New(`if ( (Origin == "MOW" || Country == "RU") && (Value >= 100 || Adults == 1) ) { return true; }  else { return false; }`)
+
+	//
+	// Ensure this compiled properly.
+	//
+	err := eval.Prepare()
+	if err != nil {
+		fmt.Printf("Failed to compile: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Create the object we'll test against.
+	//
+	params := make(map[string]interface{})
+	params["Origin"] = "MOW"
+	params["Country"] = "RU"
+	params["Adults"] = 1
+	params["Value"] = 99
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			ret, err := eval.Run(params)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if !ret {
+				b.Error("unexpected result")
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/skx/evalfilter/v2"
+)
+
+// Structure for our options and state.
+type compileCmd struct {
+	// Disable the bytecode optimizer
+	raw bool
+
+	// The file to write to, if not derived from the input name.
+	output string
+}
+
+// Info returns the name of this subcommand.
+func (c *compileCmd) Info() (string, string) {
+	return "compile", `Compile a script file to bytecode.
+
+This sub-command lexes, parses, and compiles the specified script,
+then writes the compiled program to a '.efc' file, which may be
+executed via the 'run' sub-command without the need to compile it
+again.
+
+By default the output is written alongside the input, replacing any
+suffix with '.efc'.
+
+Example:
+
+  $ evalfilter compile script.in
+  $ evalfilter run script.efc
+
+`
+}
+
+// Arguments adds per-command args to the object.
+func (c *compileCmd) Arguments(f *flag.FlagSet) {
+	f.BoolVar(&c.raw, "no-optimizer", false, "Disable the bytecode optimizer")
+	f.StringVar(&c.output, "output", "", "The file to write the compiled program to.")
+}
+
+// Compile the given script.
+func (c *compileCmd) Compile(file string) bool {
+
+	//
+	// Read the file contents.
+	//
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Error reading file %s - %s\n", file, err.Error())
+		return false
+	}
+
+	//
+	// Create the evaluator.
+	//
+	eval := evalfilter.New(string(dat))
+
+	var flags []byte
+	if c.raw {
+		flags = append(flags, evalfilter.NoOptimize)
+	}
+
+	//
+	// Prepare
+	//
+	err = eval.Prepare(flags)
+	if err != nil {
+		fmt.Printf("Error compiling:%s\n", err.Error())
+		return false
+	}
+
+	//
+	// Serialize
+	//
+	out, err := eval.Marshal()
+	if err != nil {
+		fmt.Printf("Error serializing:%s\n", err.Error())
+		return false
+	}
+
+	//
+	// Work out where to write.
+	//
+	dest := c.output
+	if dest == "" {
+		dest = strings.TrimSuffix(file, filepath.Ext(file)) + ".efc"
+	}
+
+	err = ioutil.WriteFile(dest, out, 0644)
+	if err != nil {
+		fmt.Printf("Error writing file %s - %s\n", dest, err.Error())
+		return false
+	}
+	return true
+}
+
+// Execute is invoked if the user specifies `compile` as the subcommand.
+func (c *compileCmd) Execute(args []string) int {
+
+	//
+	// We can only write to a single named output.
+	//
+	if c.output != "" && len(args) > 1 {
+		fmt.Printf("The -output flag may only be used with a single input file\n")
+		return 1
+	}
+
+	//
+	// For each file we've been passed; compile it.
+	//
+	ret := 0
+	for _, file := range args {
+		if !c.Compile(file) {
+			ret = 1
+		}
+	}
+
+	return ret
+}
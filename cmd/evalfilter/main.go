@@ -24,6 +24,7 @@ func main() {
 
 	subcommands.Register(&lexCmd{})
 	subcommands.Register(&bytecodeCmd{})
+	subcommands.Register(&compileCmd{})
 	subcommands.Register(&parseCmd{})
 	subcommands.Register(&runCmd{})
 
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/skx/evalfilter/v2"
@@ -26,6 +27,12 @@ type runCmd struct {
 
 	// Maximum execution duration for the script.
 	timeout time.Duration
+
+	// The fixed time to run the script at, if any.
+	now string
+
+	// The timezone to present times in, if any.
+	tz string
 }
 
 // Info returns the name of this subcommand.
@@ -35,10 +42,15 @@ func (r *runCmd) Info() (string, string) {
 This sub-command allows executing the specified evalfilter-script,
 optionally you may specify a JSON object to run the script against.
 
+Scripts which were compiled via the 'compile' sub-command, and have
+the '.efc' suffix, are loaded rather than compiled.
+
 Example:
 
   $ evalfilter run script.in
   $ evalfilter run -json /path/to/obj.json script.in
+  $ evalfilter run script.efc
+  $ evalfilter run -now 2024-03-09T18:30:00Z -tz Europe/Helsinki script.in
 
 `
 }
@@ -49,6 +61,8 @@ func (r *runCmd) Arguments(f *flag.FlagSet) {
 	f.BoolVar(&r.raw, "no-optimizer", false, "Disable the bytecode optimizer.")
 	f.BoolVar(&r.debug, "debug", false, "Show instructions and the stack at ever step.")
 	f.DurationVar(&r.timeout, "timeout", 0, "Specify the maximum execution time to allow for the script(s).")
+	f.StringVar(&r.now, "now", "", "Run the script as if the current time were the given RFC3339 timestamp.")
+	f.StringVar(&r.tz, "tz", "", "Specify the timezone the current time, and integer timestamps, are presented in.")
 }
 
 // Run the given script.
@@ -106,6 +120,30 @@ func (r *runCmd) Run(file string) {
 		eval.SetContext(ctx)
 	}
 
+	//
+	// If we've been given a fixed time then use it.
+	//
+	if r.now != "" {
+		now, err := time.Parse(time.RFC3339, r.now)
+		if err != nil {
+			fmt.Printf("Error parsing time %s - %s\n", r.now, err.Error())
+			return
+		}
+		eval.SetClock(func() time.Time { return now })
+	}
+
+	//
+	// If we've been given a timezone then use it.
+	//
+	if r.tz != "" {
+		loc, err := time.LoadLocation(r.tz)
+		if err != nil {
+			fmt.Printf("Error loading timezone %s - %s\n", r.tz, err.Error())
+			return
+		}
+		eval.SetLocation(loc)
+	}
+
 	//
 	// Flags to pass to the preparation function.
 	//
@@ -124,12 +162,20 @@ func (r *runCmd) Run(file string) {
 	}
 
 	//
-	// Prepare
+	// Load a compiled program, or prepare the script.
 	//
-	err = eval.Prepare(flags)
-	if err != nil {
-		fmt.Printf("Error compiling:%s\n", err.Error())
-		return
+	if strings.HasSuffix(file, ".efc") {
+		err = eval.Unmarshal(dat)
+		if err != nil {
+			fmt.Printf("Error loading:%s\n", err.Error())
+			return
+		}
+	} else {
+		err = eval.Prepare(flags)
+		if err != nil {
+			fmt.Printf("Error compiling:%s\n", err.Error())
+			return
+		}
 	}
 
 	//
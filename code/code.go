@@ -2,7 +2,10 @@
 // our compiler emits, and our virtual machine executes.
 package code
 
-import "fmt"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 // Opcode is a type-alias.
 type Opcode byte
@@ -10,6 +13,34 @@ type Opcode byte
 // Instructions is a type alias.
 type Instructions []byte
 
+// Position records the place within the source of a script which
+// generated an instruction.
+type Position struct {
+	// Line is the line-number, starting at one.
+	Line int
+
+	// Column is the column within that line.
+	Column int
+}
+
+// Positions maps the offset of each instruction to the position of the
+// source which generated it.
+type Positions map[int]Position
+
+// Find returns the position of the source which generated the instruction
+// at the given offset.
+//
+// If there is no entry for the offset we return that of the closest
+// preceding instruction which has one.
+func (p Positions) Find(offset int) (Position, bool) {
+	for ; offset >= 0; offset-- {
+		if pos, ok := p[offset]; ok {
+			return pos, true
+		}
+	}
+	return Position{}, false
+}
+
 // Opcodes we support
 const (
 
@@ -63,7 +94,10 @@ const (
 	// Set a variable by name
 	OpSet
 
-	// Setup a local variable, by name
+	// Setup a local variable.
+	//
+	// The 16-bit argument is the slot of the variable, which is
+	// set to null.
 	OpLocal
 
 	// Push a TRUE value onto the stack.
@@ -147,6 +181,10 @@ const (
 
 	// Pop two values from the stack.  If both are TRUE push TRUE,
 	// otherwise push FALSE.
+	//
+	// The compiler no longer generates this, or OpOr, since `&&`
+	// and `||` short-circuit, but they're retained so that
+	// previously serialized programs still work.
 	OpAnd
 
 	// Pop two values from the stack.  If either is TRUE push TRUE,
@@ -178,10 +216,13 @@ const (
 	//
 	//  2. We push the array back, after bumping the count-field.
 	//
-	//  3. We then push the next item.
+	//  3. We then push the index of the next item, and the item.
 	//
 	//  4. We then push TRUE - which lets our OpJumpIfFalse work.
 	//
+	// The compiler then stores the item and index in the slots of
+	// the loop-variables, via OpSetLocal.
+	//
 	// UNLESS we're at the end, in which case we do:
 	//
 	//  1.  We pop the value FROM the stack
@@ -193,8 +234,66 @@ const (
 	// Given two integer values produce an array holding
 	// items between them.
 	OpRange
+
+	// OpIterationEnd is used when a foreach-loop is exited early,
+	// via `break`.
+	//
+	// We pop the object being iterated over from the stack, just
+	// as OpIterationNext would have done at the end of the loop.
+	OpIterationEnd
+
+	// OpSetIndex updates an element of an array, or hash.
+	//
+	// We pop the index, the array/hash, and the value to store from
+	// the stack, then push an updated copy of the array/hash.  The
+	// original is left unchanged, as it might be shared.
+	OpSetIndex
+
+	// OpClosure pushes a function-value upon the stack.
+	//
+	// The 16-bit argument is the offset of the constant which holds
+	// the compiled function.  We push a copy of that which captures
+	// the local variables which are currently in scope.
+	OpClosure
+
+	// OpGetLocal pushes the value of a local variable.
+	//
+	// Function-arguments, foreach-variables, and those declared with
+	// `local` are stored in numbered slots in the frame of the function
+	// which is executing.  The 16-bit argument is the slot.
+	OpGetLocal
+
+	// OpSetLocal pops a value from the stack, and stores it in the
+	// local variable whose slot is given by the 16-bit argument.
+	OpSetLocal
+
+	// OpGetOuter pushes the value of a local variable of an enclosing
+	// function, which has been captured by a closure.
+	//
+	// The instruction is always prefixed by OpWide.  The high 16-bits
+	// of the 32-bit argument are the number of functions we must look
+	// outward, and the low 16-bits are the slot.
+	OpGetOuter
+
+	// OpSetOuter pops a value from the stack, and stores it in the
+	// local variable of an enclosing function, as with OpGetOuter.
+	OpSetOuter
+
+	// OpWide is a prefix for an instruction which takes an argument,
+	// and indicates that argument is stored in 32-bits rather than
+	// the usual 16.
+	//
+	// This allows programs to have more than 65535 constants, or more
+	// than 64k of bytecode, without making every instruction larger.
+	OpWide
 )
 
+// MaxOperand is the largest argument an instruction may have, when it
+// is prefixed by OpWide.
+//
+// Without the prefix arguments are limited to 0xFFFF.
+const MaxOperand = 0xFFFFFFFF
+
 // OpCodeNames allows mapping opcodes to their names.
 var OpCodeNames = [...]string{
 	OpAdd:            "OpAdd",
@@ -204,16 +303,20 @@ var OpCodeNames = [...]string{
 	OpBang:           "OpBang",
 	OpCall:           "OpCall",
 	OpCase:           "OpCase",
+	OpClosure:        "OpClosure",
 	OpConstant:       "OpConstant",
 	OpDec:            "OpDec",
 	OpDiv:            "OpDiv",
 	OpEqual:          "OpEqual",
 	OpFalse:          "OpFalse",
+	OpGetLocal:       "OpGetLocal",
+	OpGetOuter:       "OpGetOuter",
 	OpGreater:        "OpGreater",
 	OpGreaterEqual:   "OpGreaterEqual",
 	OpHash:           "OpHash",
 	OpInc:            "OpInc",
 	OpIndex:          "OpIndex",
+	OpIterationEnd:   "OpIterationEnd",
 	OpIterationNext:  "OpIterationNext",
 	OpIterationReset: "OpIterationReset",
 	OpJump:           "OpJump",
@@ -236,10 +339,14 @@ var OpCodeNames = [...]string{
 	OpRange:          "OpRange",
 	OpReturn:         "OpReturn",
 	OpSet:            "OpSet",
+	OpSetIndex:       "OpSetIndex",
+	OpSetLocal:       "OpSetLocal",
+	OpSetOuter:       "OpSetOuter",
 	OpSquareRoot:     "OpSquareRoot",
 	OpSub:            "OpSub",
 	OpTrue:           "OpTrue",
 	OpVoid:           "OpVoid",
+	OpWide:           "OpWide",
 }
 
 // Length returns the length of the given opcode, including any optional
@@ -252,6 +359,10 @@ var OpCodeNames = [...]string{
 // This means our instructions are either a single 8-bit byte, or
 // three such bytes.
 //
+// The exception is an instruction prefixed by OpWide, which has a
+// 32-bit argument, and is six bytes long.  OpWide itself is a single
+// byte, so use Read to find the length of the whole instruction.
+//
 // This function returns the appropriate length for a given opcode.
 func Length(op Opcode) int {
 
@@ -262,10 +373,16 @@ func Length(op Opcode) int {
 		return 3
 	case OpCall:
 		return 3
+	case OpClosure:
+		return 3
 	case OpConstant:
 		return 3
 	case OpDec:
 		return 3
+	case OpGetLocal, OpSetLocal, OpLocal:
+		return 3
+	case OpGetOuter, OpSetOuter:
+		return 3
 	case OpJump, OpJumpIfFalse:
 		return 3
 	case OpInc:
@@ -279,6 +396,65 @@ func Length(op Opcode) int {
 	return 1
 }
 
+// Make returns the encoded form of the given instruction, and argument.
+//
+// The argument is stored in 16-bits, unless it is too large or wide is
+// true, in which case the instruction is prefixed by OpWide.
+func Make(op Opcode, arg int, wide bool) Instructions {
+
+	if Length(op) == 1 {
+		return Instructions{byte(op)}
+	}
+
+	if !wide && arg <= 0xFFFF {
+		ins := make(Instructions, 3)
+		ins[0] = byte(op)
+		binary.BigEndian.PutUint16(ins[1:], uint16(arg))
+		return ins
+	}
+
+	ins := make(Instructions, 6)
+	ins[0] = byte(OpWide)
+	ins[1] = byte(op)
+	binary.BigEndian.PutUint32(ins[2:], uint32(arg))
+	return ins
+}
+
+// Read decodes the instruction at the given offset, returning the
+// opcode, its argument, and its length.
+//
+// If the instruction is prefixed by OpWide the opcode which follows the
+// prefix is returned, and the length includes the prefix.
+//
+// If the instruction is truncated its argument is zero, and the length
+// returned extends beyond the end of the bytecode.
+func Read(ins Instructions, offset int) (Opcode, int, int) {
+
+	op := Opcode(ins[offset])
+
+	if op == OpWide {
+		if offset+1 >= len(ins) {
+			return op, 0, 2
+		}
+		op = Opcode(ins[offset+1])
+		if Length(op) == 1 {
+			return op, 0, 2
+		}
+		if offset+6 > len(ins) {
+			return op, 0, 6
+		}
+		return op, int(binary.BigEndian.Uint32(ins[offset+2 : offset+6])), 6
+	}
+
+	if Length(op) == 1 {
+		return op, 0, 1
+	}
+	if offset+3 > len(ins) {
+		return op, 0, 3
+	}
+	return op, int(binary.BigEndian.Uint16(ins[offset+1 : offset+3])), 3
+}
+
 // String converts the given opcode to a string.
 //
 // This is used by our bytecode disassembler/dumper.
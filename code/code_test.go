@@ -45,6 +45,12 @@ func TestOpcodeLengths(t *testing.T) {
 			if c != OpArray &&
 				c != OpHash &&
 				c != OpCall &&
+				c != OpClosure &&
+				c != OpGetLocal &&
+				c != OpSetLocal &&
+				c != OpGetOuter &&
+				c != OpSetOuter &&
+				c != OpLocal &&
 				c != OpConstant &&
 				c != OpJump &&
 				c != OpJumpIfFalse &&
@@ -70,3 +76,63 @@ func TestInvalidCode(t *testing.T) {
 		t.Fatalf("unknown opcodes returned something unexpected:%s", name)
 	}
 }
+
+func TestPositions(t *testing.T) {
+
+	p := Positions{0: {Line: 1, Column: 3}, 5: {Line: 2, Column: 7}}
+
+	// exact matches, and the closest preceding entry
+	tests := map[int]Position{0: {1, 3}, 4: {1, 3}, 5: {2, 7}, 9: {2, 7}}
+	for offset, expected := range tests {
+		pos, ok := p.Find(offset)
+		if !ok {
+			t.Fatalf("failed to find position of %d", offset)
+		}
+		if pos != expected {
+			t.Fatalf("wrong position for %d: %v != %v", offset, pos, expected)
+		}
+	}
+
+	// Nothing to find
+	_, ok := Positions{}.Find(3)
+	if ok {
+		t.Fatalf("found position in an empty table")
+	}
+}
+
+// TestMakeRead ensures that instructions survive encoding.
+func TestMakeRead(t *testing.T) {
+
+	tests := []struct {
+		op     Opcode
+		arg    int
+		wide   bool
+		length int
+	}{
+		{op: OpTrue, arg: 0, length: 1},
+		{op: OpTrue, arg: 0, wide: true, length: 1},
+		{op: OpConstant, arg: 0, length: 3},
+		{op: OpConstant, arg: 0xFFFF, length: 3},
+		{op: OpConstant, arg: 0x10000, length: 6},
+		{op: OpJump, arg: 3, wide: true, length: 6},
+		{op: OpJump, arg: 0x7FFFFFFF, length: 6},
+	}
+
+	for _, tst := range tests {
+
+		ins := Make(tst.op, tst.arg, tst.wide)
+		if len(ins) != tst.length {
+			t.Fatalf("%s %d had length %d, expected %d", String(tst.op), tst.arg, len(ins), tst.length)
+		}
+		if len(ins) == 6 && Opcode(ins[0]) != OpWide {
+			t.Fatalf("%s %d wasn't prefixed by OpWide", String(tst.op), tst.arg)
+		}
+
+		// Decode it, after some padding.
+		ins = append(Instructions{byte(OpNop)}, ins...)
+		op, arg, length := Read(ins, 1)
+		if op != tst.op || arg != tst.arg || length != tst.length {
+			t.Fatalf("%s %d decoded as %s %d, length %d", String(tst.op), tst.arg, String(op), arg, length)
+		}
+	}
+}
@@ -5,7 +5,6 @@
 package evalfilter
 
 import (
-	"encoding/binary"
 	"fmt"
 	"sort"
 
@@ -13,11 +12,121 @@ import (
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/environment"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
+// loop records the state of a loop we're compiling, so that any `break`
+// and `continue` statements within its body may be compiled.
+type loop struct {
+	// start is the offset which `continue` jumps to.
+	start int
+
+	// foreach is true for foreach-loops, which must remove their
+	// iteration-state when exited via `break`.
+	foreach bool
+
+	// breaks holds the offsets of the jumps emitted for `break`
+	// statements, which are patched once we know where the loop ends.
+	breaks []int
+}
+
+// constantKey identifies a constant, so that we can find any existing
+// copy of it in our constant-pool.
+type constantKey struct {
+	typ   object.Type
+	value string
+}
+
+// locals records the local variables of a function we're compiling,
+// which are stored in numbered slots rather than looked up by name.
+//
+// The main program is treated as a function too, but one which starts
+// with no scopes, so `local` has no effect outside of a loop.
+type locals struct {
+	// scopes map the names of the variables which are visible to
+	// their slots, innermost last.  A function has a scope for its
+	// arguments, and each foreach-loop adds another.
+	scopes []map[string]int
+
+	// slots is the number of slots we've allocated.
+	slots int
+}
+
+// declare allocates a slot for the named variable, in the innermost
+// scope, returning it.
+//
+// Declaring a variable twice in the same scope reuses its slot.
+func (l *locals) declare(name string) int {
+	scope := l.scopes[len(l.scopes)-1]
+	if slot, ok := scope[name]; ok {
+		return slot
+	}
+	scope[name] = l.allocate()
+	return scope[name]
+}
+
+// allocate returns a new slot, which has no name.
+func (l *locals) allocate() int {
+	l.slots++
+	return l.slots - 1
+}
+
+// compileProgram compiles the given program to bytecode.
+//
+// The targets of jumps are stored in 16-bits where possible, but they're
+// emitted before we know where they'll point.  So if our program turns
+// out to be too large for that we compile it again with wider jumps.
+func (e *Eval) compileProgram(program *ast.Program) error {
+
+	for _, wide := range []bool{false, true} {
+
+		// Reset our state.
+		e.constants = nil
+		e.constantIndex = make(map[constantKey]int)
+		e.instructions = nil
+		e.positions = make(code.Positions)
+		e.functions = make(map[string]environment.UserFunction)
+		e.loops = nil
+		e.locals = []*locals{{}}
+		e.wideJumps = wide
+		e.tooLarge = false
+		e.err = nil
+		e.schemaErrors = nil
+		e.deniedCalls = nil
+
+		err := e.compile(program)
+		if err == nil {
+			err = e.err
+		}
+		if err == nil {
+			err = e.checkDenied()
+		}
+		if err != nil {
+			return err
+		}
+		if !e.tooLarge {
+			return nil
+		}
+	}
+
+	// We can't get here, as wide jumps always fit.
+	return fmt.Errorf("the program is too large")
+}
+
 // compile is core-code for converting the AST into a series of bytecodes.
 func (e *Eval) compile(node ast.Node) error {
 
+	//
+	// Record the position of this node, so that the instructions
+	// we generate for it can be traced back to the source.
+	//
+	if pos, ok := position(node); ok {
+		prev := e.position
+		e.position = pos
+		defer func() { e.position = prev }()
+	}
+
 	switch node := node.(type) {
 
 	case *ast.Program:
@@ -43,6 +152,10 @@ func (e *Eval) compile(node ast.Node) error {
 			e.emit(code.OpFalse)
 		}
 
+	case *ast.DurationLiteral:
+		dur := &object.Duration{Value: node.Value}
+		e.emit(code.OpConstant, e.addConstant(dur))
+
 	case *ast.FloatLiteral:
 		str := &object.Float{Value: node.Value}
 		e.emit(code.OpConstant, e.addConstant(str))
@@ -83,8 +196,12 @@ func (e *Eval) compile(node ast.Node) error {
 			val = "(?" + node.Flags + ")" + val
 		}
 
-		// The value + flags
-		reg := &object.Regexp{Value: val}
+		// The value + flags, compiled once now rather than
+		// each time it is used.
+		reg, err := object.NewRegexp(val)
+		if err != nil {
+			return fmt.Errorf("invalid regular expression /%s/: %s", node.Value, err.Error())
+		}
 		e.emit(code.OpConstant, e.addConstant(reg))
 
 	case *ast.ArrayLiteral:
@@ -137,7 +254,39 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+	case *ast.BreakStatement:
+		if len(e.loops) == 0 {
+			return fmt.Errorf("'break' may only be used inside a loop")
+		}
+		l := e.loops[len(e.loops)-1]
+
+		// Leaving a foreach-loop means discarding the
+		// iteration-state, which would otherwise be done
+		// by OpIterationNext.
+		if l.foreach {
+			e.emit(code.OpIterationEnd)
+		}
+
+		// Jump to the end of the loop, once we know where
+		// that is.
+		l.breaks = append(l.breaks, e.emit(code.OpJump, 9999))
+
+	case *ast.ContinueStatement:
+		if len(e.loops) == 0 {
+			return fmt.Errorf("'continue' may only be used inside a loop")
+		}
+
+		// Jump back to the start of the loop.
+		e.emit(code.OpJump, e.loops[len(e.loops)-1].start)
+
 	case *ast.InfixExpression:
+
+		// The logical operators only evaluate their
+		// right-hand side when they need to.
+		if node.Operator == "&&" || node.Operator == "||" {
+			return e.compileLogical(node)
+		}
+
 		err := e.compile(node.Left)
 		if err != nil {
 			return err
@@ -148,6 +297,14 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+		// Check the operands against the schema, if we have one.
+		if e.schema != nil {
+			e.checkInfix(node)
+			if name, ok := node.Right.(*ast.StringLiteral); ok && node.Operator == "." {
+				e.checkMember(node.Left, name.Value, node.Token)
+			}
+		}
+
 		switch node.Operator {
 
 		// mutators
@@ -160,10 +317,6 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		case "+=", "-=", "*=", "/=":
 
-			l, ok := node.Left.(*ast.Identifier)
-			if !ok {
-				return fmt.Errorf("left-most operand for %s must be an identifier", node.Operator)
-			}
 			if node.Operator == "+=" {
 				e.emit(code.OpAdd)
 			}
@@ -176,12 +329,12 @@ func (e *Eval) compile(node ast.Node) error {
 			if node.Operator == "/=" {
 				e.emit(code.OpDiv)
 			}
-			str := &object.String{Value: l.Token.Literal}
 
-			e.emit(code.OpConstant, e.addConstant(str))
-
-			// And make it work.
-			e.emit(code.OpSet)
+			// And store the result.
+			err = e.assign(node.Left)
+			if err != nil {
+				return fmt.Errorf("left-most operand for %s must be an identifier, or an index", node.Operator)
+			}
 
 		// maths
 		case "+":
@@ -226,11 +379,6 @@ func (e *Eval) compile(node ast.Node) error {
 		case "..":
 			e.emit(code.OpRange)
 
-			// logical operators
-		case "&&":
-			e.emit(code.OpAnd)
-		case "||":
-			e.emit(code.OpOr)
 		default:
 			return fmt.Errorf("unknown operator %s", node.Operator)
 		}
@@ -254,21 +402,43 @@ func (e *Eval) compile(node ast.Node) error {
 
 	case *ast.PostfixExpression:
 
+		if node.Operator != "++" && node.Operator != "--" {
+			return fmt.Errorf("unknown postfix operator %s", node.Operator)
+		}
+
+		// The variable has already been pushed, as the
+		// parser sees `x++` as `x` followed by `++`.
+		//
+		// Local variables are updated via addition, which
+		// consumes that value.
+		if _, _, ok := e.resolve(node.Token.Literal); ok {
+			e.emit(code.OpPush, 1)
+			if node.Operator == "++" {
+				e.emit(code.OpAdd)
+			} else {
+				e.emit(code.OpSub)
+			}
+			return e.store(node.Token.Literal)
+		}
+
+		name := &object.String{Value: node.Token.Literal}
 		if node.Operator == "++" {
-			name := &object.String{Value: node.Token.Literal}
 			e.emit(code.OpInc, e.addConstant(name))
-		} else if node.Operator == "--" {
-			name := &object.String{Value: node.Token.Literal}
-			e.emit(code.OpDec, e.addConstant(name))
 		} else {
-			return fmt.Errorf("unknown postfix operator %s", node.Operator)
+			e.emit(code.OpDec, e.addConstant(name))
 		}
 
 	case *ast.LocalVariable:
 
-		// get the name and declare it as local.
-		e.emit(code.OpConstant, e.addConstant(&object.String{Value: node.Token.Literal}))
-		e.emit(code.OpLocal)
+		// Outside of a function, or loop, there is no local
+		// scope so the variable remains a global.
+		fn := e.locals[len(e.locals)-1]
+		if len(fn.scopes) == 0 {
+			return nil
+		}
+
+		// Otherwise allocate a slot, and clear it.
+		e.emit(code.OpLocal, fn.declare(node.Token.Literal))
 
 	case *ast.ForeachStatement:
 
@@ -283,19 +453,29 @@ func (e *Eval) compile(node ast.Node) error {
 		// over in the post.
 		e.emit(code.OpIterationReset)
 
+		// The loop-variables are local to the
+		// body of the loop.
+		fn := e.locals[len(e.locals)-1]
+		fn.scopes = append(fn.scopes, make(map[string]int))
+		defer func() {
+			fn.scopes = fn.scopes[:len(fn.scopes)-1]
+		}()
+
+		// If there is no index-variable we still
+		// need somewhere to store the index.
+		var index int
+		if node.Index != "" {
+			index = fn.declare(node.Index)
+		} else {
+			index = fn.allocate()
+		}
+		value := fn.declare(node.Ident)
+
 		// Now we're at the start of our loop,
 		// we'll jump back to this point each
 		// time round.
 		start := len(e.instructions)
 
-		// Store the name of the index-variable.
-		str := &object.String{Value: node.Index}
-		e.emit(code.OpConstant, e.addConstant(str))
-
-		// Set the name of the body-variable
-		str = &object.String{Value: node.Ident}
-		e.emit(code.OpConstant, e.addConstant(str))
-
 		// Get the next piece of the iterable,
 		// or push False if that fails..
 		e.emit(code.OpIterationNext)
@@ -303,17 +483,27 @@ func (e *Eval) compile(node ast.Node) error {
 		// jump end
 		end := e.emit(code.OpJumpIfFalse, 9999)
 
+		// Store the item, and its index.
+		e.emit(code.OpSetLocal, value)
+		e.emit(code.OpSetLocal, index)
+
 		// Output the body
+		l := &loop{start: start, foreach: true}
+		e.loops = append(e.loops, l)
 		err = e.compile(node.Body)
+		e.loops = e.loops[:len(e.loops)-1]
 		if err != nil {
-			return nil
+			return err
 		}
 
 		// repeat
 		e.emit(code.OpJump, start)
 
-		// back-patch
+		// back-patch, including any `break` statements.
 		e.changeOperand(end, len(e.instructions))
+		for _, pos := range l.breaks {
+			e.changeOperand(pos, len(e.instructions))
+		}
 
 		// Finally add a "Nop" instruction, one that will not
 		// be optimized away.
@@ -326,82 +516,15 @@ func (e *Eval) compile(node ast.Node) error {
 
 	case *ast.FunctionDefinition:
 
-		//
-		// Hack: Reset the instructions.
-		//
-		// What we're doing here is ensuring that
-		// we start compiling each function-body as
-		// a new set of bytecode.
-		//
-		// Because things like `if` and our `iterators`
-		// have offsets in the generated bytecode we're
-		// going to end up with a chunk of bytecode
-		// for each function that starts from offset
-		// ZERO.
-		//
-		// So:
-		//    blah ..
-		//    blah ..
-		//    function foo() { ... }
-		//    blah ..
-		//    blah ..
-		//
-		// Will _ALWAYS_ result in a new set of bytecode
-		// for the function that has an instruction pointer
-		// starting at offset ZERO.  Regardless of the length
-		// of any preceding bytecode that has already been
-		// generated.
-		//
-		// This is hacky, but it is also safe, because we're
-		// single-threaded.  We CANNOT compile N-function
-		// definitions at the same time.  We'll only do so
-		// sequentially, and nothing else will mess with
-		// vm.instructions behind our back.
-		//
-		before := e.instructions
-		e.instructions = code.Instructions{}
-
-		// Compile the body of the function
-		err := e.compile(node.Body)
+		// Compile the body of the function, which can't
+		// see the local variables of any enclosing function.
+		bytecode, positions, err := e.compileFunction(node.Parameters, node.Body, false)
 		if err != nil {
-
-			// reset our instructions if we
-			// have an error.
-			//
-			// This is not required as errors
-			// will cause termination of our
-			// compiler-function but it feels
-			// like a neat thing to do.
-			e.instructions = before
 			return err
 		}
 
-		//
-		// Ensure that every function will return something.
-		//
-		// We're doing this because we'll be executing the
-		// compiled functions in (essentially) a child-VM.
-		//
-		// Our VM will terminate execution when it hits a
-		// return-statement - so this guarantees that will
-		// happen even in the case of a function like:
-		//
-		//    function alive() { printf("We're alive now\n" ); }
-		//
-		// Without an explicit return there is .. no return
-		// value, and no clean termination.  Instead we'd walk
-		// off the end of our bytecode array.
-		//
-		if len(e.instructions) == 0 ||
-			code.Opcode(e.instructions[len(e.instructions)-1]) != code.OpReturn {
-			e.emit(code.OpVoid)
-			e.emit(code.OpReturn)
-		}
-
-		// Save the bytecode away, remember we generated
-		// in our "internal" instruction space, which we
-		// swapped out for safety.
-		x := environment.UserFunction{Bytecode: e.instructions}
+		// Save the bytecode away.
+		x := environment.UserFunction{Bytecode: bytecode, Positions: positions}
 
 		// Copy the function-arguments.
 		for _, nm := range node.Parameters {
@@ -411,9 +534,24 @@ func (e *Eval) compile(node ast.Node) error {
 		// And save this function-reference by name.
 		e.functions[node.Token.Literal] = x
 
-		// Now we can restore our bytecode to what it was
-		// before we started to deal with the body.
-		e.instructions = before
+	case *ast.FunctionLiteral:
+
+		// Compile the body of the function, which may use
+		// the local variables of enclosing functions.
+		bytecode, positions, err := e.compileFunction(node.Parameters, node.Body, true)
+		if err != nil {
+			return err
+		}
+
+		// Store the function as a constant.
+		fn := &object.Function{Bytecode: bytecode, Positions: positions}
+		for _, nm := range node.Parameters {
+			fn.Arguments = append(fn.Arguments, nm.Value)
+		}
+
+		// At run-time we'll push a copy of that, which
+		// captures any local variables.
+		e.emit(code.OpClosure, e.addConstant(fn))
 
 	case *ast.IfExpression:
 
@@ -794,7 +932,10 @@ func (e *Eval) compile(node ast.Node) error {
 		//
 		// Compile the code in the body
 		//
+		l := &loop{start: cur}
+		e.loops = append(e.loops, l)
 		err = e.compile(node.Body)
+		e.loops = e.loops[:len(e.loops)-1]
 		if err != nil {
 			return err
 		}
@@ -806,9 +947,13 @@ func (e *Eval) compile(node ast.Node) error {
 
 		//
 		// Change the jump to skip the block if the condition
-		// was false.
+		// was false, along with any `break` statements which
+		// also jump to C.
 		//
 		e.changeOperand(jumpNotTruthyPos, len(e.instructions))
+		for _, pos := range l.breaks {
+			e.changeOperand(pos, len(e.instructions))
+		}
 
 		// Finally add a "Nop" instruction, one that will not
 		// be optimized away.
@@ -825,16 +970,28 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
-		// Store the name
-		str := &object.String{Value: node.Name.String()}
-		e.emit(code.OpConstant, e.addConstant(str))
+		// And store it.
+		return e.store(node.Name.String())
 
-		// And make it work.
-		e.emit(code.OpSet)
+	case *ast.IndexAssignStatement:
+
+		// Get the value
+		err := e.compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		// And store it.
+		return e.assign(node.Target)
 
 	case *ast.Identifier:
-		str := &object.String{Value: node.Value}
-		e.emit(code.OpLookup, e.addConstant(str))
+
+		// Ensure the field exists, if we have a schema.
+		if e.schema != nil {
+			e.checkIdentifier(node)
+		}
+
+		return e.load(node.Value)
 
 	case *ast.CallExpression:
 
@@ -865,9 +1022,37 @@ func (e *Eval) compile(node ast.Node) error {
 			}
 		}
 
-		// call - has the string on the stack
-		str := &object.String{Value: node.Function.String()}
-		e.emit(code.OpConstant, e.addConstant(str))
+		// call - has the string on the stack, if we're
+		// calling a function by name.
+		//
+		// Otherwise we're calling a function-value, such
+		// as `h["fn"](3)`, which we push instead.
+		//
+		// A local variable holding a function is called
+		// via its value too.
+		ident, ok := node.Function.(*ast.Identifier)
+		if ok {
+			_, _, ok = e.resolve(ident.Value)
+			ok = !ok
+		}
+		if ok && e.denied(ident.Value) {
+			e.deniedCalls = append(e.deniedCalls, &vm.Error{Position: e.position, Err: &vm.DeniedError{Function: ident.Value}})
+		}
+		if ok && e.signatures[ident.Value] != nil {
+			err := checkArity(e.signatures[ident.Value], args)
+			if err != nil {
+				return e.runError(&vm.Error{Position: e.position, Err: &vm.FunctionError{Function: ident.Value, Err: err}})
+			}
+		}
+		if ok {
+			str := &object.String{Value: node.Function.String()}
+			e.emit(code.OpConstant, e.addConstant(str))
+		} else {
+			err := e.compile(node.Function)
+			if err != nil {
+				return err
+			}
+		}
 
 		// then a call instruction with the number of args.
 		e.emit(code.OpCall, args)
@@ -883,6 +1068,11 @@ func (e *Eval) compile(node ast.Node) error {
 			return err
 		}
 
+		// Ensure the member exists, if we have a schema.
+		if name, ok := node.Index.(*ast.StringLiteral); ok && e.schema != nil {
+			e.checkMember(node.Left, name.Value, node.Token)
+		}
+
 		e.emit(code.OpIndex)
 
 	default:
@@ -891,20 +1081,399 @@ func (e *Eval) compile(node ast.Node) error {
 	return nil
 }
 
+// position returns the position within the source of the given node,
+// if it is known.
+func position(node ast.Node) (code.Position, bool) {
+
+	var tok token.Token
+
+	switch node := node.(type) {
+	case *ast.ArrayLiteral:
+		tok = node.Token
+	case *ast.AssignStatement:
+		tok = node.Token
+	case *ast.BlockStatement:
+		tok = node.Token
+	case *ast.BooleanLiteral:
+		tok = node.Token
+	case *ast.BreakStatement:
+		tok = node.Token
+	case *ast.CallExpression:
+		tok = node.Token
+	case *ast.ContinueStatement:
+		tok = node.Token
+	case *ast.DurationLiteral:
+		tok = node.Token
+	case *ast.ExpressionStatement:
+		tok = node.Token
+	case *ast.FloatLiteral:
+		tok = node.Token
+	case *ast.ForeachStatement:
+		tok = node.Token
+	case *ast.FunctionDefinition:
+		tok = node.Token
+	case *ast.FunctionLiteral:
+		tok = node.Token
+	case *ast.HashLiteral:
+		tok = node.Token
+	case *ast.Identifier:
+		tok = node.Token
+	case *ast.IndexAssignStatement:
+		tok = node.Token
+	case *ast.IfExpression:
+		tok = node.Token
+	case *ast.IndexExpression:
+		tok = node.Token
+	case *ast.InfixExpression:
+		tok = node.Token
+	case *ast.IntegerLiteral:
+		tok = node.Token
+	case *ast.LocalVariable:
+		tok = node.Token
+	case *ast.PostfixExpression:
+		tok = node.Token
+	case *ast.PrefixExpression:
+		tok = node.Token
+	case *ast.RegexpLiteral:
+		tok = node.Token
+	case *ast.ReturnStatement:
+		tok = node.Token
+	case *ast.StringLiteral:
+		tok = node.Token
+	case *ast.SwitchExpression:
+		tok = node.Token
+	case *ast.TernaryExpression:
+		tok = node.Token
+	case *ast.WhileStatement:
+		tok = node.Token
+	}
+
+	if tok.Line == 0 {
+		return code.Position{}, false
+	}
+	return code.Position{Line: tok.Line, Column: tok.Column}, true
+}
+
+// compileLogical compiles the `&&` and `||` operators, which only
+// evaluate their right-hand side if the left-hand side doesn't already
+// decide the result.
+//
+// For `a && b` we emit:
+//
+//	    a
+//	    if ! a jmp FALSE
+//	    b
+//	    if ! b jmp FALSE
+//	    OpTrue
+//	    jmp END
+//	FALSE:
+//	    OpFalse
+//	END:
+//	    OpPlaceholder
+//
+// For `a || b` we emit:
+//
+//	    a
+//	    if ! a jmp RIGHT
+//	    OpTrue
+//	    jmp END
+//	RIGHT:
+//	    b
+//	    if ! b jmp FALSE
+//	    OpTrue
+//	    jmp END
+//	FALSE:
+//	    OpFalse
+//	END:
+//	    OpPlaceholder
+//
+// In both cases the result is always a boolean.
+func (e *Eval) compileLogical(node *ast.InfixExpression) error {
+
+	err := e.compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	// The jumps to END, which we'll patch at the end.
+	var ends []int
+
+	// Test the left-hand side - placeholder
+	left := e.emit(code.OpJumpIfFalse, 9999)
+
+	// For `||` a true left-hand side is the result.
+	if node.Operator == "||" {
+		e.emit(code.OpTrue)
+		ends = append(ends, e.emit(code.OpJump, 9999))
+		e.changeOperand(left, len(e.instructions))
+	}
+
+	err = e.compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	// Test the right-hand side - placeholder
+	right := e.emit(code.OpJumpIfFalse, 9999)
+
+	e.emit(code.OpTrue)
+	ends = append(ends, e.emit(code.OpJump, 9999))
+
+	// Now we're at the FALSE handler.
+	if node.Operator == "&&" {
+		e.changeOperand(left, len(e.instructions))
+	}
+	e.changeOperand(right, len(e.instructions))
+	e.emit(code.OpFalse)
+
+	// And finally the END.
+	for _, pos := range ends {
+		e.changeOperand(pos, len(e.instructions))
+	}
+
+	// Add an instruction which won't be optimized away, because
+	// our "jmp END" might otherwise point beyond the program.
+	e.emit(code.OpPlaceholder)
+	return nil
+}
+
+// compileFunction compiles the body of a function, returning the bytecode
+// and the positions of the source which generated it.
+//
+// The arguments are stored in the first slots of the function's local
+// variables.  If closure is true the function may also use the local
+// variables of the functions which enclose it.
+func (e *Eval) compileFunction(params []*ast.Identifier, body *ast.BlockStatement, closure bool) (code.Instructions, code.Positions, error) {
+
+	//
+	// Hack: Reset the instructions.
+	//
+	// What we're doing here is ensuring that
+	// we start compiling each function-body as
+	// a new set of bytecode.
+	//
+	// Because things like `if` and our `iterators`
+	// have offsets in the generated bytecode we're
+	// going to end up with a chunk of bytecode
+	// for each function that starts from offset
+	// ZERO.
+	//
+	// So:
+	//    blah ..
+	//    blah ..
+	//    function foo() { ... }
+	//    blah ..
+	//    blah ..
+	//
+	// Will _ALWAYS_ result in a new set of bytecode
+	// for the function that has an instruction pointer
+	// starting at offset ZERO.  Regardless of the length
+	// of any preceding bytecode that has already been
+	// generated.
+	//
+	// This is hacky, but it is also safe, because we're
+	// single-threaded.  We CANNOT compile N-function
+	// definitions at the same time.  We'll only do so
+	// sequentially, and nothing else will mess with
+	// vm.instructions behind our back.
+	//
+	before := e.instructions
+	e.instructions = code.Instructions{}
+
+	// The same applies to the positions of the
+	// instructions.
+	beforePositions := e.positions
+	e.positions = make(code.Positions)
+
+	// Loops outside the function cannot be exited
+	// from within it.
+	beforeLoops := e.loops
+	e.loops = nil
+
+	// The function has its own local variables.
+	beforeLocals := e.locals
+	fn := &locals{scopes: []map[string]int{make(map[string]int)}}
+	for _, param := range params {
+		fn.scopes[0][param.Value] = fn.allocate()
+	}
+	if closure {
+		e.locals = append(e.locals, fn)
+	} else {
+		e.locals = []*locals{fn}
+	}
+
+	// Now we can restore our bytecode to what it was
+	// before we started to deal with the body, when
+	// we're done.
+	defer func() {
+		e.instructions = before
+		e.positions = beforePositions
+		e.loops = beforeLoops
+		e.locals = beforeLocals
+	}()
+
+	// Compile the body of the function
+	err := e.compile(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//
+	// Ensure that every function will return something.
+	//
+	// We're doing this because we'll be executing the
+	// compiled functions in (essentially) a child-VM.
+	//
+	// Our VM will terminate execution when it hits a
+	// return-statement - so this guarantees that will
+	// happen even in the case of a function like:
+	//
+	//    function alive() { printf("We're alive now\n" ); }
+	//
+	// Without an explicit return there is .. no return
+	// value, and no clean termination.  Instead we'd walk
+	// off the end of our bytecode array.
+	//
+	if len(e.instructions) == 0 ||
+		code.Opcode(e.instructions[len(e.instructions)-1]) != code.OpReturn {
+		e.emit(code.OpVoid)
+		e.emit(code.OpReturn)
+	}
+
+	return e.instructions, e.positions, nil
+}
+
+// resolve finds the slot of the named local variable.
+//
+// The depth is zero for a variable of the function we're compiling, one
+// for the function which encloses it, and so on.  If the variable isn't
+// local then ok is false.
+func (e *Eval) resolve(name string) (depth int, slot int, ok bool) {
+	for depth = 0; depth < len(e.locals); depth++ {
+		fn := e.locals[len(e.locals)-1-depth]
+		for i := len(fn.scopes) - 1; i >= 0; i-- {
+			if slot, ok = fn.scopes[i][name]; ok {
+				return depth, slot, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// outer returns the argument for OpGetOuter, or OpSetOuter, which holds
+// the depth in the high 16-bits, and the slot in the low 16-bits.
+//
+// As the depth is never zero the argument is always stored with an
+// OpWide prefix.
+func outer(name string, depth, slot int) (int, error) {
+	if depth > 0xFFFF || slot > 0xFFFF {
+		return 0, fmt.Errorf("cannot capture %s, there are too many local variables", name)
+	}
+	return depth<<16 | slot, nil
+}
+
+// load generates the code to push the value of the named variable.
+func (e *Eval) load(name string) error {
+
+	depth, slot, ok := e.resolve(name)
+	switch {
+	case !ok:
+		str := &object.String{Value: name}
+		e.emit(code.OpLookup, e.addConstant(str))
+	case depth == 0:
+		e.emit(code.OpGetLocal, slot)
+	default:
+		arg, err := outer(name, depth, slot)
+		if err != nil {
+			return err
+		}
+		e.emit(code.OpGetOuter, arg)
+	}
+	return nil
+}
+
+// store generates the code to store the value which is upon the top of
+// the stack into the named variable.
+func (e *Eval) store(name string) error {
+
+	depth, slot, ok := e.resolve(name)
+	switch {
+	case !ok:
+		str := &object.String{Value: name}
+		e.emit(code.OpConstant, e.addConstant(str))
+		e.emit(code.OpSet)
+	case depth == 0:
+		e.emit(code.OpSetLocal, slot)
+	default:
+		arg, err := outer(name, depth, slot)
+		if err != nil {
+			return err
+		}
+		e.emit(code.OpSetOuter, arg)
+	}
+	return nil
+}
+
+// assign generates the code to store the value which is upon the top of
+// the stack into the given target.
+//
+// The target is either a variable, or an element of an array or hash:
+//
+//	a[1] = 3;
+//	-> 3
+//	-> a
+//	-> 1
+//	OpSetIndex
+//	OpSet a
+//
+// OpSetIndex produces an updated copy of the array, which is then stored
+// in its turn.  That way nested targets such as `a[1]["name"]` work.
+func (e *Eval) assign(target ast.Expression) error {
+
+	var left, index ast.Expression
+
+	switch node := target.(type) {
+	case *ast.Identifier:
+		return e.store(node.Token.Literal)
+	case *ast.IndexExpression:
+		left = node.Left
+		index = node.Index
+	case *ast.InfixExpression:
+		if node.Operator != "." {
+			return fmt.Errorf("cannot assign to %s", node.String())
+		}
+		left = node.Left
+		index = node.Right
+	default:
+		return fmt.Errorf("cannot assign to %s", target.String())
+	}
+
+	err := e.compile(left)
+	if err != nil {
+		return err
+	}
+	err = e.compile(index)
+	if err != nil {
+		return err
+	}
+	e.emit(code.OpSetIndex)
+
+	return e.assign(left)
+}
+
 // addConstant adds a constant to the pool
 func (e *Eval) addConstant(obj object.Object) int {
 
 	//
-	// Look to see if the constant is present already
+	// Look to see if the constant is present already,
+	// with the same type and value.
 	//
-	for i, c := range e.constants {
-
-		//
-		// If the existing constant has the same
-		// type and value - then return the offset.
-		//
-		if c.Type() == obj.Type() &&
-			c.Inspect() == obj.Inspect() {
+	// Functions are never shared, as two functions
+	// with the same arguments have different bodies.
+	//
+	key := constantKey{typ: obj.Type(), value: obj.Inspect()}
+	if key.typ != object.FUNCTION {
+		if i, ok := e.constantIndex[key]; ok {
 			return i
 		}
 	}
@@ -914,28 +1483,37 @@ func (e *Eval) addConstant(obj object.Object) int {
 	// be added.
 	//
 	e.constants = append(e.constants, obj)
+	e.constantIndex[key] = len(e.constants) - 1
 	return len(e.constants) - 1
 }
 
 // emit generates a bytecode operation, and adds it to our program-array.
+//
+// Arguments which don't fit in 16-bits are stored with an OpWide prefix,
+// as are the targets of jumps if we've found our program is too large
+// for those to fit.
 func (e *Eval) emit(op code.Opcode, operands ...int) int {
 
-	ins := make([]byte, 1)
-	ins[0] = byte(op)
-
+	arg := 0
 	if len(operands) == 1 {
+		arg = operands[0]
+	}
 
-		// Make a buffer for the arg
-		b := make([]byte, 2)
-		binary.BigEndian.PutUint16(b, uint16(operands[0]))
-
-		// append
-		ins = append(ins, b...)
+	if arg < 0 || int64(arg) > code.MaxOperand {
+		e.fail(fmt.Errorf("the argument %d of %s is too large", arg, code.String(op)))
 	}
 
+	wide := e.wideJumps && (op == code.OpJump || op == code.OpJumpIfFalse)
+	ins := code.Make(op, arg, wide)
+
 	posNewInstruction := len(e.instructions)
 	e.instructions = append(e.instructions, ins...)
 
+	// Record the source of the instruction, if known.
+	if e.position.Line > 0 {
+		e.positions[posNewInstruction] = e.position
+	}
+
 	return posNewInstruction
 }
 
@@ -970,12 +1548,28 @@ func (e *Eval) changeOperand(opPos int, operand int) {
 	// in-place.
 	//
 
-	// Make a buffer for the arg, which we can
-	// use to split it into two bytes.
-	b := make([]byte, 2)
-	binary.BigEndian.PutUint16(b, uint16(operand))
+	// If the target doesn't fit in 16-bits we'll
+	// have to start again, with wider jumps.
+	//
+	op := code.Opcode(e.instructions[opPos])
+	wide := op == code.OpWide
+	if wide {
+		op = code.Opcode(e.instructions[opPos+1])
+	} else if operand > 0xFFFF {
+		e.tooLarge = true
+		return
+	}
 
 	// replace the argument in-place
-	e.instructions[opPos+1] = b[0]
-	e.instructions[opPos+2] = b[1]
+	copy(e.instructions[opPos:], code.Make(op, operand, wide))
+}
+
+// fail records an error found while generating bytecode, which will
+// cause compilation to fail.
+//
+// Only the first error is kept.
+func (e *Eval) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
 }
@@ -3,26 +3,160 @@
 package environment
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"os"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/skx/evalfilter/v2/object"
 )
 
-// regCache is a cache of compiled regular expression objects.
-// These may persist between runs because a regular expression object
-// is essentially constant.
-var regCache map[string]*regexp.Regexp
+// regexpCacheSize is the number of compiled regular expressions we
+// cache, for the patterns which are only known at run-time.
+//
+// Regular expression literals are compiled along with the script, so
+// they don't need to be cached.
+const regexpCacheSize = 256
+
+// regexpCache is a least-recently-used cache of compiled regular
+// expressions, which may be used concurrently.
+type regexpCache struct {
+
+	// mutex guards our state.
+	mutex sync.Mutex
+
+	// size is the maximum number of entries we hold.
+	size int
+
+	// entries maps each pattern to its position in order.
+	entries map[string]*list.Element
+
+	// order holds our entries, the most recently used first.
+	order *list.List
+}
+
+// regexpEntry is an entry in our regexpCache.
+type regexpEntry struct {
+	pattern  string
+	compiled *object.Regexp
+}
+
+// regCache holds the regular expressions which have been compiled at
+// run-time.
+var regCache = newRegexpCache(regexpCacheSize)
+
+// newRegexpCache creates a cache which holds the given number of
+// compiled regular expressions.
+func newRegexpCache(size int) *regexpCache {
+	return &regexpCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the compiled version of the given pattern, compiling it
+// if it isn't already present in the cache.
+func (c *regexpCache) get(pattern string) (*object.Regexp, error) {
+
+	// Look for the compiled regular-expression object in our cache.
+	c.mutex.Lock()
+	if el, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(el)
+		c.mutex.Unlock()
+		return el.Value.(*regexpEntry).compiled, nil
+	}
+	c.mutex.Unlock()
+
+	// OK it wasn't found, so compile it.
+	r, err := object.NewRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
 
-// init ensures that our regexp cache is populated
-func init() {
-	regCache = make(map[string]*regexp.Regexp)
+	// store in the cache for next time, discarding the least
+	// recently used entry if we're full.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[pattern]; !ok {
+		c.entries[pattern] = c.order.PushFront(&regexpEntry{pattern: pattern, compiled: r})
+
+		if c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*regexpEntry).pattern)
+		}
+	}
+	return r, nil
+}
+
+// compileRegexp returns the compiled version of the given regular
+// expression.
+//
+// Regular expression literals were compiled along with the script, other
+// patterns are compiled now, using our cache where possible.
+func compileRegexp(reg object.Object) (*object.Regexp, error) {
+
+	if r, ok := reg.(*object.Regexp); ok && r.Compiled() != nil {
+		return r, nil
+	}
+
+	r, err := regCache.get(reg.Inspect())
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %s: %s", reg.Inspect(), err.Error())
+	}
+	return r, nil
+}
+
+// matchInput returns the strings the given regular expression should be
+// matched against.
+//
+// Usually each line of the input is matched separately, with leading and
+// trailing whitespace removed, but if the expression has the "w" flag the
+// whole input is used.
+func matchInput(r *object.Regexp, str string) []string {
+
+	if r.Whole() {
+		return []string{str}
+	}
+
+	lines := strings.Split(str, "\n")
+	for i, s := range lines {
+		lines[i] = strings.TrimSpace(s)
+	}
+	return lines
+}
+
+// Captures returns the text of the first match of the given regular
+// expression within the input, followed by the text of each of the
+// expression's capture groups, or nil if there is no match.
+//
+// Matching is done in the same way as the `match` function.
+func Captures(str string, reg object.Object) ([]string, error) {
+
+	r, err := compileRegexp(reg)
+	if err != nil {
+		return nil, err
+	}
+	return captures(r, str), nil
+}
+
+// captures implements Captures, for an expression we've compiled.
+func captures(r *object.Regexp, str string) []string {
+
+	for _, s := range matchInput(r, str) {
+		if m := r.Compiled().FindStringSubmatch(s); m != nil {
+			return m
+		}
+	}
+	return nil
 }
 
 // fnBetween is the implementation of our between function.
@@ -65,6 +199,51 @@ func fnBetween(args []object.Object) object.Object {
 	return &object.Boolean{Value: true}
 }
 
+// fnCaptures is the implementation of our `captures` function.
+//
+// It returns an array of the whole match, and each capture group, or a
+// hash of the named capture groups if there are any.
+func fnCaptures(ctx context.Context, args []object.Object) (object.Object, error) {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Null{}, nil
+	}
+
+	r, err := compileRegexp(args[1])
+	if err != nil {
+		return nil, err
+	}
+	m := captures(r, args[0].Inspect())
+
+	// Named groups result in a hash.
+	named := false
+	for _, name := range r.Compiled().SubexpNames() {
+		if name != "" {
+			named = true
+		}
+	}
+
+	if named {
+		pairs := make(map[object.HashKey]object.HashPair)
+		for i, name := range r.Compiled().SubexpNames() {
+			if name == "" || m == nil {
+				continue
+			}
+			key := &object.String{Value: name}
+			pairs[key.HashKey()] = object.HashPair{Key: key, Value: &object.String{Value: m[i]}}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+	}
+
+	// Otherwise an array.
+	elements := make([]object.Object, len(m))
+	for i, v := range m {
+		elements[i] = &object.String{Value: v}
+	}
+	return &object.Array{Elements: elements}, nil
+}
+
 // fnFloat is the implementation of the `float` function.
 //
 // It converts an object to a float, if it can.
@@ -115,6 +294,15 @@ func fnInt(args []object.Object) object.Object {
 		return &object.Null{}
 	}
 
+	// Times are converted to seconds past the epoch, and durations
+	// to a number of seconds.
+	switch arg := args[0].(type) {
+	case *object.Time:
+		return &object.Integer{Value: arg.Value.Unix()}
+	case *object.Duration:
+		return &object.Integer{Value: int64(arg.Value / time.Second)}
+	}
+
 	// Stringify
 	str := args[0].Inspect()
 
@@ -242,46 +430,30 @@ func fnLower(args []object.Object) object.Object {
 }
 
 // fnMatch is the implementation of our regex `match` function.
-func fnMatch(args []object.Object) object.Object {
+func fnMatch(ctx context.Context, args []object.Object) (object.Object, error) {
 
 	// We expect two arguments
 	if len(args) != 2 {
-		return &object.Boolean{Value: false}
+		return &object.Boolean{Value: false}, nil
 	}
 
 	str := args[0].Inspect()
-	reg := args[1].Inspect()
-
-	// Look for the compiled regular-expression object in our cache.
-	r, ok := regCache[reg]
-	if !ok {
-
-		// OK it wasn't found, so compile it.
-		var err error
-		r, err = regexp.Compile(reg)
 
-		// Ensure it compiled
-		if err != nil {
-			fmt.Printf("Invalid regular expression %s %s", reg, err.Error())
-			return &object.Boolean{Value: false}
-		}
-
-		// store in the cache for next time
-		regCache[reg] = r
+	// Get the compiled regular-expression object.
+	r, err := compileRegexp(args[1])
+	if err != nil {
+		return nil, err
 	}
 
-	// Split the input by newline.
-	for _, s := range strings.Split(str, "\n") {
-
-		// Strip leading-trailing whitespace
-		s = strings.TrimSpace(s)
+	// Test each line, or the whole input.
+	for _, s := range matchInput(r, str) {
 
 		// Test if it matched
-		if r.MatchString(s) {
-			return &object.Boolean{Value: true}
+		if r.Compiled().MatchString(s) {
+			return &object.Boolean{Value: true}, nil
 		}
 	}
-	return &object.Boolean{Value: false}
+	return &object.Boolean{Value: false}, nil
 }
 
 // fnMax is the implementation of our `max` function.
@@ -333,24 +505,42 @@ func fnMin(args []object.Object) object.Object {
 }
 
 // fnNow is the implementation of our `now` function.
-func fnNow(args []object.Object) object.Object {
+func (e *Environment) fnNow(args []object.Object) object.Object {
+	return &object.Time{Value: e.Now()}
+}
 
-	// Handle timezones, by reading $TZ, and if not set
-	// defaulting to UTC.
-	env := os.Getenv("TZ")
-	if env == "" {
-		env = "UTC"
+// fnParseTime is the implementation of our `parse_time` function.
+//
+// The value is parsed with the given layout, as used by golang's
+// time.Parse, or as RFC3339 if there is no layout.  Values which don't
+// include a timezone are assumed to be in the named zone, if given, or
+// our location.  Values which can't be parsed result in null.
+func (e *Environment) fnParseTime(ctx context.Context, args []object.Object) (object.Object, error) {
+
+	// We expect one to three arguments
+	if len(args) < 1 || len(args) > 3 {
+		return &object.Null{}, nil
 	}
 
-	now := time.Now()
+	layout := time.RFC3339
+	if len(args) > 1 {
+		layout = args[1].Inspect()
+	}
 
-	// Ensure we set that timezone.
-	loc, err := time.LoadLocation(env)
-	if err == nil {
-		now = now.In(loc)
+	loc := e.Location()
+	if len(args) > 2 {
+		var err error
+		loc, err = loadZone(args[2].Inspect())
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &object.Integer{Value: now.Unix()}
+	t, err := time.ParseInLocation(layout, args[0].Inspect(), loc)
+	if err != nil {
+		return &object.Null{}, nil
+	}
+	return &object.Time{Value: t}, nil
 }
 
 // fnSplit is the implementation of our `split` primitive.
@@ -444,15 +634,17 @@ func fnPanic(args []object.Object) (out object.Object) {
 }
 
 // fnPrint is the implementation of our `print` function.
-func fnPrint(args []object.Object) object.Object {
-	for _, e := range args {
-		fmt.Printf("%s", e.Inspect())
+func (e *Environment) fnPrint(args []object.Object) object.Object {
+	var out strings.Builder
+	for _, arg := range args {
+		out.WriteString(arg.Inspect())
 	}
+	e.Print(out.String())
 	return &object.Void{}
 }
 
 // fnPrintf is the implementation of our `printf` function.
-func fnPrintf(args []object.Object) object.Object {
+func (e *Environment) fnPrintf(args []object.Object) object.Object {
 
 	// Convert to the formatted version, via our `sprintf`
 	// function.
@@ -460,7 +652,7 @@ func fnPrintf(args []object.Object) object.Object {
 
 	// If that returned a string then we can print it
 	if out.Type() == object.STRING {
-		fmt.Print(out.(*object.String).Value)
+		e.Print(out.(*object.String).Value)
 
 	}
 
@@ -501,38 +693,25 @@ func fnSort(args []object.Object) object.Object {
 }
 
 // fnReplace replaces the contents of a regexp with a string
-func fnReplace(args []object.Object) object.Object {
+func fnReplace(ctx context.Context, args []object.Object) (object.Object, error) {
 
 	// We expect two arguments
 	if len(args) != 3 {
-		return &object.Null{}
+		return &object.Null{}, nil
 	}
 
 	str := args[0].Inspect()
-	reg := args[1].Inspect()
 	replace := args[2].Inspect()
 
 
-	// Look for the compiled regular-expression object in our cache.
-	r, ok := regCache[reg]
-	if !ok {
-
-		// OK it wasn't found, so compile it.
-		var err error
-		r, err = regexp.Compile(reg)
-
-		// Ensure it compiled
-		if err != nil {
-			fmt.Printf("Invalid regular expression %s %s", reg, err.Error())
-			return &object.Boolean{Value: false}
-		}
-
-		// store in the cache for next time
-		regCache[reg] = r
+	// Get the compiled regular-expression object.
+	r, err := compileRegexp(args[1])
+	if err != nil {
+		return nil, err
 	}
 
-	out := r.ReplaceAll([]byte(str), []byte(replace))
-	return &object.String{Value: string(out)}
+	out := r.Compiled().ReplaceAll([]byte(str), []byte(replace))
+	return &object.String{Value: string(out)}, nil
 }
 
 // fnReverse implements our `reverse` function
@@ -687,34 +866,45 @@ func fnUpper(args []object.Object) object.Object {
 	return &object.String{Value: arg}
 }
 
-// getTimeField handles returning a time-related field from an object
-// which is assumed to contain a time in the Unix Epoch format.
-func getTimeField(args []object.Object, val string) object.Object {
+// loadZone returns the named timezone.
+func loadZone(name string) (*time.Location, error) {
 
-	// We expect one argument
-	if len(args) != 1 {
-		return &object.Null{}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s: %s", name, err.Error())
 	}
+	return loc, nil
+}
 
-	// It must be an integer
-	if args[0].Type() != object.INTEGER {
-		return &object.Null{}
+// toTime converts the given object to a time, if it is a time or an
+// integer containing seconds past the Unix epoch.
+//
+// Integers are presented in our location, times keep their own.
+func (e *Environment) toTime(obj object.Object) (time.Time, bool) {
+
+	switch obj := obj.(type) {
+	case *object.Time:
+		return obj.Value, true
+	case *object.Integer:
+		return time.Unix(obj.Value, 0).In(e.Location()), true
 	}
+	return time.Time{}, false
+}
 
-	// Convert that to a time
-	ts := time.Unix(args[0].(*object.Integer).Value, 0)
+// getTimeField handles returning a time-related field from an object
+// which is either a time, or an integer containing a time in the Unix
+// Epoch format.
+func (e *Environment) getTimeField(args []object.Object, val string) object.Object {
 
-	// Handle timezones, by reading $TZ, and if not set
-	// defaulting to UTC.
-	env := os.Getenv("TZ")
-	if env == "" {
-		env = "UTC"
+	// We expect one argument
+	if len(args) != 1 {
+		return &object.Null{}
 	}
 
-	// Ensure we set that timezone.
-	loc, err := time.LoadLocation(env)
-	if err == nil {
-		ts = ts.In(loc)
+	// It must be a time, or an integer
+	ts, ok := e.toTime(args[0])
+	if !ok {
+		return &object.Null{}
 	}
 
 	// Now get the fields
@@ -744,36 +934,129 @@ func getTimeField(args []object.Object, val string) object.Object {
 }
 
 // fnHour returns the hour of the given time-object.
-func fnHour(args []object.Object) object.Object {
-	return getTimeField(args, "hour")
+func (e *Environment) fnHour(args []object.Object) object.Object {
+	return e.getTimeField(args, "hour")
 }
 
 // fnMinute returns the minute of the given time-object.
-func fnMinute(args []object.Object) object.Object {
-	return getTimeField(args, "minute")
+func (e *Environment) fnMinute(args []object.Object) object.Object {
+	return e.getTimeField(args, "minute")
 }
 
 // fnSeconds returns the seconds of the given time-object.
-func fnSeconds(args []object.Object) object.Object {
-	return getTimeField(args, "seconds")
+func (e *Environment) fnSeconds(args []object.Object) object.Object {
+	return e.getTimeField(args, "seconds")
 }
 
 // fnDay returns the day of the given time-object.
-func fnDay(args []object.Object) object.Object {
-	return getTimeField(args, "day")
+func (e *Environment) fnDay(args []object.Object) object.Object {
+	return e.getTimeField(args, "day")
 }
 
 // fnMonth returns the month of the given time-object.
-func fnMonth(args []object.Object) object.Object {
-	return getTimeField(args, "month")
+func (e *Environment) fnMonth(args []object.Object) object.Object {
+	return e.getTimeField(args, "month")
 }
 
 // fnYear returns the year of the given time-object.
-func fnYear(args []object.Object) object.Object {
-	return getTimeField(args, "year")
+func (e *Environment) fnYear(args []object.Object) object.Object {
+	return e.getTimeField(args, "year")
 }
 
 // fnWeekday returns the name of the day in the given time-object.
-func fnWeekday(args []object.Object) object.Object {
-	return getTimeField(args, "weekday")
+func (e *Environment) fnWeekday(args []object.Object) object.Object {
+	return e.getTimeField(args, "weekday")
+}
+
+// fnInTimezone returns the given time in the named timezone.
+func (e *Environment) fnInTimezone(ctx context.Context, args []object.Object) (object.Object, error) {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Null{}, nil
+	}
+
+	ts, ok := e.toTime(args[0])
+	if !ok {
+		return &object.Null{}, nil
+	}
+
+	loc, err := loadZone(args[1].Inspect())
+	if err != nil {
+		return nil, err
+	}
+	return &object.Time{Value: ts.In(loc)}, nil
+}
+
+// strftime maps the directives our `strftime` function understands to
+// the equivalent golang layouts.
+var strftime = map[rune]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'e': "_2",
+	'F': "2006-01-02",
+	'H': "15",
+	'I': "03",
+	'j': "002",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'S': "05",
+	'T': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+}
+
+// fnStrftime is the implementation of our `strftime` function, which
+// formats a time using C-style directives such as "%Y-%m-%d".
+func (e *Environment) fnStrftime(args []object.Object) object.Object {
+
+	// We expect two arguments
+	if len(args) != 2 {
+		return &object.Null{}
+	}
+
+	ts, ok := e.toTime(args[0])
+	if !ok {
+		return &object.Null{}
+	}
+
+	var out strings.Builder
+
+	format := []rune(args[1].Inspect())
+	for i := 0; i < len(format); i++ {
+
+		if format[i] != '%' || i+1 == len(format) {
+			out.WriteRune(format[i])
+			continue
+		}
+
+		i++
+		switch c := format[i]; c {
+		case '%':
+			out.WriteRune('%')
+		case 's':
+			out.WriteString(strconv.FormatInt(ts.Unix(), 10))
+		default:
+			if layout, ok := strftime[c]; ok {
+				out.WriteString(ts.Format(layout))
+			} else {
+				out.WriteRune('%')
+				out.WriteRune(c)
+			}
+		}
+	}
+
+	return &object.String{Value: out.String()}
+}
+
+// fnTime is the implementation of our `time` function, which returns the
+// current time as seconds past the Unix epoch.
+func (e *Environment) fnTime(args []object.Object) object.Object {
+	return &object.Integer{Value: e.Now().Unix()}
 }
@@ -1,7 +1,13 @@
 package environment
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -247,6 +253,8 @@ func TestInt(t *testing.T) {
 		{Input: &object.Integer{Value: 3}, Result: &object.Integer{Value: 3}},
 		{Input: &object.String{Value: "3"}, Result: &object.Integer{Value: 3}},
 		{Input: &object.Boolean{Value: true}, Result: &object.Null{}},
+		{Input: &object.Time{Value: time.Unix(195315316, 0)}, Result: &object.Integer{Value: 195315316}},
+		{Input: &object.Duration{Value: 90 * time.Second}, Result: &object.Integer{Value: 90}},
 	}
 
 	// For each test
@@ -550,9 +558,12 @@ func TestMatch(t *testing.T) {
 		{String: "Steve", Regexp: "^steve$", Result: false},
 		{String: "Steve", Regexp: "^steve$", Result: false},
 
-		// invalid regexp
-		{String: "Steve", Regexp: "+", Result: false},
-		{String: "Steve", Regexp: "+", Result: false},
+		// Each line is matched, unless the "w" flag is used
+		{String: "one\n two \nthree", Regexp: "^two$", Result: true},
+		{String: "one\n two \nthree", Regexp: "(?s)^two$", Result: true},
+		{String: "one\n two \nthree", Regexp: "(?w)^two$", Result: false},
+		{String: "one\n two \nthree", Regexp: "(?sw)^one.*three$", Result: true},
+		{String: "one\n two \nthree", Regexp: "(?w)^one.*three$", Result: false},
 	}
 
 	for _, test := range tests {
@@ -562,7 +573,7 @@ func TestMatch(t *testing.T) {
 		args = append(args, &object.String{Value: test.String})
 		args = append(args, &object.String{Value: test.Regexp})
 
-		res := fnMatch(args)
+		res, _ := fnMatch(context.Background(), args)
 
 		if res.(*object.Boolean).Value != test.Result {
 			t.Errorf("Invalid result for %s =~ /%s/", test.String, test.Regexp)
@@ -572,13 +583,170 @@ func TestMatch(t *testing.T) {
 
 	// Calling the function with != 2 arguments should return false
 	var args []object.Object
-	out := fnMatch(args)
+	out, _ := fnMatch(context.Background(), args)
 	if out.(*object.Boolean).Value != false {
 		t.Errorf("no arguments returns a weird result")
 	}
 
 }
 
+// Test capture groups are returned.
+func TestCaptures(t *testing.T) {
+
+	type TestCase struct {
+		String string
+		Regexp string
+		Result string
+	}
+
+	tests := []TestCase{
+		{String: "Re: [TICKET-1234] help", Regexp: "([A-Z]+)-(\\d+)", Result: "[TICKET-1234, TICKET, 1234]"},
+		{String: "Re: [TICKET-1234] help", Regexp: "(?P<project>[A-Z]+)-(?P<id>\\d+)", Result: "{id: 1234, project: TICKET}"},
+
+		// No match
+		{String: "Steve", Regexp: "(\\d+)", Result: "[]"},
+		{String: "Steve", Regexp: "(?P<id>\\d+)", Result: "{}"},
+
+		// Lines are matched separately, and trimmed
+		{String: "one\n  two  \nthree", Regexp: "^(t.*)$", Result: "[two, two]"},
+
+		// Unless the "w" flag is used
+		{String: "one\n  two  \nthree", Regexp: "(?sw)^one(.*)$", Result: "[one\n  two  \nthree, \n  two  \nthree]"},
+		{String: "one\n  two  \nthree", Regexp: "(?sw)^(t.*)$", Result: "[]"},
+		{String: "one\n  two  \nthree", Regexp: "(?s)^(t.*)$", Result: "[two, two]"},
+	}
+
+	for _, test := range tests {
+
+		args := []object.Object{
+			&object.String{Value: test.String},
+			&object.String{Value: test.Regexp},
+		}
+
+		res, _ := fnCaptures(context.Background(), args)
+		if res.Inspect() != test.Result {
+			t.Errorf("Invalid result for captures(%s, %s): got %s, expected %s", test.String, test.Regexp, res.Inspect(), test.Result)
+		}
+	}
+
+	// Calling the function with != 2 arguments should return null
+	var args []object.Object
+	out, _ := fnCaptures(context.Background(), args)
+	if out.Type() != object.NULL {
+		t.Errorf("no arguments returns a weird result")
+	}
+}
+
+// Invalid regular expressions are reported as errors.
+func TestMatchInvalid(t *testing.T) {
+
+	tests := map[string][]object.Object{
+		"captures": {&object.String{Value: "Steve"}, &object.String{Value: "+"}},
+		"match":    {&object.String{Value: "Steve"}, &object.String{Value: "+"}},
+		"replace":  {&object.String{Value: "Steve"}, &object.String{Value: "+"}, &object.String{Value: "X"}},
+	}
+
+	for name, args := range tests {
+
+		var err error
+		switch name {
+		case "captures":
+			_, err = fnCaptures(context.Background(), args)
+		case "match":
+			_, err = fnMatch(context.Background(), args)
+		case "replace":
+			_, err = fnReplace(context.Background(), args)
+		}
+
+		if err == nil {
+			t.Fatalf("%s: expected error, got none", name)
+		}
+		if !strings.Contains(err.Error(), "invalid regular expression +") {
+			t.Errorf("%s: unexpected error: %s", name, err.Error())
+		}
+	}
+}
+
+// Test that compiled regular expressions are used directly.
+func TestMatchCompiled(t *testing.T) {
+
+	reg, err := object.NewRegexp("^Steve (Kemp)?$")
+	if err != nil {
+		t.Fatalf("failed to compile regexp: %s", err)
+	}
+
+	res, _ := fnMatch(context.Background(), []object.Object{&object.String{Value: "Steve Kemp"}, reg})
+	if !res.(*object.Boolean).Value {
+		t.Errorf("compiled regexp failed to match")
+	}
+
+	if _, ok := regCache.entries["^Steve (Kemp)?$"]; ok {
+		t.Errorf("compiled regexp should not have been cached")
+	}
+}
+
+// Test our cache of regular expressions is bounded.
+func TestRegexpCache(t *testing.T) {
+
+	c := newRegexpCache(2)
+
+	for _, pattern := range []string{"a", "b", "a", "c"} {
+		_, err := c.get(pattern)
+		if err != nil {
+			t.Fatalf("unexpected error compiling %s: %s", pattern, err)
+		}
+	}
+
+	if c.order.Len() != 2 || len(c.entries) != 2 {
+		t.Fatalf("cache is not bounded, has %d entries", c.order.Len())
+	}
+
+	// "b" was the least-recently used, so it should be gone.
+	if _, ok := c.entries["b"]; ok {
+		t.Errorf("expected b to have been evicted")
+	}
+	for _, pattern := range []string{"a", "c"} {
+		if _, ok := c.entries[pattern]; !ok {
+			t.Errorf("expected %s to be cached", pattern)
+		}
+	}
+
+	// Errors are returned, and not cached.
+	_, err := c.get("+")
+	if err == nil {
+		t.Errorf("expected an error compiling an invalid pattern")
+	}
+	if _, ok := c.entries["+"]; ok {
+		t.Errorf("invalid pattern should not be cached")
+	}
+}
+
+// Test our cache may be used concurrently.
+func TestRegexpCacheConcurrent(t *testing.T) {
+
+	c := newRegexpCache(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				pattern := fmt.Sprintf("^%d$", (i+j)%10)
+				r, err := c.get(pattern)
+				if err != nil || !r.Compiled().MatchString(fmt.Sprintf("%d", (i+j)%10)) {
+					t.Errorf("unexpected result for %s", pattern)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.order.Len() > 4 {
+		t.Errorf("cache is not bounded, has %d entries", c.order.Len())
+	}
+}
+
 // Test minimum/maximum number
 func TestMinMax(t *testing.T) {
 
@@ -775,49 +943,79 @@ func TestPanicArgument(t *testing.T) {
 	fnPanic(args)
 }
 
-// NOP-test
+// Test that print writes to our output, or our logger.
 func TestPrint(t *testing.T) {
+
+	e := New()
+
+	var buf bytes.Buffer
+	e.SetOutput(&buf)
+
 	var args []object.Object
-	fnPrint(args)
+	e.fnPrint(args)
 
 	args = append(args, &object.String{Value: ""})
-	fnPrint(args)
+	e.fnPrint(args)
+
+	args = append(args, &object.String{Value: "Steve "}, &object.Integer{Value: 3})
+	e.fnPrint(args)
+
+	if buf.String() != "Steve 3" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	// A logger receives each message, in preference.
+	var logged []string
+	e.SetLogger(func(level, msg string) {
+		logged = append(logged, level+":"+msg)
+	})
+	e.fnPrint(args)
+	e.fnPrintf([]object.Object{&object.String{Value: "%d!"}, &object.Integer{Value: 3}})
+
+	if buf.String() != "Steve 3" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if strings.Join(logged, ",") != "info:Steve 3,info:3!" {
+		t.Errorf("unexpected messages: %v", logged)
+	}
 }
 
 // TestTime performs *minimal* invocation of time-fields
 func TestTime(t *testing.T) {
 
+	e := New()
+
 	//
 	// Call all the functions with no arguments
 	//
 	var args []object.Object
 	var out object.Object
 
-	out = fnHour(args)
+	out = e.fnHour(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnMinute(args)
+	out = e.fnMinute(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnSeconds(args)
+	out = e.fnSeconds(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnDay(args)
+	out = e.fnDay(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnMonth(args)
+	out = e.fnMonth(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnYear(args)
+	out = e.fnYear(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
-	out = fnWeekday(args)
+	out = e.fnWeekday(args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
@@ -825,6 +1023,8 @@ func TestTime(t *testing.T) {
 
 func TestTimeKnown(t *testing.T) {
 
+	e := New()
+
 	var args []object.Object
 
 	//
@@ -835,33 +1035,33 @@ func TestTimeKnown(t *testing.T) {
 	//
 	// And check the values.
 	//
-	if fnDay(args).(*object.Integer).Value != 10 {
+	if e.fnDay(args).(*object.Integer).Value != 10 {
 		t.Errorf("Failed to get the correct date")
 	}
-	if fnMonth(args).(*object.Integer).Value != 3 {
+	if e.fnMonth(args).(*object.Integer).Value != 3 {
 		t.Errorf("Failed to get the correct date")
 	}
-	if fnYear(args).(*object.Integer).Value != 1976 {
+	if e.fnYear(args).(*object.Integer).Value != 1976 {
 		t.Errorf("Failed to get the correct date")
 	}
-	if fnWeekday(args).(*object.String).Value != "Wednesday" {
+	if e.fnWeekday(args).(*object.String).Value != "Wednesday" {
 		t.Errorf("Failed to get the correct date")
 	}
 
-	if fnHour(args).(*object.Integer).Value != 14 {
+	if e.fnHour(args).(*object.Integer).Value != 14 {
 		t.Errorf("Failed to get the correct time")
 	}
-	if fnMinute(args).(*object.Integer).Value != 15 {
+	if e.fnMinute(args).(*object.Integer).Value != 15 {
 		t.Errorf("Failed to get the correct time")
 	}
-	if fnSeconds(args).(*object.Integer).Value != 16 {
+	if e.fnSeconds(args).(*object.Integer).Value != 16 {
 		t.Errorf("Failed to get the correct time")
 	}
 
 	//
 	// Test bogus field-name to the internal-helper.
 	//
-	if getTimeField(args, "bogus").Type() != object.NULL {
+	if e.getTimeField(args, "bogus").Type() != object.NULL {
 		t.Errorf("unexpected value passing bogus argument")
 	}
 
@@ -871,7 +1071,7 @@ func TestTimeKnown(t *testing.T) {
 	var bogus []object.Object
 	bogus = append(bogus, &object.String{Value: "not int"})
 
-	if fnSeconds(bogus).Type() != object.NULL {
+	if e.fnSeconds(bogus).Type() != object.NULL {
 		t.Errorf("unexpected value passing bogus argument")
 	}
 
@@ -880,6 +1080,8 @@ func TestTimeKnown(t *testing.T) {
 // Test `now`
 func TestNow(t *testing.T) {
 
+	e := New()
+
 	// Handle timezones, by reading $TZ, and if not set
 	// defaulting to UTC.
 	env := os.Getenv("TZ")
@@ -897,15 +1099,27 @@ func TestNow(t *testing.T) {
 
 	// Call the function
 	var empty []object.Object
-	out := fnNow(empty)
+	out := e.fnNow(empty)
 
 	// type-check
-	if out.Type() != object.INTEGER {
-		t.Errorf("output of `now` was not an integer")
+	if out.Type() != object.TIME {
+		t.Errorf("output of `now` was not a time")
 	}
 
 	// get the value
-	val := out.(*object.Integer).Value
+	val := out.(*object.Time).Value.Unix()
+	if out.(*object.Time).Value.Location().String() != env {
+		t.Errorf("output of `now` is in the wrong timezone")
+	}
+
+	// `time` returns an integer, for compatibility
+	epoch := e.fnTime(empty)
+	if epoch.Type() != object.INTEGER {
+		t.Errorf("output of `time` was not an integer")
+	}
+	if epoch.(*object.Integer).Value-val > 2 {
+		t.Errorf("`time` and `now` differ by more than two seconds.  weird")
+	}
 
 	// diff
 	diff := val - now.Unix()
@@ -918,6 +1132,128 @@ func TestNow(t *testing.T) {
 	}
 }
 
+// Times keep their own timezone, rather than using $TZ.
+func TestTimeZone(t *testing.T) {
+
+	e := New()
+
+	loc := time.FixedZone("EST", -5*3600)
+	args := []object.Object{&object.Time{Value: time.Date(2024, 3, 10, 23, 30, 0, 0, loc)}}
+
+	if e.fnHour(args).(*object.Integer).Value != 23 {
+		t.Errorf("Failed to get the correct time")
+	}
+	if e.fnDay(args).(*object.Integer).Value != 10 {
+		t.Errorf("Failed to get the correct date")
+	}
+
+	// Converting to UTC moves us into the next day
+	utc, err := e.fnInTimezone(context.Background(), []object.Object{args[0], &object.String{Value: "UTC"}})
+	if err != nil {
+		t.Fatalf("Failed to convert to UTC: %s", err.Error())
+	}
+	if e.fnHour([]object.Object{utc}).(*object.Integer).Value != 4 {
+		t.Errorf("Failed to get the correct time")
+	}
+	if e.fnDay([]object.Object{utc}).(*object.Integer).Value != 11 {
+		t.Errorf("Failed to get the correct date")
+	}
+
+	// Bogus arguments
+	out, _ := e.fnInTimezone(context.Background(), args)
+	if out.Type() != object.NULL {
+		t.Errorf("one argument returns a weird result")
+	}
+	out, _ = e.fnInTimezone(context.Background(), []object.Object{&object.String{Value: "x"}, &object.String{Value: "UTC"}})
+	if out.Type() != object.NULL {
+		t.Errorf("a string returns a weird result")
+	}
+
+	// Unknown timezones are an error
+	_, err = e.fnInTimezone(context.Background(), []object.Object{args[0], &object.String{Value: "Mars/Olympus"}})
+	if err == nil || !strings.Contains(err.Error(), "unknown timezone Mars/Olympus") {
+		t.Errorf("Expected an error for an unknown timezone, got %v", err)
+	}
+}
+
+// Test formatting times
+func TestStrftime(t *testing.T) {
+
+	e := New()
+
+	when := &object.Time{Value: time.Date(1976, 3, 10, 14, 5, 9, 0, time.UTC)}
+
+	tests := map[string]string{
+		"%Y-%m-%d %H:%M:%S": "1976-03-10 14:05:09",
+		"%F %T %Z %z":       "1976-03-10 14:05:09 UTC +0000",
+		"%a %A %b %B %e":    "Wed Wednesday Mar March 10",
+		"%y %I%p %j":        "76 02PM 070",
+		"%s":                "195314709",
+		"100%% %q %":        "100% %q %",
+		"Mon Jan 2006":      "Mon Jan 2006",
+	}
+
+	for format, expected := range tests {
+		out := e.fnStrftime([]object.Object{when, &object.String{Value: format}})
+		if out.Inspect() != expected {
+			t.Errorf("strftime(%s) gave %s, expected %s", format, out.Inspect(), expected)
+		}
+	}
+
+	// Integers are epoch seconds
+	out := e.fnStrftime([]object.Object{&object.Integer{Value: 195314709}, &object.String{Value: "%s"}})
+	if out.Inspect() != "195314709" {
+		t.Errorf("strftime of an integer gave %s", out.Inspect())
+	}
+
+	// Bogus arguments
+	if e.fnStrftime([]object.Object{when}).Type() != object.NULL {
+		t.Errorf("one argument returns a weird result")
+	}
+	if e.fnStrftime([]object.Object{&object.String{Value: "x"}, &object.String{Value: "%Y"}}).Type() != object.NULL {
+		t.Errorf("a string returns a weird result")
+	}
+}
+
+// Test parsing times
+func TestParseTime(t *testing.T) {
+
+	e := New()
+
+	tests := []struct {
+		Args   []string
+		Result string
+	}{
+		{Args: []string{"2024-03-10T14:15:16.5+01:00"}, Result: "2024-03-10T14:15:16.5+01:00"},
+		{Args: []string{"10/03/1976", "02/01/2006"}, Result: "1976-03-10T00:00:00Z"},
+		{Args: []string{"10/03/1976 12:00", "02/01/2006 15:04", "Asia/Tokyo"}, Result: "1976-03-10T12:00:00+09:00"},
+		{Args: []string{"bogus"}, Result: "null"},
+		{Args: []string{}, Result: "null"},
+	}
+
+	for _, test := range tests {
+		var args []object.Object
+		for _, arg := range test.Args {
+			args = append(args, &object.String{Value: arg})
+		}
+
+		out, _ := e.fnParseTime(context.Background(), args)
+		if out.Inspect() != test.Result {
+			t.Errorf("parse_time(%v) gave %s, expected %s", test.Args, out.Inspect(), test.Result)
+		}
+	}
+	// Unknown timezones are an error
+	args := []object.Object{
+		&object.String{Value: "10/03/1976"},
+		&object.String{Value: "02/01/2006"},
+		&object.String{Value: "Mars/Olympus"},
+	}
+	_, err := e.fnParseTime(context.Background(), args)
+	if err == nil || !strings.Contains(err.Error(), "unknown timezone Mars/Olympus") {
+		t.Errorf("Expected an error for an unknown timezone, got %v", err)
+	}
+}
+
 // Test formatting strings
 func TestSprintf(t *testing.T) {
 
@@ -988,6 +1324,9 @@ func TestSprintf(t *testing.T) {
 // Test printing formatting strings
 func TestPrintf(t *testing.T) {
 
+	e := New()
+	e.SetOutput(ioutil.Discard)
+
 	type TestCase struct {
 		Input []object.Object
 	}
@@ -1034,7 +1373,7 @@ func TestPrintf(t *testing.T) {
 		var args []object.Object
 		args = append(args, test.Input...)
 
-		x := fnPrintf(args)
+		x := e.fnPrintf(args)
 		if x.Type() != object.VOID {
 			t.Errorf("Invalid return type for test %d, got %s", i, x)
 		}
@@ -1122,7 +1461,7 @@ func TestReplace(t *testing.T) {
 
 	// Calling the function with no-arguments should return null
 	var args []object.Object
-	out := fnReplace(args)
+	out, _ := fnReplace(context.Background(), args)
 	if out.Type() != object.NULL {
 		t.Errorf("no arguments returns a weird result")
 	}
@@ -1130,14 +1469,14 @@ func TestReplace(t *testing.T) {
 
 	// 1 argument is invalid
 	args = append(args, &object.String{Value:"one"})
-	out = fnReplace(args)
+	out, _ = fnReplace(context.Background(), args)
 	if out.Type() != object.NULL {
 		t.Errorf("one argument returns a weird result")
 	}
 
 	// 2 arguments is invalid
 	args = append(args, &object.String{Value:"one"})
-	out = fnReplace(args)
+	out, _ = fnReplace(context.Background(), args)
 	if out.Type() != object.NULL {
 		t.Errorf("two arguments returns a weird result")
 	}
@@ -1148,7 +1487,7 @@ func TestReplace(t *testing.T) {
 		&object.String{Value:"\\d"},
 		&object.String{Value:"X"},
 	}
-	out = fnReplace(args)
+	out, _ = fnReplace(context.Background(), args)
 	if out.Type() != object.STRING {
 		t.Errorf("invalid return value for replace")
 	}
@@ -1164,7 +1503,7 @@ func TestReplace(t *testing.T) {
 		&object.Regexp{Value:"\\d"},
 		&object.String{Value:"X"},
 	}
-	out = fnReplace(args)
+	out, _ = fnReplace(context.Background(), args)
 	if out.Type() != object.STRING {
 		t.Errorf("invalid return value for replace")
 	}
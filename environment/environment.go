@@ -19,34 +19,91 @@
 //
 // This might be wrong and buggy, we'll see.  Reference to the
 // problem https://github.com/skx/evalfilter/issues/123
+//
+// NOTE: Our virtual machine no longer uses scopes, the compiler assigns
+// local variables to numbered slots instead, but they remain available
+// to host applications.
+//
+// Scopes belong to a single execution of a script, so to allow a script
+// to be executed concurrently each execution uses a fork of the
+// environment.  Forks have their own scopes, and their own copy of any
+// global variables they set, which shadow the shared ones until they're
+// committed.  Functions are shared, and protected by a lock.
 package environment
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/skx/evalfilter/v2/object"
 )
 
+// globals holds the state which is shared between an environment and
+// any forks of it, as created via Fork.
+type globals struct {
+
+	// mutex guards access to our maps, as forked environments
+	// may be used concurrently.
+	mutex sync.RWMutex
+
+	// variables is the storage for globally-scoped variables.
+	variables map[string]object.Object
+
+	// functions holds golang function pointers, as set by
+	// by the host-application.
+	//
+	// These are largely static, and always global.
+	functions map[string]interface{}
+
+	// builtin records the names of our built-in functions which
+	// haven't been replaced, or deleted, by the host-application.
+	builtin map[string]bool
+
+	// clock returns the current time, for our time-related
+	// functions.  If this is nil time.Now is used.
+	clock func() time.Time
+
+	// location is the timezone the current time, and times
+	// given as integer epoch seconds, are presented in.  If
+	// this is nil we use the zone named by $TZ, or UTC.
+	location *time.Location
+
+	// output is where `print` and `printf` write, unless we have
+	// a logger.  If this is nil os.Stdout is used.
+	output io.Writer
+
+	// logger receives the messages from `print` and `printf`, in
+	// preference to our output, if it is set.
+	logger func(level, msg string)
+
+	// outputMutex serializes writes to our output, as forked
+	// environments may be printing concurrently.
+	outputMutex sync.Mutex
+}
+
 // Environment stores our functions, variables, constants, etc.
 type Environment struct {
 
-	// global is the storage for globally-scoped variables.
-	global map[string]object.Object
+	// global is the storage for globally-scoped variables, and
+	// functions.
+	global *globals
+
+	// variables holds the global variables which have been set in
+	// a fork, which shadow the shared ones until Commit is called.
+	//
+	// This is nil unless we're a fork, in which case variables are
+	// set in the shared storage directly.
+	variables map[string]object.Object
 
 	// local holds variables which are scoped for the
-	// duration of `foreach` iterations only.  If we
-	// were to support user-defined functions we'd also
-	// use local-variables too.
+	// duration of `foreach` iterations, and function calls.
 	//
 	// We create an entry here each time we enter a new scope,
 	// removing it on exit.
 	local []map[string]object.Object
-
-	// functions holds golang function pointers, as set by
-	// by the host-application.
-	//
-	// These are largely static, and always global.
-	functions map[string]interface{}
 }
 
 // New creates a new environment, which is used for storing variable
@@ -54,17 +111,19 @@ type Environment struct {
 // available to the scripting environment by the host application.
 func New() *Environment {
 
-	// Holder for variables.
-	global := make(map[string]object.Object)
-
-	// Holder for function-pointers for all our builtins.
-	functions := make(map[string]interface{})
+	// Holder for variables and function-pointers for all our builtins.
+	global := &globals{
+		variables: make(map[string]object.Object),
+		functions: make(map[string]interface{}),
+		builtin:   make(map[string]bool),
+	}
 
 	// Create the environment object.
-	env := &Environment{global: global, functions: functions}
+	env := &Environment{global: global}
 
 	// Now register our default functions.
 	env.SetFunction("between", fnBetween)
+	env.SetFunction("captures", fnCaptures)
 	env.SetFunction("float", fnFloat)
 	env.SetFunction("getenv", fnGetenv)
 	env.SetFunction("int", fnInt)
@@ -75,17 +134,17 @@ func New() *Environment {
 	env.SetFunction("match", fnMatch)
 	env.SetFunction("max", fnMax)
 	env.SetFunction("min", fnMin)
-	env.SetFunction("now", fnNow)
+	env.SetFunction("now", env.fnNow)
 	env.SetFunction("panic", fnPanic)
-	env.SetFunction("print", fnPrint)
-	env.SetFunction("printf", fnPrintf)
+	env.SetFunction("print", env.fnPrint)
+	env.SetFunction("printf", env.fnPrintf)
 	env.SetFunction("replace", fnReplace)
 	env.SetFunction("reverse", fnReverse)
 	env.SetFunction("sort", fnSort)
 	env.SetFunction("split", fnSplit)
 	env.SetFunction("sprintf", fnSprintf)
 	env.SetFunction("string", fnString)
-	env.SetFunction("time", fnNow)
+	env.SetFunction("time", env.fnTime)
 	env.SetFunction("trim", fnTrim)
 	env.SetFunction("type", fnType)
 	env.SetFunction("upper", fnUpper)
@@ -93,24 +152,35 @@ func New() *Environment {
 	//
 	// These all refer to time.Time fields.
 	//
-	// (Though they will work on any object which
-	// is an integer.  Because when we examine time.Time
-	// fields via reflection we convert them to Unix epoch
-	// seconds.)
+	// (Though they will also work on any object which
+	// is an integer, treating it as Unix epoch seconds.
+	// This is how time.Time fields were presented before
+	// we had a time-type.)
 	//
 
 	// 10:11:12, etc.
-	env.SetFunction("hour", fnHour)
-	env.SetFunction("minute", fnMinute)
-	env.SetFunction("seconds", fnSeconds)
+	env.SetFunction("hour", env.fnHour)
+	env.SetFunction("minute", env.fnMinute)
+	env.SetFunction("seconds", env.fnSeconds)
 
 	// 10/03/1976, etc.
-	env.SetFunction("day", fnDay)
-	env.SetFunction("month", fnMonth)
-	env.SetFunction("year", fnYear)
+	env.SetFunction("day", env.fnDay)
+	env.SetFunction("month", env.fnMonth)
+	env.SetFunction("year", env.fnYear)
 
 	// "Saturday", "Sunday", etc.
-	env.SetFunction("weekday", fnWeekday)
+	env.SetFunction("weekday", env.fnWeekday)
+
+	// Formatting, parsing, and timezone conversion.
+	env.SetFunction("in_timezone", env.fnInTimezone)
+	env.SetFunction("parse_time", env.fnParseTime)
+	env.SetFunction("strftime", env.fnStrftime)
+
+	// Record our built-in functions, so that we know if they're
+	// replaced.
+	for name := range global.functions {
+		global.builtin[name] = true
+	}
 
 	// All done.
 	return env
@@ -131,12 +201,49 @@ func (e *Environment) Get(name string) (object.Object, bool) {
 
 	// There was no locally-scoped variable.
 	//
-	// Looking at the global-variable storage.
+	// Look at the variables set in this fork, and then at the
+	// global-variable storage.
 	//
-	obj, ok = e.global[name]
+	obj, ok = e.variables[name]
+	if ok {
+		return obj, ok
+	}
+	e.global.mutex.RLock()
+	obj, ok = e.global.variables[name]
+	e.global.mutex.RUnlock()
 	return obj, ok
 }
 
+// Fork returns a new environment which shares the functions of this one,
+// but which has its own local scopes.
+//
+// The fork sees our global variables, but those it sets are only visible
+// to it until Commit is called.  This allows scripts to be executed
+// concurrently, with each execution using its own fork.
+func (e *Environment) Fork() *Environment {
+	return &Environment{
+		global:    e.global,
+		variables: make(map[string]object.Object),
+	}
+}
+
+// Commit stores the global variables which have been set in a fork in the
+// shared storage, so that they are visible to the parent and any other
+// forks created after this.
+func (e *Environment) Commit() {
+	if len(e.variables) == 0 {
+		return
+	}
+
+	e.global.mutex.Lock()
+	for name, val := range e.variables {
+		e.global.variables[name] = val
+	}
+	e.global.mutex.Unlock()
+
+	e.variables = make(map[string]object.Object)
+}
+
 // Is the variable locally scoped?
 //
 // This is a bit icky.  On the one hand we know that when a caller
@@ -184,9 +291,15 @@ func (e *Environment) Set(name string, val object.Object) object.Object {
 	}
 
 	//
-	// OK we're storing globally.
+	// OK we're storing globally, which a fork does privately.
 	//
-	e.global[name] = val
+	if e.variables != nil {
+		e.variables[name] = val
+		return val
+	}
+	e.global.mutex.Lock()
+	e.global.variables[name] = val
+	e.global.mutex.Unlock()
 	return val
 }
 
@@ -256,7 +369,10 @@ func (e *Environment) SetLocal(name string, val object.Object) object.Object {
 // SetFunction makes a (golang) function available to the scripting
 // environment.
 func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
-	e.functions[name] = fun
+	e.global.mutex.Lock()
+	e.global.functions[name] = fun
+	delete(e.global.builtin, name)
+	e.global.mutex.Unlock()
 	return fun
 }
 
@@ -265,7 +381,9 @@ func (e *Environment) SetFunction(name string, fun interface{}) interface{} {
 // Functions retrieved are only those which have been previously added
 // via `SetFunction`.
 func (e *Environment) GetFunction(name string) (interface{}, bool) {
-	fun, ok := e.functions[name]
+	e.global.mutex.RLock()
+	fun, ok := e.global.functions[name]
+	e.global.mutex.RUnlock()
 	return fun, ok
 }
 
@@ -275,5 +393,119 @@ func (e *Environment) GetFunction(name string) (interface{}, bool) {
 // used to allow you to disable any existing built-in functions you did
 // not wish to expose to your scripting environment.
 func (e *Environment) DeleteFunction(name string) {
-	delete(e.functions, name)
+	e.global.mutex.Lock()
+	delete(e.global.functions, name)
+	delete(e.global.builtin, name)
+	e.global.mutex.Unlock()
+}
+
+// Builtin returns true if the named function is one of our built-in
+// functions, rather than a replacement set by the host-application.
+func (e *Environment) Builtin(name string) bool {
+	e.global.mutex.RLock()
+	builtin := e.global.builtin[name]
+	e.global.mutex.RUnlock()
+	return builtin
+}
+
+// SetClock sets the function our time-related functions use to find the
+// current time, which allows scripts to be tested at a fixed time.
+//
+// If the clock is nil time.Now is used.
+func (e *Environment) SetClock(clock func() time.Time) {
+	e.global.mutex.Lock()
+	e.global.clock = clock
+	e.global.mutex.Unlock()
+}
+
+// SetLocation sets the timezone the current time, and times given as
+// integer epoch seconds, are presented in by our time-related functions.
+//
+// If the location is nil the zone named by $TZ is used, or UTC.
+func (e *Environment) SetLocation(loc *time.Location) {
+	e.global.mutex.Lock()
+	e.global.location = loc
+	e.global.mutex.Unlock()
+}
+
+// Now returns the current time, according to our clock, in our location.
+func (e *Environment) Now() time.Time {
+	e.global.mutex.RLock()
+	clock := e.global.clock
+	e.global.mutex.RUnlock()
+
+	if clock == nil {
+		clock = time.Now
+	}
+	return clock().In(e.Location())
+}
+
+// Location returns the timezone the current time, and times given as
+// integer epoch seconds, are presented in.
+func (e *Environment) Location() *time.Location {
+	e.global.mutex.RLock()
+	loc := e.global.location
+	e.global.mutex.RUnlock()
+
+	if loc != nil {
+		return loc
+	}
+
+	env := os.Getenv("TZ")
+	if env == "" {
+		env = "UTC"
+	}
+
+	loc, err := time.LoadLocation(env)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// SetOutput sets the writer which `print` and `printf` write to, which is
+// os.Stdout by default.  Use ioutil.Discard to discard their output.
+//
+// If the writer is nil os.Stdout is used.
+func (e *Environment) SetOutput(output io.Writer) {
+	e.global.mutex.Lock()
+	e.global.output = output
+	e.global.mutex.Unlock()
+}
+
+// SetLogger sets a function which receives the messages from `print` and
+// `printf`, instead of them being written to our output.  Each call to
+// either function results in a single message, logged at the level "info".
+//
+// If the logger is nil our output is used.
+func (e *Environment) SetLogger(logger func(level, msg string)) {
+	e.global.mutex.Lock()
+	e.global.logger = logger
+	e.global.mutex.Unlock()
+}
+
+// Print sends the given message to our logger, or writes it to our output.
+// Empty messages are ignored.
+func (e *Environment) Print(msg string) {
+	if msg == "" {
+		return
+	}
+
+	e.global.mutex.RLock()
+	output := e.global.output
+	logger := e.global.logger
+	e.global.mutex.RUnlock()
+
+	if logger != nil {
+		logger("info", msg)
+		return
+	}
+
+	if output == nil {
+		output = os.Stdout
+	}
+
+	e.global.outputMutex.Lock()
+	defer e.global.outputMutex.Unlock()
+	fmt.Fprint(output, msg)
 }
@@ -1,7 +1,9 @@
 package environment
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/skx/evalfilter/v2/object"
 )
@@ -191,3 +193,162 @@ func TestScopeLookup(t *testing.T) {
 	}
 
 }
+
+// TestBuiltin ensures that we know which functions have been replaced.
+func TestBuiltin(t *testing.T) {
+
+	env := New()
+	if !env.Builtin("match") {
+		t.Errorf("match should be built-in")
+	}
+
+	env.SetFunction("match", func(args []object.Object) object.Object {
+		return &object.Boolean{Value: true}
+	})
+	if env.Builtin("match") {
+		t.Errorf("match has been replaced")
+	}
+
+	env.DeleteFunction("upper")
+	if env.Builtin("upper") {
+		t.Errorf("upper has been deleted")
+	}
+
+	env.SetFunction("custom", fnUpper)
+	if env.Builtin("custom") {
+		t.Errorf("custom is not built-in")
+	}
+}
+
+// TestFork ensures forks see globals, but not local scopes.
+func TestFork(t *testing.T) {
+
+	env := New()
+	env.Set("global", &object.String{Value: "parent"})
+
+	fork := env.Fork()
+	fork.AddScope()
+	fork.SetLocal("local", &object.String{Value: "fork"})
+
+	// The fork sees the parent's globals
+	get, ok := fork.Get("global")
+	if !ok || get.Inspect() != "parent" {
+		t.Errorf("Fork failed to see global")
+	}
+
+	// Globals set in the fork are private to it
+	fork.Set("other", &object.String{Value: "fork"})
+	_, ok = env.Get("other")
+	if ok {
+		t.Errorf("Parent saw global set in fork")
+	}
+	get, ok = fork.Get("other")
+	if !ok || get.Inspect() != "fork" {
+		t.Errorf("Fork failed to see its own global")
+	}
+
+	// Until they're committed
+	fork.Commit()
+	get, ok = env.Get("other")
+	if !ok || get.Inspect() != "fork" {
+		t.Errorf("Parent failed to see global committed by fork")
+	}
+
+	// But locals are not
+	_, ok = env.Get("local")
+	if ok {
+		t.Errorf("Parent saw local from fork")
+	}
+
+	// The parent has no scopes to remove.
+	err := env.RemoveScope()
+	if err == nil {
+		t.Errorf("Parent has the fork's scope")
+	}
+
+	// Functions are shared too
+	env.DeleteFunction("print")
+	_, ok = fork.GetFunction("print")
+	if ok {
+		t.Errorf("Fork still has a deleted function")
+	}
+}
+
+// Test the clock and timezone used by our time-related functions.
+func TestClock(t *testing.T) {
+
+	e := New()
+
+	// Without a location we use $TZ, or UTC.
+	t.Setenv("TZ", "")
+	if e.Location() != time.UTC {
+		t.Errorf("expected UTC by default, got %s", e.Location())
+	}
+
+	fixed := time.Date(2024, 3, 9, 23, 30, 0, 0, time.UTC)
+	tokyo := time.FixedZone("JST", 9*3600)
+
+	e.SetClock(func() time.Time { return fixed })
+	e.SetLocation(tokyo)
+
+	// Forks share our clock.
+	f := e.Fork()
+
+	if !f.Now().Equal(fixed) || f.Now().Location() != tokyo {
+		t.Errorf("unexpected current time %s", f.Now())
+	}
+
+	call := func(name string, args ...object.Object) string {
+		fn, ok := f.GetFunction(name)
+		if !ok {
+			t.Fatalf("missing function %s", name)
+		}
+		switch fn := fn.(type) {
+		case func([]object.Object) object.Object:
+			return fn(args).Inspect()
+		case func(context.Context, []object.Object) (object.Object, error):
+			out, err := fn(context.Background(), args)
+			if err != nil {
+				t.Fatalf("%s failed: %s", name, err.Error())
+			}
+			return out.Inspect()
+		}
+		t.Fatalf("%s has an unexpected type %T", name, fn)
+		return ""
+	}
+
+	epoch := &object.Integer{Value: fixed.Unix()}
+
+	tests := []struct {
+		Got      string
+		Expected string
+	}{
+		{Got: call("now"), Expected: "2024-03-10T08:30:00+09:00"},
+		{Got: call("time"), Expected: "1710027000"},
+
+		// Integers are presented in our location.
+		{Got: call("hour", epoch), Expected: "8"},
+		{Got: call("weekday", epoch), Expected: "Sunday"},
+		{Got: call("strftime", epoch, &object.String{Value: "%F %H:%M"}), Expected: "2024-03-10 08:30"},
+
+		// As are times without a zone.
+		{Got: call("parse_time", &object.String{Value: "2024-03-10 12:00"}, &object.String{Value: "2006-01-02 15:04"}), Expected: "2024-03-10T12:00:00+09:00"},
+
+		// Times keep their own zone.
+		{Got: call("hour", &object.Time{Value: fixed}), Expected: "23"},
+		{Got: call("hour", &object.Time{Value: fixed.In(tokyo)}), Expected: "8"},
+	}
+
+	for _, test := range tests {
+		if test.Got != test.Expected {
+			t.Errorf("got %s, expected %s", test.Got, test.Expected)
+		}
+	}
+
+	// Resetting restores the defaults
+	e.SetClock(nil)
+	e.SetLocation(nil)
+	if e.Location() != time.UTC || time.Since(e.Now()) > time.Minute {
+		t.Errorf("failed to reset the clock")
+	}
+}
@@ -16,4 +16,8 @@ type UserFunction struct {
 	// The function will be compiled into a set of bytecode
 	// instructions which will be stored here.
 	Bytecode code.Instructions
+
+	// Positions maps the offsets of the bytecode instructions to
+	// the position of the source which generated them.
+	Positions code.Positions
 }
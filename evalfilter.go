@@ -10,8 +10,11 @@ package evalfilter
 import (
 	"context"
 	"fmt"
+	"io"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/environment"
@@ -25,8 +28,54 @@ import (
 const (
 	// Don't run the optimizer when generating bytecode.
 	NoOptimize byte = iota
+
+	// Expose structure fields to scripts using the names in their
+	// `json` tags, rather than their Go names.
+	JSONFieldNames
+
+	// Expose structure fields to scripts using the names in their
+	// `evalfilter` tags, rather than their Go names.
+	TagFieldNames
+
+	// Assignments to the fields of the object a script is run
+	// against update that object, rather than setting a variable.
+	WriteBack
 )
 
+// Error is the type of the errors returned when executing a script.
+//
+// As well as the underlying error it records the position within the
+// script at which the error occurred, along with the text of that line,
+// so that the author of the script can find the problem.
+type Error struct {
+	// Line is the line-number of the failing source, starting at one.
+	//
+	// This will be zero if the position is not known.
+	Line int
+
+	// Column is the column within that line.
+	Column int
+
+	// Snippet holds the text of the failing line.
+	Snippet string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the error-message, along with the position.
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s around line %d, column %d", e.Err.Error(), e.Line, e.Column)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // Eval is our public-facing structure which stores our state.
 type Eval struct {
 	// Script holds the script the user submitted in our constructor.
@@ -38,24 +87,90 @@ type Eval struct {
 	// constants compiled
 	constants []object.Object
 
+	// constantIndex maps constants to their offset in our pool.
+	constantIndex map[constantKey]int
+
 	// bytecode we generate
 	instructions code.Instructions
 
+	// positions maps our bytecode to the source which generated it.
+	positions code.Positions
+
+	// position is the location of the node we're currently compiling.
+	position code.Position
+
+	// loops holds the state of the loops we're currently compiling.
+	loops []*loop
+
+	// locals holds the local variables of the functions we're
+	// currently compiling, innermost last.
+	locals []*locals
+
+	// wideJumps is true if the targets of jumps should be stored in
+	// 32-bits, which is required for programs larger than 64k.
+	wideJumps bool
+
+	// tooLarge is set if we found a jump-target which didn't fit.
+	tooLarge bool
+
+	// err holds the first error found while generating bytecode.
+	err error
+
 	// the machine we drive
 	machine *vm.VM
 
 	// context for handling timeout
 	context context.Context
 
+	// limits restrict the resources a script may consume.
+	limits vm.Limits
+
+	// policy restricts the functions a script may call, if one
+	// was given to New.
+	policy *Policy
+
+	// deniedCalls holds the calls the script makes to functions the
+	// policy may forbid, which are checked once it has been compiled.
+	deniedCalls []*vm.Error
+
+	// signatures holds the types of the host functions which we've
+	// wrapped, so that calls to them may be checked.
+	signatures map[string]reflect.Type
+
 	// user-defined functions
 	functions map[string]environment.UserFunction
 
-	// Mutex to allow concurrent runs
+	// schema describes the object scripts will be run against, if
+	// it has been declared via SetSchema.
+	schema *schemaType
+
+	// optimize is true if the bytecode optimizer should be used.
+	optimize bool
+
+	// naming controls how structure-fields are exposed to scripts.
+	naming vm.FieldNaming
+
+	// writeBack is true if scripts may update the fields of the
+	// object they're run against.
+	writeBack bool
+
+	// variables holds the names of the variables a script sets, which
+	// are not checked against the schema.
+	variables map[string]bool
+
+	// schemaErrors holds the errors found when checking the script
+	// against the schema.
+	schemaErrors []string
+
+	// Mutex to guard against concurrent preparation.
 	mutex sync.Mutex
 }
 
 // New creates a new instance of the evaluator.
-func New(script string) *Eval {
+//
+// An optional Policy may be given to restrict the functions which the
+// script may call, and the resources it may consume.
+func New(script string, policy ...Policy) *Eval {
 
 	//
 	// Create our object.
@@ -65,9 +180,25 @@ func New(script string) *Eval {
 		Script:      script,
 		context:     context.Background(),
 		functions:   make(map[string]environment.UserFunction),
+		signatures:  make(map[string]reflect.Type),
+		positions:   make(code.Positions),
 		mutex:       sync.Mutex{},
 	}
 
+	//
+	// Apply the policy, if we have one.
+	//
+	for _, p := range policy {
+		functions := make(map[string]vm.Access)
+		for name, access := range p.Functions {
+			functions[name] = access
+		}
+		p.Functions = functions
+
+		e.policy = &p
+		e.limits = p.Limits
+	}
+
 	//
 	// Return it.
 	//
@@ -82,6 +213,74 @@ func (e *Eval) SetContext(ctx context.Context) {
 	e.context = ctx
 }
 
+// SetLimits restricts the resources which each execution of the script
+// may consume, in addition to any timeout set via SetContext.
+//
+// Limits must be set before Prepare is called.  A script which exceeds
+// one of them fails with an error wrapping a *vm.LimitError.
+func (e *Eval) SetLimits(limits vm.Limits) {
+	e.limits = limits
+}
+
+// SetClock replaces the function used to find the current time, which is
+// otherwise time.Now.  This allows the results of scripts which use now(),
+// time(), and the other time-related functions to be deterministic.
+//
+// Passing nil restores the system clock.
+func (e *Eval) SetClock(clock func() time.Time) {
+	e.environment.SetClock(clock)
+}
+
+// SetLocation sets the timezone in which now(), hour(), strftime(), and
+// the other time-related functions present the current time and integer
+// timestamps.  Times which already have a zone are left alone.
+//
+// By default the zone named by $TZ is used, falling back to UTC.  Passing
+// nil restores that default.
+func (e *Eval) SetLocation(loc *time.Location) {
+	e.environment.SetLocation(loc)
+}
+
+// SetOutput sets the writer to which the `print` and `printf` functions
+// write, which is os.Stdout by default.  Output is discarded if you pass
+// ioutil.Discard.
+//
+// Each Eval has its own output, and writes to it are serialized, so it is
+// safe to execute a script concurrently.
+func (e *Eval) SetOutput(output io.Writer) {
+	e.environment.SetOutput(output)
+}
+
+// SetLogger sets a function which receives the output of the `print` and
+// `printf` functions, rather than it being written to our output.  This
+// allows scripts to log via your application's logging library.
+//
+// Each call to either function results in a single message, which is
+// logged at the level "info".  The logger may be invoked concurrently if
+// the script is.
+func (e *Eval) SetLogger(logger func(level, msg string)) {
+	e.environment.SetLogger(logger)
+}
+
+// SetSchema declares the type of the object which scripts will be run
+// against, so that field-references may be checked when Prepare is called.
+//
+// The schema may be given as a reflect.Type, or as a sample value.  A sample
+// is useful for maps, since the keys it contains are taken to be the only
+// valid field-names.
+//
+// Unknown fields, and obviously mismatched operand types such as a regular
+// expression match against an integer field, are reported as errors by
+// Prepare.  Variables must be set before Prepare is called if the script
+// refers to them.
+func (e *Eval) SetSchema(schema interface{}) {
+	if schema == nil {
+		e.schema = nil
+		return
+	}
+	e.schema = newSchemaType(schema)
+}
+
 // Prepare is the second function the caller must invoke, it compiles
 // the user-supplied program to its final-form.
 //
@@ -95,15 +294,32 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	//
 	// Default to optimizing the bytecode.
 	//
-	optimize := true
+	e.optimize = true
+
+	//
+	// Default to exposing structure-fields by their Go names.
+	//
+	e.naming = vm.GoNames
+
+	//
+	// Default to treating assignments as setting variables.
+	//
+	e.writeBack = false
 
 	//
 	// But let flags change our behaviour.
 	//
 	for _, arg := range flags {
 		for _, val := range arg {
-			if val == NoOptimize {
-				optimize = false
+			switch val {
+			case NoOptimize:
+				e.optimize = false
+			case JSONFieldNames:
+				e.naming = vm.JSONNames
+			case TagFieldNames:
+				e.naming = vm.TagNames
+			case WriteBack:
+				e.writeBack = true
 			}
 		}
 	}
@@ -126,10 +342,19 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 		return err
 	}
 
+	//
+	// If we have a schema then find the variables the program
+	// sets, so that we don't mistake them for fields.
+	//
+	if e.schema != nil {
+		e.variables = make(map[string]bool)
+		e.collectVariables(program)
+	}
+
 	//
 	// Compile the program to bytecode
 	//
-	err = e.compile(program)
+	err = e.compileProgram(program)
 
 	//
 	// If there were errors then return them.
@@ -138,24 +363,47 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 		return err
 	}
 
+	//
+	// Report any problems found when checking the program
+	// against the schema.
+	//
+	if len(e.schemaErrors) > 0 {
+		return fmt.Errorf("%s", strings.Join(e.schemaErrors, "\n"))
+	}
+
+	//
+	// Now we're done, construct the virtual machine.
+	//
+	e.createMachine()
+
+	//
+	// All done; no errors.
+	//
+	return nil
+}
+
+// createMachine constructs the virtual machine we drive, once our program
+// has been compiled, or loaded via Unmarshal.
+func (e *Eval) createMachine() {
+
 	//
 	// If we've got the optimizer enabled then set the environment
 	// variable, so that the virtual machine knows it should
 	// run a series of optimizations.
 	//
-	if optimize {
+	if e.optimize {
 		e.environment.Set("OPTIMIZE", &object.Boolean{Value: true})
 	}
 
 	//
-	// Now we're done, construct a VM with the bytecode and constants
-	// we've created - as well as any function pointers and variables
+	// Construct a VM with the bytecode and constants we've
+	// created - as well as any function pointers and variables
 	// which we were given.
 	//
 	// The optimization will happen at this step, so that it is complete
 	// before Execute/Run are invoked - and we only take the speed hit
 	// once.
-	e.machine = vm.New(e.constants, e.instructions, e.functions, e.environment)
+	e.machine = vm.New(e.constants, e.instructions, e.positions, e.functions, e.environment)
 
 	//
 	// Setup our context
@@ -163,9 +411,26 @@ func (e *Eval) Prepare(flags ...[]byte) error {
 	e.machine.SetContext(e.context)
 
 	//
-	// All done; no errors.
+	// Setup our resource-limits.
 	//
-	return nil
+	e.machine.SetLimits(e.limits)
+
+	//
+	// Setup the functions the script may call.
+	//
+	if e.policy != nil {
+		e.machine.SetAccess(e.policy.Access)
+	}
+
+	//
+	// Setup the naming of structure-fields.
+	//
+	e.machine.SetFieldNaming(e.naming)
+
+	//
+	// Allow the fields of our object to be updated, if we should.
+	//
+	e.machine.SetWriteBack(e.writeBack)
 }
 
 // dumper is the callback function which is invoked for dumping bytecode
@@ -197,9 +462,18 @@ func (e *Eval) dumper(offset int, opCode code.Opcode, opArg interface{}) (bool,
 	if code.Opcode(opCode) == code.OpCall {
 		fmt.Printf("\t// call function with %d arg(s)", opArg.(int))
 	}
+	if code.Opcode(opCode) == code.OpClosure {
+		fmt.Printf("\t// create function from constant %d", opArg.(int))
+	}
 	if code.Opcode(opCode) == code.OpPush {
 		fmt.Printf("\t// Push %d to stack", opArg.(int))
 	}
+	if code.Opcode(opCode) == code.OpGetLocal || code.Opcode(opCode) == code.OpSetLocal {
+		fmt.Printf("\t// local variable %d", opArg.(int))
+	}
+	if code.Opcode(opCode) == code.OpGetOuter || code.Opcode(opCode) == code.OpSetOuter {
+		fmt.Printf("\t// local variable %d of enclosing function %d", opArg.(int)&0xFFFF, opArg.(int)>>16)
+	}
 	fmt.Printf("\n")
 
 	// Keep walking, no error.
@@ -253,6 +527,19 @@ func (e *Eval) Dump() error {
 		count++
 	}
 
+	// Anonymous functions are stored in the constant pool.
+	for i, n := range consts {
+		if n.Type() != object.FUNCTION {
+			continue
+		}
+		fmt.Printf("\nAnonymous function, constant %04d: %s\n", i, n.Inspect())
+
+		err := e.machine.WalkConstantBytecode(i, e.dumper)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -265,13 +552,18 @@ func (e *Eval) Dump() error {
 //
 // Use of this method allows you to receive the `3` that a script
 // such as `return 1 + 2;` would return.
+//
+// Once a script has been prepared it may be executed concurrently from
+// multiple goroutines.  Each execution has its own stack and variables.
+// The global variables a script sets become visible to later executions,
+// and to GetVariable, once it has finished.
 func (e *Eval) Execute(obj interface{}) (out object.Object, error error) {
 
 	// Catch errors when we're executing.
 	defer func() {
 		if r := recover(); r != nil {
 			out = &object.Null{}
-			error = fmt.Errorf("error during Run: %s", r)
+			error = e.runError(fmt.Errorf("error during Run: %s", r))
 		}
 	}()
 
@@ -284,7 +576,7 @@ func (e *Eval) Execute(obj interface{}) (out object.Object, error error) {
 	// Error executing?  Report that.
 	//
 	if err != nil {
-		return &object.Null{}, err
+		return &object.Null{}, e.runError(err)
 	}
 
 	//
@@ -293,6 +585,29 @@ func (e *Eval) Execute(obj interface{}) (out object.Object, error error) {
 	return out, nil
 }
 
+// runError converts an error from the virtual machine into an *Error,
+// which includes the text of the line of the script which failed.
+func (e *Eval) runError(err error) *Error {
+
+	vmErr, ok := err.(*vm.Error)
+	if !ok {
+		return &Error{Err: err}
+	}
+
+	out := &Error{
+		Line:   vmErr.Position.Line,
+		Column: vmErr.Position.Column,
+		Err:    vmErr.Err,
+	}
+
+	// Find the text of the line, if we can.
+	lines := strings.Split(e.Script, "\n")
+	if out.Line > 0 && out.Line <= len(lines) {
+		out.Snippet = strings.TrimRight(lines[out.Line-1], "\r")
+	}
+	return out
+}
+
 // Run executes the program which the user passed in the constructor.
 //
 // The return value, assuming no error, is a binary/boolean result which
@@ -301,18 +616,16 @@ func (e *Eval) Execute(obj interface{}) (out object.Object, error error) {
 // If you wish to return the actual value the script returned then you can
 // use the `Execute` method instead.  That doesn't attempt to determine whether
 // the result of the script was "true" or not.
+//
+// Like Execute this may be called concurrently.
 func (e *Eval) Run(obj interface{}) (bool, error) {
 
-	e.mutex.Lock()
-
 	//
 	// Execute the script, getting the resulting error
 	// and return object.
 	//
 	out, err := e.Execute(obj)
 
-	e.mutex.Unlock()
-
 	//
 	// Error? Then return that.
 	//
@@ -331,8 +644,48 @@ func (e *Eval) Run(obj interface{}) (bool, error) {
 // to the scripting environment.
 //
 // Once a function has been added it may be used by the filter script.
-func (e *Eval) AddFunction(name string, fun interface{}) {
-	e.environment.SetFunction(name, fun)
+//
+// Functions with the signature `func([]object.Object) object.Object` are
+// passed the objects the script called them with.  Those with the signature
+// `func(context.Context, []object.Object) (object.Object, error)` also
+// receive the context given to SetContext, and may return an error which
+// stops the script.  The error returned by Execute, or Run, then wraps a
+// *vm.FunctionError recording the name of the function.
+//
+// Other functions, such as `func(string, int) (bool, error)`, have their
+// arguments and results converted via reflection: they may return a value,
+// an error, or both, and if their first argument is a context.Context they
+// receive the context given to SetContext.
+//
+// An error is returned if the function has a signature we can't handle.
+// If the function is added before Prepare is called then scripts which
+// call it with the wrong number of arguments fail to compile.
+func (e *Eval) AddFunction(name string, fun interface{}) error {
+
+	var fn interface{}
+	switch f := fun.(type) {
+	case builtin:
+		fn = f
+		delete(e.signatures, name)
+	case contextBuiltin:
+		fn = f
+		delete(e.signatures, name)
+	default:
+		converter := &object.Converter{
+			FieldName: func(field reflect.StructField) (string, bool) {
+				return e.naming.Name(field)
+			},
+		}
+		wrapped, err := wrapFunction(name, fun, converter)
+		if err != nil {
+			return err
+		}
+		fn = wrapped
+		e.signatures[name] = reflect.TypeOf(fun)
+	}
+
+	e.environment.SetFunction(name, fn)
+	return nil
 }
 
 // SetVariable adds, or updates a variable which will be available
@@ -1,14 +1,19 @@
 package evalfilter
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/skx/evalfilter/v2/code"
 	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
 )
 
 // TestLess tests uses `>` and `>=`.
@@ -758,6 +763,60 @@ func TestAndOr(t *testing.T) {
 
 }
 
+// TestShortCircuit ensures that the right-hand side of `&&` and `||` is
+// only evaluated when it is required.
+func TestShortCircuit(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+		Calls  int
+	}{
+		{Input: `return false && called();`, Result: "false", Calls: 0},
+		{Input: `return true && called();`, Result: "true", Calls: 1},
+		{Input: `return true || called();`, Result: "true", Calls: 0},
+		{Input: `return false || called();`, Result: "true", Calls: 1},
+		{Input: `name = ""; return name != "" && called();`, Result: "false", Calls: 0},
+		{Input: `a = [1]; return len(a) > 1 && a[1] == 2;`, Result: "false", Calls: 0},
+		{Input: `if ( false || (true && called()) ) { return called(); } return 0;`, Result: "true", Calls: 2},
+		{Input: `x = 0; while ( x < 3 && called() ) { x++; } return x;`, Result: "3", Calls: 3},
+		{Input: `return 1 && "steve";`, Result: "true", Calls: 0},
+		{Input: `return 0 || "";`, Result: "false", Calls: 0},
+		{Input: `a = true; b = false; return a && b || a;`, Result: "true", Calls: 0},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			calls := 0
+
+			obj := New(tst.Input)
+			obj.AddFunction("called", func(args []object.Object) object.Object {
+				calls++
+				return &object.Boolean{Value: true}
+			})
+
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+			if calls != tst.Calls {
+				t.Fatalf("Wrong number of calls for %s: %d != %d", tst.Input, calls, tst.Calls)
+			}
+		}
+	}
+}
+
 // TestArrayObject tests that using reflection to get array values works
 // for basic types.
 func TestArrayObject(t *testing.T) {
@@ -1160,6 +1219,14 @@ if ( index ) {    print( "Test FAILED: index is set: ", index, "\n"); return fal
 return true;
 `,
 			Result: true},
+
+		// Loops over the same object are independent
+		{Input: `a = [1, 2, 3]; count = 0; foreach x in a { foreach y in a { count++; } } return count == 9;`,
+			Result: true},
+		{Input: `h = {"a": 1, "b": 2}; count = 0; foreach k, v in h { foreach k2, v2 in h { count++; } } return count == 4;`,
+			Result: true},
+		{Input: `a = [1, 2]; function f(n) { local t; t = 0; foreach x in a { if ( n > 0 ) { t = t + f(n - 1); } t = t + x; } return t; } return f(1) == 9;`,
+			Result: true},
 	}
 
 	for _, tst := range tests {
@@ -1181,6 +1248,73 @@ return true;
 	}
 }
 
+// countdown is a host-defined object which provides its own iterator.
+type countdown struct {
+	from int64
+}
+
+func (c *countdown) Type() object.Type        { return "COUNTDOWN" }
+func (c *countdown) Inspect() string          { return fmt.Sprintf("countdown(%d)", c.from) }
+func (c *countdown) True() bool               { return c.from > 0 }
+func (c *countdown) ToInterface() interface{} { return c.from }
+func (c *countdown) Iterator() object.Iterator {
+	return &countdownIterator{n: c.from}
+}
+
+// countdownIterator holds the state of an iteration over a countdown.
+type countdownIterator struct {
+	n int64
+}
+
+func (it *countdownIterator) Next() (object.Object, object.Object, bool) {
+	if it.n <= 0 {
+		return nil, nil, false
+	}
+	it.n--
+	return &object.Integer{Value: it.n + 1}, &object.Integer{Value: it.n}, true
+}
+
+// legacyCountdown implements the deprecated Iterable interface instead.
+type legacyCountdown struct {
+	from int64
+	it   countdownIterator
+}
+
+func (c *legacyCountdown) Type() object.Type        { return "COUNTDOWN" }
+func (c *legacyCountdown) Inspect() string          { return fmt.Sprintf("legacy(%d)", c.from) }
+func (c *legacyCountdown) True() bool               { return c.from > 0 }
+func (c *legacyCountdown) ToInterface() interface{} { return c.from }
+func (c *legacyCountdown) Reset()                   { c.it.n = c.from }
+func (c *legacyCountdown) Next() (object.Object, object.Object, bool) {
+	return c.it.Next()
+}
+
+// TestHostIterators tests iterating over host-defined objects.
+func TestHostIterators(t *testing.T) {
+
+	for _, value := range []object.Object{&countdown{from: 3}, &legacyCountdown{from: 3}} {
+
+		obj := New(`out = ""; foreach i, x in value { out += string(x); } return out;`)
+		obj.SetVariable("value", value)
+
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+
+		// Run twice, to ensure each loop starts afresh.
+		for i := 0; i < 2; i++ {
+			out, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if out.Inspect() != "321" {
+				t.Fatalf("Wrong result for %s: %s", value.Inspect(), out.Inspect())
+			}
+		}
+	}
+}
+
 // TestTernary checks our simple ternary expression(s)
 func TestTernary(t *testing.T) {
 
@@ -1367,14 +1501,16 @@ func TestMutators(t *testing.T) {
 func TestUnderscore(t *testing.T) {
 
 	// Dummy structure to test field-access.
+	//
+	// NOTE: Unexported fields are not visible to scripts.
 	type Structure struct {
 		//lint:ignore ST1003 This is a test to ensure that underscores are permitted.
-		foo_bar int
+		Foo_bar int
 	}
 
 	// Instance of object
 	var object Structure
-	object.foo_bar = 3
+	object.Foo_bar = 3
 
 	type Test struct {
 		Input  string
@@ -1382,7 +1518,7 @@ func TestUnderscore(t *testing.T) {
 	}
 
 	tests := []Test{
-		{Input: `if ( foo_bar == 3 ) { return true; } return false;`, Result: true},
+		{Input: `if ( Foo_bar == 3 ) { return true; } return false;`, Result: true},
 	}
 
 	for _, tst := range tests {
@@ -1491,6 +1627,124 @@ func TestRace(t *testing.T) {
 	wg.Wait()
 }
 
+// TestConcurrentExecute ensures that a prepared script may be executed
+// concurrently, with each execution seeing its own state.
+func TestConcurrentExecute(t *testing.T) {
+
+	type Input struct {
+		Name  string
+		Count int
+	}
+
+	obj := New(`
+function count(str) {
+  local n;
+  n = 0;
+  foreach char in str {
+    n++;
+  }
+  return n;
+}
+
+if ( Name ~= /^pizza/ ) {
+  return count(Name) + Count;
+}
+return count("steve") - Count;
+`)
+
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("error preparing: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			in := Input{Name: "steve", Count: i}
+			expected := int64(5 - i)
+			if i%2 == 0 {
+				in.Name = "pizza" + strings.Repeat("!", i)
+				expected = int64(5 + i + i)
+			}
+
+			for j := 0; j < 10; j++ {
+				out, err := obj.Execute(in)
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				if out.(*object.Integer).Value != expected {
+					t.Errorf("wrong result for %v: %s != %d", in, out.Inspect(), expected)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// TestConcurrentGlobals ensures that the global variables set by one
+// execution are not visible to those running concurrently, but are
+// visible once it has finished.
+func TestConcurrentGlobals(t *testing.T) {
+
+	type Input struct {
+		Name string
+	}
+
+	obj := New(`
+name = Name;
+i = 0;
+while ( i < 1000 ) {
+  i++;
+}
+return name == Name;
+`)
+
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("error preparing: %s", err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				in := Input{Name: fmt.Sprintf("input-%d-%d", i, j)}
+				ok, err := obj.Run(in)
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+					return
+				}
+				if !ok {
+					t.Errorf("saw the global of another run, for %v", in)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	// The globals of the last run are visible afterwards.
+	_, err = obj.Run(Input{Name: "last"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if obj.GetVariable("name").Inspect() != "last" {
+		t.Errorf("global variable was not kept: %s", obj.GetVariable("name").Inspect())
+	}
+}
+
 // Test we can handle null values set in JSON objects
 func TestNullJsonField(t *testing.T) {
 	input := []string{
@@ -1592,3 +1846,1768 @@ return out ;
 		t.Fatalf("failed split/join test got %s not %s", out.Inspect(), nameOut)
 	}
 }
+
+// TestNestedStructures ensures that nested structures, embedded structures,
+// and pointers are available to scripts.
+func TestNestedStructures(t *testing.T) {
+
+	type Address struct {
+		City    string
+		Country string
+	}
+
+	type Customer struct {
+		Name    string
+		Address Address
+		Billing *Address
+	}
+
+	type Base struct {
+		ID   int
+		Kind string
+	}
+
+	type Order struct {
+		Base
+		Kind     string
+		Customer *Customer
+		Items    []Address
+		Missing  *Customer
+	}
+
+	order := &Order{
+		Base: Base{ID: 3, Kind: "base"},
+		Kind: "order",
+		Customer: &Customer{
+			Name:    "Steve",
+			Address: Address{City: "Helsinki", Country: "Finland"},
+		},
+		Items: []Address{{City: "Oulu"}, {City: "Turku"}},
+	}
+
+	tests := []string{
+		`return Customer.Address.City == "Helsinki";`,
+		`return Customer["Address"]["City"] == "Helsinki";`,
+		`return Customer.Name == "Steve";`,
+		`return type(Customer.Billing) == "null";`,
+		`return type(Missing) == "null";`,
+		`return ID == 3;`,
+		`return Kind == "order";`,
+		`return Base.Kind == "base";`,
+		`return Items[1].City == "Turku";`,
+		`return len(Items) == 2;`,
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst)
+
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s - %s", tst, err.Error())
+		}
+
+		ret, err := obj.Run(order)
+		if err != nil {
+			t.Fatalf("Found unexpected error running script: %s : %s", tst, err.Error())
+		}
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst)
+		}
+	}
+}
+
+// TestFieldNaming ensures that structure tags can control the names
+// of the fields which scripts see.
+func TestFieldNaming(t *testing.T) {
+
+	type Inner struct {
+		Label string `json:"label" evalfilter:"tag"`
+	}
+
+	type Event struct {
+		UserID  int    `json:"user_id" evalfilter:"uid"`
+		Name    string `json:"name,omitempty"`
+		Secret  string `json:"secret" evalfilter:"-"`
+		Hidden  string `json:"-"`
+		Nested  Inner  `json:"nested"`
+		private string
+	}
+
+	event := Event{
+		UserID:  42,
+		Name:    "Steve",
+		Secret:  "password",
+		Hidden:  "json-hidden",
+		Nested:  Inner{Label: "inner"},
+		private: "unexported",
+	}
+
+	type Test struct {
+		Input string
+		Flag  []byte
+	}
+
+	tests := []Test{
+		{Input: `return UserID == 42 && Name == "Steve" && Hidden == "json-hidden";`},
+		{Input: `return type(Secret) == "null" && type(private) == "null";`},
+		{Input: `return Nested.Label == "inner";`},
+		{Input: `return user_id == 42 && name == "Steve" && nested.label == "inner";`, Flag: []byte{JSONFieldNames}},
+		{Input: `return type(Hidden) == "null" && type(secret) == "null";`, Flag: []byte{JSONFieldNames}},
+		{Input: `return uid == 42 && Name == "Steve" && Nested.tag == "inner";`, Flag: []byte{TagFieldNames}},
+		{Input: `return type(Secret) == "null";`, Flag: []byte{TagFieldNames}},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+
+		err := obj.Prepare(tst.Flag)
+		if err != nil {
+			t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+		}
+
+		ret, err := obj.Run(event)
+		if err != nil {
+			t.Fatalf("Found unexpected error running script: %s : %s", tst.Input, err.Error())
+		}
+		if !ret {
+			t.Fatalf("Found unexpected result running script: %s", tst.Input)
+		}
+	}
+}
+
+// TestSchema ensures that scripts are checked against a declared schema.
+func TestSchema(t *testing.T) {
+
+	type Origin struct {
+		Host string
+		Port int
+	}
+
+	type Message struct {
+		Message  string
+		Severity int
+		Tags     []string
+		Origin   *Origin
+		Labels   map[string]string
+	}
+
+	type Test struct {
+		Input  string
+		Schema interface{}
+		Flag   []byte
+		Error  string
+	}
+
+	tests := []Test{
+		// Valid references
+		{Input: `return Message ~= /panic/ && Severity > 3;`, Schema: Message{}},
+		{Input: `return Origin.Host == "localhost" && Origin["Port"] == 22;`, Schema: reflect.TypeOf(&Message{})},
+		{Input: `return Tags[0] == "x" && Labels.anything == "y";`, Schema: Message{}},
+		{Input: `count = 0; foreach tag in Tags { count++; } return count > 1;`, Schema: Message{}},
+		{Input: `function f(x) { local y; y = x; return y; } return f(Severity) == 3;`, Schema: Message{}},
+		{Input: `return user == "steve";`, Schema: map[string]interface{}{"user": "steve"}},
+		{Input: `return user.name == "steve";`, Schema: map[string]interface{}{"user": map[string]interface{}{"name": "steve"}}},
+		{Input: `if ( Message != null ) { return true; }`, Schema: Message{}},
+		{Input: `return Origin == null || Origin.Host == null;`, Schema: Message{}},
+
+		// Unknown fields
+		{Input: `return Mesage ~= /panic/;`, Schema: Message{}, Error: "unknown field 'Mesage' around line 1"},
+		{Input: "return true;\nreturn Origin.Hots == 3;", Schema: Message{}, Error: "unknown field 'Origin.Hots' around line 2"},
+		{Input: `return Origin["Prt"] == 3;`, Schema: Message{}, Error: "unknown field 'Origin.Prt'"},
+		{Input: `return usr == "steve";`, Schema: map[string]interface{}{"user": "steve"}, Error: "unknown field 'usr'"},
+		{Input: `return Severity.Level == 3;`, Schema: Message{}, Error: "unknown field 'Severity.Level'"},
+		{Input: `return Message == "x";`, Schema: Message{}, Flag: []byte{JSONFieldNames}},
+
+		// Operand types
+		{Input: `return Severity ~= /panic/;`, Schema: Message{}, Error: "regular expression match against INTEGER field 'Severity'"},
+		{Input: `return Severity == "high";`, Schema: Message{}, Error: "type mismatch: INTEGER == STRING"},
+		{Input: `return Origin.Host > 3;`, Schema: Message{}, Error: "type mismatch: STRING > INTEGER"},
+		{Input: `return Severity == 3.5;`, Schema: Message{}},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetSchema(tst.Schema)
+
+		err := obj.Prepare(tst.Flag)
+		if tst.Error == "" {
+			if err != nil {
+				t.Fatalf("Unexpected error compiling %s - %s", tst.Input, err.Error())
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("Expected an error compiling %s, got none", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("Expected error '%s' compiling %s, got '%s'", tst.Error, tst.Input, err.Error())
+		}
+	}
+
+	// Variables set before Prepare are not fields.
+	obj := New(`return limit > 3;`)
+	obj.SetSchema(Message{})
+	obj.SetVariable("limit", &object.Integer{Value: 4})
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+}
+
+// TestErrorPosition ensures runtime errors report their position.
+func TestErrorPosition(t *testing.T) {
+
+	type Test struct {
+		Input   string
+		Line    int
+		Column  int
+		Snippet string
+		Error   string
+	}
+
+	tests := []Test{
+		{Input: "x = 1 + 2;\nreturn x + \"a\";", Line: 2, Column: 10, Snippet: `return x + "a";`, Error: "type mismatch"},
+		{Input: "\n  return   foo(3);", Line: 2, Column: 15, Snippet: "  return   foo(3);", Error: "the function foo does not exist"},
+		{Input: "function f(a) {\n return a[\"x\"];\n}\nreturn f(3);", Line: 2, Column: 10, Snippet: ` return a["x"];`, Error: "the index operator can only be applied"},
+		{Input: "if (true) {\n  panic(\"fish\");\n}", Line: 2, Column: 8, Snippet: `  panic("fish");`, Error: "fish"},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			_, err = obj.Execute(nil)
+			if err == nil {
+				t.Fatalf("Expected an error running %s, got none", tst.Input)
+			}
+
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("Error has the wrong type: %T", err)
+			}
+			if e.Line != tst.Line || e.Column != tst.Column {
+				t.Fatalf("Wrong position for %s: %d:%d", tst.Input, e.Line, e.Column)
+			}
+			if e.Snippet != tst.Snippet {
+				t.Fatalf("Wrong snippet for %s: '%s'", tst.Input, e.Snippet)
+			}
+			if !strings.Contains(e.Err.Error(), tst.Error) {
+				t.Fatalf("Wrong error for %s: %s", tst.Input, e.Err.Error())
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("around line %d, column %d", tst.Line, tst.Column)) {
+				t.Fatalf("Error message is missing the position: %s", err.Error())
+			}
+		}
+	}
+}
+
+// TestLimits ensures that resource-limits are enforced.
+func TestLimits(t *testing.T) {
+
+	type Test struct {
+		Input  string
+		Limits vm.Limits
+		Limit  string
+	}
+
+	tests := []Test{
+		{Input: `while ( true ) { a = 1; }`, Limits: vm.Limits{Instructions: 1000}, Limit: vm.InstructionLimit},
+		{Input: `return [1, 2, 3, 4, 5, 6, 7, 8];`, Limits: vm.Limits{StackDepth: 4}, Limit: vm.StackLimit},
+		{Input: `function f(n) { return f(n + 1); } return f(0);`, Limits: vm.Limits{CallDepth: 50}, Limit: vm.CallLimit},
+		{Input: `a = 1..100000000; return true;`, Limits: vm.Limits{Size: 1000}, Limit: vm.SizeLimit},
+		{Input: `s = "x"; while ( true ) { s = s + s; }`, Limits: vm.Limits{Size: 1024}, Limit: vm.SizeLimit},
+		{Input: `a = [1, 2, 3, 4, 5]; return true;`, Limits: vm.Limits{Size: 3}, Limit: vm.SizeLimit},
+		{Input: `h = { "a": 1, "b": 2 }; return true;`, Limits: vm.Limits{Size: 1}, Limit: vm.SizeLimit},
+		{Input: `a = split("a,b,c,d", ","); return true;`, Limits: vm.Limits{Size: 3}, Limit: vm.SizeLimit},
+
+		// Scripts within their limits are fine
+		{Input: `a = 1..10; return len(a) == 10;`, Limits: vm.Limits{Instructions: 100, StackDepth: 10, Size: 10}},
+		{Input: `function f(n) { if ( n > 0 ) { return f(n - 1); } return true; } return f(5);`, Limits: vm.Limits{CallDepth: 6}},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetLimits(tst.Limits)
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+		}
+
+		ret, err := obj.Run(nil)
+
+		if tst.Limit == "" {
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if !ret {
+				t.Fatalf("Unexpected result running %s", tst.Input)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("Expected an error running %s, got none", tst.Input)
+		}
+
+		e, ok := err.(*Error).Err.(*vm.LimitError)
+		if !ok {
+			t.Fatalf("Error has the wrong type for %s: %s", tst.Input, err.Error())
+		}
+		if e.Limit != tst.Limit {
+			t.Fatalf("Wrong limit exceeded for %s: %s", tst.Input, e.Limit)
+		}
+	}
+}
+
+// TestBreakContinue ensures that loops may be exited early.
+func TestBreakContinue(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `i = 0; while ( true ) { i++; if ( i == 5 ) { break; } } return i;`, Result: "5"},
+		{Input: `i = 0; t = 0; for ( i < 10 ) { i++; if ( i % 2 == 0 ) { continue; } t += i; } return t;`, Result: "25"},
+		{Input: `t = 0; foreach x in 1..10 { if ( x == 3 ) { continue; } if ( x == 6 ) { break; } t += x; } return t;`, Result: "12"},
+		{Input: `t = ""; foreach i, c in "steve" { if ( i == 3 ) { break; } t += c; } return t;`, Result: "ste"},
+
+		// Nested loops only exit the innermost loop
+		{Input: `t = 0; foreach x in 1..3 { foreach y in 1..3 { if ( y == 2 ) { break; } t += 10; } t += x; } return t;`, Result: "36"},
+		{Input: `t = 0; foreach x in 1..3 { i = 0; while ( i < 5 ) { i++; if ( i > x ) { break; } t++; } } return t;`, Result: "6"},
+
+		// The loop-variables are removed when we break
+		{Input: `foreach x in [1, 2] { break; } return x;`, Result: "null"},
+		{Input: `function f(a) { foreach x in a { if ( x > 1 ) { break; } } return x; } return f([1, 2, 3]);`, Result: "null"},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestIndexAssign ensures that elements of arrays and hashes may be updated.
+func TestIndexAssign(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		{Input: `a = [1, 2, 3]; a[1] = "two"; return a;`, Result: "[1, two, 3]"},
+		{Input: `a = [1, 2, 3]; a[2] += 10; return a[2];`, Result: "13"},
+		{Input: `h = {}; h["name"] = "steve"; return h["name"];`, Result: "steve"},
+		{Input: `h = { "count": 1 }; h["count"] += 1; h.count *= 5; return h.count;`, Result: "10"},
+		{Input: `h = { "name": "bob" }; h.name = "steve"; return h["name"];`, Result: "steve"},
+		{Input: `h = { "x": [ 1, { "y": 2 } ] }; h["x"][1]["y"] = 3; return h.x[1].y;`, Result: "3"},
+
+		// Other references are unaffected
+		{Input: `a = [1, 2]; b = a; a[0] = 3; return b[0];`, Result: "1"},
+
+		// Locals and loop-variables
+		{Input: `function f(a) { local b; b = [a]; b[0] = a * 2; return b[0]; } return f(3);`, Result: "6"},
+		{Input: `t = 0; foreach x in [[1], [2]] { x[0] *= 10; t += x[0]; } return t;`, Result: "30"},
+
+		// Errors
+		{Input: `a = [1, 2]; a[2] = 3;`, Error: "index 2 is out of range for an array of length 2"},
+		{Input: `a = [1, 2]; a[-1] = 3;`, Error: "index -1 is out of range"},
+		{Input: `h = {}; h[[1]] = 3;`, Error: "unusable as hash key: ARRAY"},
+		{Input: `s = "steve"; s[0] = "S";`, Error: "index assignment can only be applied to arrays and hashes, not STRING"},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(nil)
+			if tst.Error != "" {
+				if err == nil {
+					t.Fatalf("Expected an error running %s, got none", tst.Input)
+				}
+				if !strings.Contains(err.Error(), tst.Error) {
+					t.Fatalf("Wrong error for %s: %s", tst.Input, err.Error())
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestFunctionValues ensures that functions may be used as values.
+func TestFunctionValues(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		// Anonymous functions
+		{Input: `f = function(x) { return x * 2; }; return f(4);`, Result: "8"},
+		{Input: `f = function() { }; return type(f);`, Result: "function"},
+		{Input: `return function(a, b) { return a; };`, Result: "function(a, b)"},
+
+		// Passed to other functions, as callbacks
+		{Input: `function apply(f, v) { return f(v); } return apply(function(x) { return x + 1; }, 2);`, Result: "3"},
+		{Input: `function double(x) { return x * 2; } function apply(f, v) { return f(v); } return apply(double, 21);`, Result: "42"},
+		{Input: `function map(a, f) { local r; r = a; foreach i, x in a { r[i] = f(x); } return r; } return map([1, 2], function(x) { return x * 10; });`, Result: "[10, 20]"},
+
+		// Stored in hashes and arrays
+		{Input: `h = { "f": function(x) { return x * 3; } }; return h["f"](3);`, Result: "9"},
+		{Input: `h = { "f": function(x) { return x * 3; } }; return h.f(4);`, Result: "12"},
+		{Input: `a = [ function() { return "a"; }, function() { return "b"; } ]; return a[1]();`, Result: "b"},
+
+		// Captured variables
+		{Input: `function counter() { local n; n = 0; return function() { n++; return n; }; } c = counter(); c(); c(); return c();`, Result: "3"},
+		{Input: `function counter() { local n; n = 0; return function() { n++; return n; }; } a = counter(); b = counter(); a(); a(); return b();`, Result: "1"},
+		{Input: `function adder(n) { return function(x) { return x + n; }; } add = adder(10); return add(5);`, Result: "15"},
+
+		// Errors
+		{Input: `f = 3; f();`, Error: "the function f does not exist"},
+		{Input: `f = function(a) { return a; }; f();`, Error: "mismatch in argument-counts"},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(nil)
+			if tst.Error != "" {
+				if err == nil {
+					t.Fatalf("Expected an error running %s, got none", tst.Input)
+				}
+				if !strings.Contains(err.Error(), tst.Error) {
+					t.Fatalf("Wrong error for %s: %s", tst.Input, err.Error())
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+
+	// Anonymous functions survive serialization.
+	obj := New(`function adder(n) { return function(x) { return x + n; }; } return adder(1)(2);`)
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	data, err := obj.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal: %s", err.Error())
+	}
+	loaded := New("")
+	err = loaded.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %s", err.Error())
+	}
+	out, err := loaded.Execute(nil)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err.Error())
+	}
+	if out.Inspect() != "3" {
+		t.Fatalf("Wrong result: %s", out.Inspect())
+	}
+}
+
+// TestRecursion ensures that deep recursion works, and that runaway
+// recursion is reported cleanly.
+func TestRecursion(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		{Input: `function sum(n) { if ( n == 0 ) { return 0; } return n + sum(n - 1); } return sum(5000);`, Result: "12502500"},
+		{Input: `function fib(n) { if ( n < 2 ) { return n; } return fib(n - 1) + fib(n - 2); } return fib(15);`, Result: "610"},
+		{Input: `function f(n) { return f(n + 1); } return f(0);`, Error: "stack overflow"},
+		{Input: `f = function(n) { return f(n + 1); }; return f(0);`, Error: "stack overflow"},
+
+		// Returning from within a loop drops the scopes of the function
+		{Input: `function first(a) { foreach x in a { return x; } return 0; } first([1]); return type(a);`, Result: "null"},
+		{Input: `function first(a) { foreach x in a { return x; } return 0; } return first([3]) + first([4]);`, Result: "7"},
+
+		// Fields are available within functions
+		{Input: `function name() { return Name; } return name() + Name;`, Result: "SteveSteve"},
+	}
+
+	type Person struct {
+		Name string
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(Person{Name: "Steve"})
+			if tst.Error != "" {
+				if err == nil {
+					t.Fatalf("Expected an error running %s, got none", tst.Input)
+				}
+				if !strings.Contains(err.Error(), tst.Error) {
+					t.Fatalf("Wrong error for %s: %s", tst.Input, err.Error())
+				}
+
+				e, ok := err.(*Error).Err.(*vm.LimitError)
+				if !ok || e.Limit != vm.CallLimit || e.Max != vm.DefaultCallDepth {
+					t.Fatalf("Expected the default call-depth limit for %s: %s", tst.Input, err.Error())
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestLocals tests the scoping of local variables.
+func TestLocals(t *testing.T) {
+
+	// A closure which captures a local with a large slot.
+	many := "function f() { "
+	for i := 0; i < 300; i++ {
+		many += fmt.Sprintf("local v%d; ", i)
+	}
+	many += "v299 = 299; g = function() { v299++; return v299; }; return g(); } return f();"
+
+	// And one which captures a local of a distant function.
+	deep := "function f(x) { "
+	for i := 0; i < 300; i++ {
+		deep += fmt.Sprintf("g%d = function() { ", i)
+	}
+	deep += "return x;"
+	for i := 299; i >= 0; i-- {
+		deep += fmt.Sprintf(" }; return g%d();", i)
+	}
+	deep += " } return f(7);"
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		// Locals don't change globals of the same name
+		{Input: `function f(x) { local y; y = x * 2; return y; } y = 1; f(3); return y;`, Result: "1"},
+		{Input: `function f(x) { x = 10; return x; } x = 1; return f(2) + x;`, Result: "11"},
+		{Input: `x = 7; foreach x in [1] { } return x;`, Result: "7"},
+
+		// Loop-variables are not visible after the loop
+		{Input: `foreach i, x in [1, 2] { } return type(x) + type(i);`, Result: "nullnull"},
+		{Input: `function total(a) { t = 0; foreach i, x in a { t = t + i * x; } return t; } return total([1, 2, 3]);`, Result: "8"},
+
+		// Postfix operations on locals
+		{Input: `function f(x) { x++; x++; x--; return x; } return f(1);`, Result: "2"},
+
+		// Closures share the variables they capture
+		{Input: `function counter() { local n; n = 0; return function() { n++; return n; }; } c = counter(); c(); c(); return c();`, Result: "3"},
+		{Input: `function counter() { local n; n = 0; return function() { n++; return n; }; } a = counter(); b = counter(); a(); a(); return b();`, Result: "1"},
+		{Input: `function add(x) { return function(y) { return function(z) { return x + y + z; }; }; } f = add(1); g = f(2); return g(3);`, Result: "6"},
+		{Input: `function f(x) { g = function(y) { x = x + y; }; g(2); g(3); return x; } return f(1);`, Result: "6"},
+		{Input: `function f(a) { local out; out = 0; foreach x in a { g = function() { out = out + x; }; g(); } return out; } return f([1, 2, 3]);`, Result: "6"},
+		{Input: many, Result: "300"},
+		{Input: deep, Result: "7"},
+	}
+
+	for _, tst := range tests {
+
+		// With and without the optimizer
+		for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+			obj := New(tst.Input)
+			err := obj.Prepare(flags)
+			if err != nil {
+				t.Fatalf("Failed to compile: %s - %s", tst.Input, err.Error())
+			}
+
+			out, err := obj.Execute(nil)
+			if err != nil {
+				t.Fatalf("Unexpected error running %s: %s", tst.Input, err.Error())
+			}
+			if out.Inspect() != tst.Result {
+				t.Fatalf("Wrong result for %s: %s != %s", tst.Input, out.Inspect(), tst.Result)
+			}
+		}
+	}
+}
+
+// TestWideOperands tests programs with more than 65535 constants, and
+// more than 64k of bytecode.
+func TestWideOperands(t *testing.T) {
+
+	// Generate a large allow-list.
+	names := []string{}
+	for i := 0; i < 70000; i++ {
+		names = append(names, fmt.Sprintf("\"user%d\"", i))
+	}
+
+	src := `
+allowed = [];
+if ( len(Name) > 0 ) {
+   allowed = [ ` + strings.Join(names, ", ") + ` ];
+}
+foreach name in allowed {
+   if ( name == Name ) {
+      return true;
+   }
+}
+return false;
+`
+
+	type Person struct {
+		Name string
+	}
+
+	// With and without the optimizer
+	for _, flags := range [][]byte{{}, {NoOptimize}} {
+
+		obj := New(src)
+		err := obj.Prepare(flags)
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+		if len(obj.constants) <= 0xFFFF || len(obj.instructions) <= 0xFFFF {
+			t.Fatalf("The program isn't large enough to be useful")
+		}
+
+		// The program should survive serialization too.
+		data, err := obj.Marshal()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %s", err.Error())
+		}
+		loaded := New("")
+		err = loaded.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal: %s", err.Error())
+		}
+
+		for _, e := range []*Eval{obj, loaded} {
+			for name, expected := range map[string]bool{"user0": true, "user69999": true, "user70000": false} {
+				ret, err := e.Run(Person{Name: name})
+				if err != nil {
+					t.Fatalf("Unexpected error running: %s", err.Error())
+				}
+				if ret != expected {
+					t.Fatalf("Wrong result for %s: %v", name, ret)
+				}
+			}
+		}
+	}
+
+	// Schema errors are reported once, even though the program is
+	// compiled again with wider jumps.
+	obj := New(strings.Replace(src, "return false;", `return Nmae == "steve";`, 1))
+	obj.SetSchema(Person{})
+	err := obj.Prepare()
+	if err == nil {
+		t.Fatalf("Expected a schema error")
+	}
+	if strings.Count(err.Error(), "unknown field 'Nmae'") != 1 {
+		t.Fatalf("Wrong schema errors: %s", err.Error())
+	}
+}
+
+// Test invalid regular expressions are reported, and that patterns may be
+// used by several scripts at once.
+func TestRegexp(t *testing.T) {
+
+	// Invalid literals are found when the script is compiled.
+	obj := New(`return "steve" ~= /+/;`)
+	err := obj.Prepare()
+	if err == nil {
+		t.Fatalf("expected an error compiling an invalid regexp")
+	}
+	if !strings.Contains(err.Error(), "invalid regular expression /+/") {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	// Invalid patterns built at run-time are errors too.
+	obj = New(`reg = "+"; return match("steve", reg);`)
+	err = obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = obj.Run(nil)
+	if err == nil {
+		t.Fatalf("expected an error running an invalid regexp")
+	}
+	if !strings.Contains(err.Error(), "invalid regular expression +") {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, ok := err.(*Error).Err.(*vm.FunctionError); !ok {
+		t.Fatalf("expected a FunctionError, got %T", err.(*Error).Err)
+	}
+
+	// The host may replace the match function, which is then used
+	// by our operators.
+	obj = New(`return "steve" ~= /^(s)/ && $1 == "s" && "kemp" ~= /^s/;`)
+	obj.AddFunction("match", func(args []object.Object) object.Object {
+		return &object.Boolean{Value: true}
+	})
+	err = obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	ret, err := obj.Run(nil)
+	if err != nil || !ret {
+		t.Fatalf("unexpected result from replaced match: %v %v", ret, err)
+	}
+
+	// But it must return a boolean.
+	obj = New(`return "steve" ~= /^s/;`)
+	obj.AddFunction("match", func(args []object.Object) object.Object {
+		return &object.String{Value: "yes"}
+	})
+	err = obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = obj.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "the function match returned STRING, rather than a boolean") {
+		t.Fatalf("unexpected error from replaced match: %v", err)
+	}
+
+	// Several scripts may run concurrently.
+	src := `
+if ( Name !~ /^user/ ) { return false; }
+return match( Name, "^user" + string(Number) + "$" );
+`
+	type Person struct {
+		Name   string
+		Number int
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			e := New(src)
+			err := e.Prepare()
+			if err != nil {
+				t.Errorf("Failed to compile: %s", err.Error())
+				return
+			}
+			for j := 0; j < 50; j++ {
+				ret, err := e.Run(Person{Name: fmt.Sprintf("user%d", j), Number: j})
+				if err != nil || !ret {
+					t.Errorf("unexpected result for %d: %v %v", j, ret, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Test capture groups are available to scripts.
+func TestCaptureGroups(t *testing.T) {
+
+	type Message struct {
+		Subject string
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		{Input: `if ( Subject ~= /\\[([A-Z]+)-(\\d+)\\]/ ) { return $2; } return "none";`, Result: "1234"},
+		{Input: `if ( Subject ~= /\\[([A-Z]+)-(\\d+)\\]/ ) { return $0; } return "none";`, Result: "[TICKET-1234]"},
+		{Input: `if ( Subject !~ /(\\d+)/ ) { return "none"; } return $1;`, Result: "1234"},
+
+		// Missing groups, and failed matches, are null.
+		{Input: `if ( Subject ~= /(\\d+)/ ) { return type($2); } return "none";`, Result: "null"},
+		{Input: `Subject ~= /(\\d+)/; if ( Subject ~= /(missing)/ ) { return "matched"; } return type($1);`, Result: "null"},
+
+		// The most recent match is used.
+		{Input: `a = Subject ~= /(\\d+)/; b = Subject ~= /\\[([A-Z]+)/; return $1;`, Result: "TICKET"},
+
+		// Captures are also available as values.
+		{Input: `c = captures(Subject, /([A-Z]+)-(\\d+)/); return c[2];`, Result: "1234"},
+		{Input: `c = captures(Subject, /(?P<id>\\d+)/); return c.id;`, Result: "1234"},
+
+		// The legacy "$" prefix still refers to fields.
+		{Input: `if ( $Subject ~= /(\\d+)/ ) { return $1; } return "none";`, Result: "1234"},
+
+		// Each line is matched separately, unless the "w" flag is used.
+		{Input: `s = "one\ntwo"; if ( s ~= /^one.two$/s ) { return "matched"; } return "none";`, Result: "none"},
+		{Input: `s = "one\ntwo"; if ( s ~= /^ONE.(two)$/isw ) { return $1; } return "none";`, Result: "two"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetSchema(Message{})
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err.Error())
+		}
+
+		out, err := obj.Execute(Message{Subject: "Re: [TICKET-1234] printer on fire"})
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", tst.Input, err.Error())
+		}
+		if out.Inspect() != tst.Result {
+			t.Errorf("Wrong result for %s: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+		}
+	}
+}
+
+// Test times and durations.
+func TestTimeDuration(t *testing.T) {
+
+	type Message struct {
+		Sent    time.Time
+		Timeout time.Duration
+	}
+
+	cet := time.FixedZone("CET", 3600)
+	msg := Message{
+		Sent:    time.Date(2024, 3, 10, 14, 15, 16, 500000000, cet),
+		Timeout: 90 * time.Second,
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+	}{
+		// Times keep their zone and precision.
+		{Input: `return Sent;`, Result: "2024-03-10T14:15:16.5+01:00"},
+		{Input: `return type(Sent) + " " + type(Timeout);`, Result: "time duration"},
+		{Input: `return hour(Sent);`, Result: "14"},
+
+		// Arithmetic
+		{Input: `return Sent + 2h;`, Result: "2024-03-10T16:15:16.5+01:00"},
+		{Input: `return 2h + Sent;`, Result: "2024-03-10T16:15:16.5+01:00"},
+		{Input: `return Sent - 1h30m;`, Result: "2024-03-10T12:45:16.5+01:00"},
+		{Input: `return (Sent + 2h) - Sent;`, Result: "2h0m0s"},
+		{Input: `return Timeout * 2 + 30s;`, Result: "3m30s"},
+		{Input: `return 2 * Timeout;`, Result: "3m0s"},
+		{Input: `return 1.5 * Timeout;`, Result: "2m15s"},
+		{Input: `return Timeout / 3;`, Result: "30s"},
+		{Input: `return Timeout / 2.0;`, Result: "45s"},
+		{Input: `return 1h / 30m;`, Result: "2"},
+		{Input: `return 100s % 30s;`, Result: "10s"},
+		{Input: `return -Timeout;`, Result: "-1m30s"},
+
+		// Comparisons
+		{Input: `return now() - Sent > 30m;`, Result: "true"},
+		{Input: `return Sent < Sent + 1s;`, Result: "true"},
+		{Input: `return Sent == in_timezone(Sent, "UTC");`, Result: "true"},
+		{Input: `return Timeout >= 90s && Timeout < 2m;`, Result: "true"},
+		{Input: `return Timeout != 1m;`, Result: "true"},
+
+		// Integers are epoch seconds, or a number of seconds.
+		{Input: `return Sent > 1710000000;`, Result: "true"},
+		{Input: `return 1710076516 == Sent;`, Result: "true"},
+		{Input: `return Sent + 60;`, Result: "2024-03-10T14:16:16.5+01:00"},
+		{Input: `return Timeout == 90;`, Result: "true"},
+		{Input: `return 1710076516 + 1m;`, Result: "1710076576"},
+		{Input: `return int(Sent) + int(Timeout);`, Result: "1710076606"},
+
+		// Formatting and parsing.
+		{Input: `return strftime(Sent, "%Y-%m-%d %H:%M");`, Result: "2024-03-10 14:15"},
+		{Input: `return parse_time("10/03/1976", "02/01/2006") < Sent;`, Result: "true"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		obj.SetSchema(Message{})
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err.Error())
+		}
+
+		out, err := obj.Execute(msg)
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", tst.Input, err.Error())
+		}
+		if out.Inspect() != tst.Result {
+			t.Errorf("Wrong result for %s: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+		}
+	}
+
+	// Errors
+	errors := []struct {
+		Input string
+		Error string
+	}{
+		{Input: `return 2x;`, Error: `could not parse "2x" as duration`},
+		{Input: `return Sent + "x";`, Error: "type mismatch: TIME + STRING"},
+		{Input: `x = "x"; return Sent + x;`, Error: "type mismatch: TIME OpAdd STRING"},
+		{Input: `return Sent * 2;`, Error: "TIME OpMul INTEGER"},
+		{Input: `return Timeout / 0;`, Error: "division by zero"},
+		{Input: `return in_timezone(Sent, "Mars/Olympus");`, Error: "unknown timezone Mars/Olympus"},
+	}
+
+	for _, tst := range errors {
+
+		obj := New(tst.Input)
+		obj.SetSchema(Message{})
+		err := obj.Prepare()
+		if err == nil {
+			_, err = obj.Execute(msg)
+		}
+		if err == nil {
+			t.Fatalf("Expected an error for %s", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Error) {
+			t.Errorf("Unexpected error for %s: %s", tst.Input, err.Error())
+		}
+	}
+}
+
+// TestClock ensures that the clock and timezone may be replaced.
+func TestClock(t *testing.T) {
+
+	helsinki := time.FixedZone("EET", 2*3600)
+
+	tests := []struct {
+		Now      time.Time
+		Location *time.Location
+		Result   bool
+	}{
+		// 16:30 in UTC is office hours, but 18:30 in Helsinki is not.
+		{Now: time.Date(2024, 3, 8, 16, 30, 0, 0, time.UTC), Location: time.UTC, Result: true},
+		{Now: time.Date(2024, 3, 8, 16, 30, 0, 0, time.UTC), Location: helsinki, Result: false},
+
+		// Saturday is never office hours.
+		{Now: time.Date(2024, 3, 9, 10, 0, 0, 0, time.UTC), Location: helsinki, Result: false},
+		{Now: time.Date(2024, 3, 11, 8, 0, 0, 0, time.UTC), Location: helsinki, Result: true},
+	}
+
+	input := `
+day = weekday(now());
+if ( day == "Saturday" || day == "Sunday" ) { return false; }
+return hour(now()) >= 9 && hour(time()) < 17;
+`
+	for _, tst := range tests {
+
+		now := tst.Now
+
+		obj := New(input)
+		obj.SetClock(func() time.Time { return now })
+		obj.SetLocation(tst.Location)
+
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+
+		out, err := obj.Run(nil)
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err.Error())
+		}
+		if out != tst.Result {
+			t.Errorf("Wrong result at %s in %s: got %t", now, tst.Location, out)
+		}
+	}
+}
+
+// TestOutput ensures that output may be captured, or logged.
+func TestOutput(t *testing.T) {
+
+	input := `print("Hello, ", Name, "\n"); printf("%d\n", len(Name)); return true;`
+
+	type Person struct {
+		Name string
+	}
+
+	obj := New(input)
+
+	var buf bytes.Buffer
+	obj.SetOutput(&buf)
+
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	// Run concurrently, to ensure writes are serialized.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := obj.Run(Person{Name: "Steve"})
+			if err != nil {
+				t.Errorf("Failed to run: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Messages may be interleaved, but never mixed.
+	out := buf.String()
+	if len(out) != 4*len("Hello, Steve\n5\n") || strings.Count(out, "Hello, Steve\n") != 4 || strings.Count(out, "5\n") != 4 {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+
+	// Now log instead.
+	var logged []string
+	obj.SetLogger(func(level, msg string) {
+		logged = append(logged, level+" "+msg)
+	})
+
+	_, err = obj.Run(Person{Name: "Bob"})
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err.Error())
+	}
+	if strings.Join(logged, "") != "info Hello, Bob\ninfo 3\n" {
+		t.Errorf("unexpected messages: %q", logged)
+	}
+}
+
+// TestPolicy ensures that policies restrict the functions scripts may call.
+func TestPolicy(t *testing.T) {
+
+	tests := []struct {
+		Input  string
+		Policy Policy
+		Result string
+		Error  string
+	}{
+		// Denied functions fail to compile.
+		{Input: `return getenv("HOME");`, Policy: Untrusted(), Error: "the function getenv is not permitted around line 1"},
+		{Input: `return upper("steve");`, Policy: Policy{Default: vm.Deny}, Error: "the function upper is not permitted"},
+		{Input: `return secret();`, Policy: Policy{Functions: map[string]vm.Access{"secret": vm.Deny}}, Error: "the function secret is not permitted"},
+		{Input: `foreach x in [1] { getenv("HOME"); } return true;`, Policy: Untrusted(), Error: "the function getenv is not permitted around line 1"},
+
+		// Or fail when called at run-time.
+		{Input: `h = { "fn": "getenv" }; return h["fn"]("HOME");`, Policy: Untrusted(), Error: "the function getenv is not permitted"},
+		{Input: `return host(1);`, Policy: Policy{Default: vm.Deny}, Error: "the function host is not permitted"},
+
+		// Stubs do nothing.
+		{Input: `print("Hello\n"); return printf("%d\n", 3);`, Policy: Untrusted(), Result: "null"},
+		{Input: `return upper("steve");`, Policy: Policy{Functions: map[string]vm.Access{"upper": vm.Stub}}, Result: "null"},
+
+		// Everything else is permitted.
+		{Input: `return upper("steve");`, Policy: Untrusted(), Result: "STEVE"},
+		{Input: `return "steve" ~= /^s/ && lower("S") == "s";`, Policy: Policy{Default: vm.Deny, Functions: map[string]vm.Access{"lower": vm.Allow}}, Result: "true"},
+
+		// Including functions defined by the script itself.
+		{Input: `function getenv(name) { return "/home/" + name; } return getenv("steve");`, Policy: Untrusted(), Result: "/home/steve"},
+		{Input: `return getenv("steve"); function getenv(name) { return "/home/" + name; }`, Policy: Untrusted(), Result: "/home/steve"},
+		{Input: `function print(x) { return x; } return print("steve");`, Policy: Untrusted(), Result: "steve"},
+		{Input: `function double(x) { return x * 2; } f = function(x) { return x + 1; }; return f(double(2));`, Policy: Policy{Default: vm.Deny}, Result: "5"},
+
+		// Limits are applied.
+		{Input: `while ( true ) { }`, Policy: Untrusted(), Error: "instruction limit of 1000000 exceeded"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input, tst.Policy)
+
+		var buf bytes.Buffer
+		obj.SetOutput(&buf)
+
+		err := obj.Prepare()
+		var out object.Object
+		if err == nil {
+
+			// Added after Prepare, so only checked at run-time.
+			obj.AddFunction("host", func(args []object.Object) object.Object {
+				return args[0]
+			})
+			out, err = obj.Execute(nil)
+		}
+
+		if tst.Error != "" {
+			if err == nil {
+				t.Fatalf("Expected an error for %s", tst.Input)
+			}
+			if !strings.Contains(err.Error(), tst.Error) {
+				t.Errorf("Unexpected error for %s: %s", tst.Input, err.Error())
+			}
+			if strings.Contains(tst.Error, "permitted") {
+				if _, ok := err.(*Error).Err.(*vm.DeniedError); !ok {
+					t.Errorf("Expected a DeniedError for %s, got %T", tst.Input, err.(*Error).Err)
+				}
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", tst.Input, err.Error())
+		}
+		if out.Inspect() != tst.Result {
+			t.Errorf("Wrong result for %s: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Unexpected output for %s: %q", tst.Input, buf.String())
+		}
+	}
+}
+
+// TestWrappedFunctions ensures that plain Go functions may be added.
+func TestWrappedFunctions(t *testing.T) {
+
+	functions := map[string]interface{}{
+		"repeat": strings.Repeat,
+		"between": func(s string, min, max int) (bool, error) {
+			if min > max {
+				return false, fmt.Errorf("%d > %d", min, max)
+			}
+			return len(s) >= min && len(s) <= max, nil
+		},
+		"sum": func(n ...float64) float64 {
+			total := 0.0
+			for _, v := range n {
+				total += v
+			}
+			return total
+		},
+		"byte":  func(b uint8) uint8 { return b },
+		"keys":  func(m map[string]int) []string { return []string{fmt.Sprintf("%d", len(m))} },
+		"later": func(t time.Time, d time.Duration) time.Time { return t.Add(d) },
+		"upper": func(o *object.String) object.Object { return &object.String{Value: strings.ToUpper(o.Value)} },
+		"any":   func(v interface{}) string { return fmt.Sprintf("%v", v) },
+		"check": func(ok bool) error {
+			if !ok {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		},
+		"nothing": func() {},
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		{Input: `return repeat("ab", 3);`, Result: "ababab"},
+		{Input: `return between("steve", 2, 8);`, Result: "true"},
+		{Input: `return sum(1, 2.5, 3);`, Result: "6.5"},
+		{Input: `return sum();`, Result: "0"},
+		{Input: `return byte(255);`, Result: "255"},
+		{Input: `return keys({"a": 1, "b": 2});`, Result: "[2]"},
+		{Input: `return later(0, 90s);`, Result: time.Unix(90, 0).Format(time.RFC3339Nano)},
+		{Input: `return upper("steve");`, Result: "STEVE"},
+		{Input: `return any([1, "two"]);`, Result: "[1 two]"},
+		{Input: `check(true); return true;`, Result: "true"},
+		{Input: `nothing(); return true;`, Result: "true"},
+
+		// Arity is checked at compile-time.
+		{Input: `return repeat("ab");`, Error: "repeat: expected 2 arguments, got 1 around line 1"},
+		{Input: `return between("a", 1, 2, 3);`, Error: "between: expected 3 arguments, got 4"},
+		{Input: `function f() { return upper(); } return f();`, Error: "upper: expected 1 arguments, got 0"},
+
+		// Types, and errors, at run-time.
+		{Input: `return repeat(3, 3);`, Error: "repeat: argument 1: expected string, got INTEGER"},
+		{Input: `return byte(256);`, Error: "byte: argument 1: 256 overflows uint8"},
+		{Input: `return keys({"a": "b"});`, Error: "keys: argument 1: value of a: expected int, got STRING"},
+		{Input: `return between("steve", 8, 2);`, Error: "between: 8 > 2"},
+		{Input: `return check(false);`, Error: "check: failed"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(tst.Input)
+		for name, fn := range functions {
+			err := obj.AddFunction(name, fn)
+			if err != nil {
+				t.Fatalf("Failed to add %s: %s", name, err.Error())
+			}
+		}
+
+		err := obj.Prepare()
+		var out object.Object
+		if err == nil {
+			out, err = obj.Execute(nil)
+		}
+
+		if tst.Error != "" {
+			if err == nil {
+				t.Fatalf("Expected an error for %s", tst.Input)
+			}
+			if !strings.Contains(err.Error(), tst.Error) {
+				t.Errorf("Unexpected error for %s: %s", tst.Input, err.Error())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", tst.Input, err.Error())
+		}
+		if out.Inspect() != tst.Result {
+			t.Errorf("Wrong result for %s: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+		}
+	}
+
+	// Unsupported signatures are rejected.
+	invalid := []interface{}{
+		3,
+		func(c chan int) {},
+		func() (int, int) { return 1, 2 },
+		func() (int, error, error) { return 1, nil, nil },
+		func(s fmt.Stringer) {},
+	}
+
+	for _, fn := range invalid {
+		obj := New(`return true;`)
+		if obj.AddFunction("invalid", fn) == nil {
+			t.Errorf("Expected an error adding %T", fn)
+		}
+	}
+}
+
+// TestContextFunctions ensures that host functions may receive our
+// context, and fail.
+func TestContextFunctions(t *testing.T) {
+
+	type key string
+	missing := fmt.Errorf("not found")
+
+	lookup := func(ctx context.Context, args []object.Object) (object.Object, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected one argument")
+		}
+		if args[0].Inspect() == "slow" {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+		if args[0].Inspect() == "missing" {
+			return nil, missing
+		}
+		if args[0].Inspect() == "nil" {
+			return nil, nil
+		}
+		return &object.String{Value: fmt.Sprintf("%v", ctx.Value(key("user")))}, nil
+	}
+
+	tests := []struct {
+		Input  string
+		Result string
+		Error  string
+	}{
+		{Input: `return lookup("user");`, Result: "steve"},
+		{Input: `return lookup("nil");`, Result: "null"},
+		{Input: `return admin("steve") && !admin("bob");`, Result: "true"},
+		{Input: `return admin("steve", "bob");`, Error: "admin: expected 1 arguments, got 2 around line 1"},
+		{Input: `x = 1;
+return lookup("missing");`, Error: "lookup: not found around line 2, column 14"},
+		{Input: `return lookup("slow");`, Error: "lookup: context deadline exceeded"},
+	}
+
+	for _, tst := range tests {
+
+		ctx := context.WithValue(context.Background(), key("user"), "steve")
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		obj := New(tst.Input)
+		obj.SetContext(ctx)
+		err := obj.AddFunction("lookup", lookup)
+		if err != nil {
+			t.Fatalf("Failed to add function: %s", err.Error())
+		}
+		err = obj.AddFunction("admin", func(ctx context.Context, user string) (bool, error) {
+			return ctx.Value(key("user")) == user, nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to add function: %s", err.Error())
+		}
+
+		err = obj.Prepare()
+		var out object.Object
+		if err == nil {
+			out, err = obj.Execute(nil)
+		}
+
+		if tst.Error != "" {
+			if err == nil {
+				t.Fatalf("Expected an error for %s", tst.Input)
+			}
+			if !strings.Contains(err.Error(), tst.Error) {
+				t.Errorf("Unexpected error for %s: %s", tst.Input, err.Error())
+			}
+			if _, ok := err.(*Error).Err.(*vm.FunctionError); !ok {
+				t.Errorf("Expected a FunctionError for %s, got %T", tst.Input, err.(*Error).Err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Failed to run %s: %s", tst.Input, err.Error())
+		}
+		if out.Inspect() != tst.Result {
+			t.Errorf("Wrong result for %s: got %s, expected %s", tst.Input, out.Inspect(), tst.Result)
+		}
+	}
+
+	// The error the function returned is available.
+	obj := New(`return lookup("missing");`)
+	obj.AddFunction("lookup", lookup)
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	_, err = obj.Execute(nil)
+	if err == nil || err.(*Error).Err.(*vm.FunctionError).Err != missing {
+		t.Errorf("Expected the error the function returned, got %v", err)
+	}
+}
+
+// TestConversion ensures that native values may be passed to scripts, and
+// their results decoded.
+func TestConversion(t *testing.T) {
+
+	type Limits struct {
+		Max  int      `json:"max"`
+		Deny []string `json:"deny"`
+	}
+	type Decision struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+		Limits *Limits
+	}
+
+	input := `
+if ( contains(limits.deny, User) ) {
+   return { "allow": false, "reason": "denied", "Limits": limits };
+}
+return { "allow": Count < limits.max, "reason": "count" };
+`
+	obj := New(input)
+
+	// Use the same names as the script.
+	converter := &object.Converter{FieldName: vm.JSONNames.Name}
+
+	limits, err := converter.FromGo(Limits{Max: 10, Deny: []string{"root"}})
+	if err != nil {
+		t.Fatalf("Failed to convert: %s", err.Error())
+	}
+	obj.SetVariable("limits", limits)
+	obj.AddFunction("contains", func(list []string, s string) bool {
+		for _, x := range list {
+			if x == s {
+				return true
+			}
+		}
+		return false
+	})
+
+	err = obj.Prepare([]byte{JSONFieldNames})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	tests := []struct {
+		Input  map[string]interface{}
+		Result string
+	}{
+		{Input: map[string]interface{}{"User": "steve", "Count": 3}, Result: "true count <nil>"},
+		{Input: map[string]interface{}{"User": "steve", "Count": 30}, Result: "false count <nil>"},
+		{Input: map[string]interface{}{"User": "root", "Count": 3}, Result: "false denied &{10 [root]}"},
+	}
+
+	for _, tst := range tests {
+		out, err := obj.Execute(tst.Input)
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err.Error())
+		}
+
+		var decision Decision
+		err = converter.Decode(out, &decision)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %s", out.Inspect(), err.Error())
+		}
+
+		result := fmt.Sprintf("%t %s %v", decision.Allow, decision.Reason, decision.Limits)
+		if result != tst.Result {
+			t.Errorf("Wrong result for %v: got %s, expected %s", tst.Input, result, tst.Result)
+		}
+	}
+}
+
+// TestWriteBack ensures that scripts may update the object they're run
+// against, if they're allowed to.
+func TestWriteBack(t *testing.T) {
+
+	type Record struct {
+		Name   string
+		Score  float64
+		Rank   int
+		Level  uint
+		Tags   []string
+		Meta   map[string]int
+		secret string
+	}
+
+	input := `
+Score = Score + 1;
+Name = upper(Name);
+Meta["seen"] = Meta["seen"] + 1;
+Rank++;
+Level--;
+total = Score * 2;
+return total == 10;
+`
+
+	// Without the flag the assignments set variables.
+	obj := New(input)
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	record := &Record{Name: "steve", Score: 4, Rank: 1, Level: 3, Meta: map[string]int{"seen": 1}}
+	ok, err := obj.Run(record)
+	if err != nil || !ok {
+		t.Fatalf("Failed to run: %v %v", ok, err)
+	}
+	if record.Name != "steve" || record.Score != 4 || record.Rank != 1 || record.Level != 3 || record.Meta["seen"] != 1 {
+		t.Fatalf("Record was modified: %v", record)
+	}
+
+	// With it the fields are updated.
+	obj = New(input)
+	err = obj.Prepare([]byte{WriteBack})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	meta := record.Meta
+	ok, err = obj.Run(record)
+	if err != nil || !ok {
+		t.Fatalf("Failed to run: %v %v", ok, err)
+	}
+	if record.Name != "STEVE" || record.Score != 5 || record.Rank != 2 || record.Level != 2 || meta["seen"] != 2 {
+		t.Fatalf("Record was not updated: %v", record)
+	}
+
+	// Maps are updated too, preserving the types of their values.
+	obj = New(`
+Count = Count + 1;
+Meta["score"] = 3.5;
+Tags[0] = "first";
+seen = true;
+return Count == 4;
+`)
+	err = obj.Prepare([]byte{WriteBack})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+
+	nested := map[string]interface{}{"id": 7}
+	tags := []string{"a", "b"}
+	fields := map[string]interface{}{"Count": 3, "Meta": nested, "Tags": tags}
+	ok, err = obj.Run(fields)
+	if err != nil || !ok {
+		t.Fatalf("Failed to run: %v %v", ok, err)
+	}
+	if fields["Count"] != 4 {
+		t.Errorf("Count was not updated: %#v", fields["Count"])
+	}
+	if nested["score"] != 3.5 || nested["id"] != 7 {
+		t.Errorf("Meta was not updated in place: %#v", nested)
+	}
+	if !reflect.DeepEqual(fields["Tags"], []string{"first", "b"}) {
+		t.Errorf("Tags were not updated: %#v", fields["Tags"])
+	}
+	if _, ok := fields["seen"]; ok {
+		t.Errorf("A variable was written to the map")
+	}
+
+	// Failures are reported.
+	tests := []struct {
+		Input  string
+		Object interface{}
+		Error  string
+	}{
+		{Input: `Score = 3; return true;`,
+			Object: Record{},
+			Error:  "cannot write to field Score: the structure must be passed to Run by pointer"},
+		{Input: `secret = "x"; return true;`,
+			Object: &Record{},
+			Error:  "cannot write to field secret: the field is unexported"},
+		{Input: `Name = [ 1, 2 ]; return true;`,
+			Object: &Record{},
+			Error:  "cannot write to field Name: expected string, got ARRAY"},
+		{Input: `Meta["seen"] = "twice"; return true;`,
+			Object: &Record{Meta: map[string]int{}},
+			Error:  "cannot write to field Meta: key seen"},
+	}
+
+	for _, tst := range tests {
+		obj := New(tst.Input)
+		err := obj.Prepare([]byte{WriteBack})
+		if err != nil {
+			t.Fatalf("Failed to compile %s: %s", tst.Input, err.Error())
+		}
+
+		_, err = obj.Run(tst.Object)
+		if err == nil {
+			t.Fatalf("Expected an error running %s", tst.Input)
+		}
+		if !strings.Contains(err.Error(), tst.Error) {
+			t.Errorf("Wrong error for %s: got %s, expected %s", tst.Input, err.Error(), tst.Error)
+		}
+		if _, ok := err.(*Error).Err.(*vm.FieldError); !ok {
+			t.Errorf("Expected a FieldError for %s, got %T", tst.Input, err.(*Error).Err)
+		}
+	}
+}
+
+// TestMarshal ensures that prepared programs survive serialization.
+func TestMarshal(t *testing.T) {
+
+	input := `
+function double(x) { return x * 2; }
+
+if ( Name ~= /^ste/i && double(Age) == 84 && 2h > 90m ) {
+   return 3.25 + 100000;
+}
+return false;
+`
+
+	for _, flags := range [][]byte{{}, {NoOptimize}, {JSONFieldNames}} {
+
+		obj := New(input)
+		err := obj.Prepare(flags)
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+
+		data, err := obj.Marshal()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %s", err.Error())
+		}
+
+		loaded := New("")
+		err = loaded.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal: %s", err.Error())
+		}
+
+		if loaded.Script != input {
+			t.Fatalf("Script was not restored")
+		}
+
+		type Person struct {
+			Name string `json:"Name"`
+			Age  int    `json:"Age"`
+		}
+
+		out, err := loaded.Execute(Person{Name: "Steve", Age: 42})
+		if err != nil {
+			t.Fatalf("Failed to run: %s", err.Error())
+		}
+		if out.Inspect() != "100003.25" {
+			t.Fatalf("Wrong result: %s", out.Inspect())
+		}
+
+		// The output is stable.
+		again, err := loaded.Marshal()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %s", err.Error())
+		}
+		if string(again) != string(data) {
+			t.Fatalf("Marshaling the loaded program gave different output")
+		}
+	}
+
+	// Writing back to fields survives too.
+	obj := New(`Score = Score + 1; return true;`)
+	err := obj.Prepare([]byte{WriteBack})
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	data, err := obj.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal: %s", err.Error())
+	}
+	loaded := New("")
+	err = loaded.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %s", err.Error())
+	}
+	record := &struct{ Score int }{Score: 1}
+	_, err = loaded.Run(record)
+	if err != nil {
+		t.Fatalf("Failed to run: %s", err.Error())
+	}
+	if record.Score != 2 {
+		t.Fatalf("Field was not written back: %d", record.Score)
+	}
+
+	// Error positions survive too.
+	obj = New("x = 3;\nreturn x[\"y\"];")
+	err = obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	data, err = obj.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal: %s", err.Error())
+	}
+	loaded = New("")
+	err = loaded.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %s", err.Error())
+	}
+	_, err = loaded.Execute(nil)
+	if err == nil {
+		t.Fatalf("Expected an error, got none")
+	}
+	if e, ok := err.(*Error); !ok || e.Line != 2 || e.Snippet != `return x["y"];` {
+		t.Fatalf("Wrong error: %s", err.Error())
+	}
+
+	// We can't marshal a program which isn't prepared.
+	_, err = New("return true;").Marshal()
+	if err == nil {
+		t.Fatalf("Expected an error marshaling an unprepared program")
+	}
+}
+
+// TestUnmarshalCorrupt ensures that corrupt input is rejected.
+func TestUnmarshalCorrupt(t *testing.T) {
+
+	obj := New(`function f() { return 1; } return f() == 1 && "steve" ~= /ste/;`)
+	err := obj.Prepare()
+	if err != nil {
+		t.Fatalf("Failed to compile: %s", err.Error())
+	}
+	data, err := obj.Marshal()
+	if err != nil {
+		t.Fatalf("Failed to marshal: %s", err.Error())
+	}
+
+	// Every truncation must fail.
+	for i := 0; i < len(data); i++ {
+		err = New("").Unmarshal(data[:i])
+		if err == nil {
+			t.Fatalf("Expected an error loading %d bytes", i)
+		}
+	}
+
+	// Trailing data is rejected.
+	err = New("").Unmarshal(append(data, 0))
+	if err == nil || !strings.Contains(err.Error(), "trailing") {
+		t.Fatalf("Expected an error about trailing data, got %v", err)
+	}
+
+	// Unknown versions are rejected.
+	bad := append([]byte{}, data...)
+	bad[5] = 99
+	err = New("").Unmarshal(bad)
+	if err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("Expected an error about the version, got %v", err)
+	}
+
+	// As is random junk
+	err = New("").Unmarshal([]byte("return true;"))
+	if err == nil {
+		t.Fatalf("Expected an error loading a script")
+	}
+
+	// Invalid bytecode is rejected.
+	type Test struct {
+		Bytecode code.Instructions
+		Error    string
+	}
+
+	tests := []Test{
+		{Bytecode: code.Instructions{0xFF}, Error: "unknown opcode"},
+		{Bytecode: code.Instructions{byte(code.OpTrue), byte(code.OpConstant), 0}, Error: "truncated"},
+		{Bytecode: code.Instructions{byte(code.OpConstant), 0, 99}, Error: "missing constant"},
+		{Bytecode: code.Instructions{byte(code.OpLookup), 1, 0}, Error: "missing constant"},
+		{Bytecode: code.Instructions{byte(code.OpJump), 0, 99}, Error: "invalid target"},
+		{Bytecode: code.Instructions{byte(code.OpWide)}, Error: "truncated"},
+		{Bytecode: code.Instructions{byte(code.OpWide), byte(code.OpConstant), 0, 0}, Error: "truncated"},
+		{Bytecode: code.Instructions{byte(code.OpWide), byte(code.OpTrue)}, Error: "invalid OpWide prefix"},
+		{Bytecode: code.Instructions{byte(code.OpWide), byte(code.OpConstant), 0, 1, 0, 0}, Error: "missing constant"},
+	}
+
+	for _, tst := range tests {
+
+		obj := New(`return "steve";`)
+		err := obj.Prepare()
+		if err != nil {
+			t.Fatalf("Failed to compile: %s", err.Error())
+		}
+		obj.instructions = tst.Bytecode
+
+		data, err := obj.Marshal()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %s", err.Error())
+		}
+
+		err = New("").Unmarshal(data)
+		if err == nil {
+			t.Fatalf("Expected an error loading %v", tst.Bytecode)
+		}
+		if !strings.Contains(err.Error(), tst.Error) {
+			t.Fatalf("Expected error '%s', got '%s'", tst.Error, err.Error())
+		}
+	}
+}
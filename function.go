@@ -0,0 +1,162 @@
+package evalfilter
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// builtin is the signature of the functions which the virtual machine
+// invokes.
+type builtin = func(args []object.Object) object.Object
+
+// contextBuiltin is the signature of the functions which the virtual
+// machine invokes with its context, and which may fail.  Everything else
+// passed to AddFunction is wrapped to match it.
+type contextBuiltin = func(ctx context.Context, args []object.Object) (object.Object, error)
+
+// The types we handle specially.
+var (
+	objectType  = reflect.TypeOf((*object.Object)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// wrapFunction returns a contextBuiltin which invokes the given Go function,
+// converting the arguments it is called with, and the results it returns.
+//
+// The function may accept any number of arguments, and return a single
+// value, an error, or a value and an error.  Arguments and results may be
+// booleans, numbers, strings, times, durations, objects, structures, or
+// slices, maps, and pointers of those, which are converted via the given
+// converter.  If the first argument is a context.Context it receives the
+// context given to SetContext.
+func wrapFunction(name string, fun interface{}, converter *object.Converter) (contextBuiltin, error) {
+
+	fn := reflect.ValueOf(fun)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("%s: expected a function, got %T", name, fun)
+	}
+
+	// Validate the signature.
+	typ := fn.Type()
+	skip := contextArgs(typ)
+	for i := skip; i < typ.NumIn(); i++ {
+		arg := typ.In(i)
+		if i == typ.NumIn()-1 && typ.IsVariadic() {
+			arg = arg.Elem()
+		}
+		if !convertible(arg) {
+			return nil, fmt.Errorf("%s: unsupported type %s for argument %d", name, arg, i+1-skip)
+		}
+	}
+
+	switch typ.NumOut() {
+	case 0:
+	case 1:
+		if typ.Out(0) != errorType && !convertible(typ.Out(0)) {
+			return nil, fmt.Errorf("%s: unsupported result type %s", name, typ.Out(0))
+		}
+	case 2:
+		if !convertible(typ.Out(0)) || typ.Out(1) != errorType {
+			return nil, fmt.Errorf("%s: results must be a value and an error, got (%s, %s)", name, typ.Out(0), typ.Out(1))
+		}
+	default:
+		return nil, fmt.Errorf("%s: too many results, %d", name, typ.NumOut())
+	}
+
+	return func(ctx context.Context, args []object.Object) (object.Object, error) {
+
+		err := checkArity(typ, len(args))
+		if err != nil {
+			return nil, err
+		}
+
+		// Convert our arguments, after the context if the
+		// function wants it.
+		in := make([]reflect.Value, skip, skip+len(args))
+		if skip > 0 {
+			in[0] = reflect.ValueOf(&ctx).Elem()
+		}
+		for i, arg := range args {
+			var t reflect.Type
+			if typ.IsVariadic() && skip+i >= typ.NumIn()-1 {
+				t = typ.In(typ.NumIn() - 1).Elem()
+			} else {
+				t = typ.In(skip + i)
+			}
+
+			val := reflect.New(t).Elem()
+			err := converter.DecodeValue(arg, val)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i+1, err)
+			}
+			in = append(in, val)
+		}
+
+		// Call the function, and convert the result.
+		out := fn.Call(in)
+		if len(out) > 0 && out[len(out)-1].Type() == errorType {
+			if e := out[len(out)-1]; !e.IsNil() {
+				return nil, e.Interface().(error)
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return &object.Void{}, nil
+		}
+		return converter.FromValue(out[0])
+	}, nil
+}
+
+// contextArgs returns the number of leading arguments of a function of
+// the given type which we supply the context to, rather than the script.
+func contextArgs(typ reflect.Type) int {
+	if typ.NumIn() > 0 && typ.In(0) == contextType {
+		return 1
+	}
+	return 0
+}
+
+// checkArity returns an error if a function of the given type may not be
+// called with the specified number of arguments.
+func checkArity(typ reflect.Type, args int) error {
+	params := typ.NumIn() - contextArgs(typ)
+	if typ.IsVariadic() {
+		if args < params-1 {
+			return fmt.Errorf("expected at least %d arguments, got %d", params-1, args)
+		}
+		return nil
+	}
+	if args != params {
+		return fmt.Errorf("expected %d arguments, got %d", params, args)
+	}
+	return nil
+}
+
+// convertible returns true if values of the given type may be passed to,
+// and returned from, wrapped functions.
+func convertible(t reflect.Type) bool {
+	if t.Implements(objectType) || t == objectType {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	case reflect.Struct:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return convertible(t.Elem())
+	case reflect.Map:
+		return convertible(t.Key()) && convertible(t.Elem())
+	}
+	return false
+}
@@ -178,12 +178,14 @@ func (l *Lexer) NextToken() token.Token {
 		//   foo[3] / 3      -> INDEX
 		//   3.2 / c         -> FLOAT
 		//   1 / c           -> INT
+		//   2h / c          -> DURATION
 		//
 		if l.prevToken.Type == token.RPAREN ||
 			l.prevToken.Type == token.IDENT ||
 			l.prevToken.Type == token.RSQUARE ||
 			l.prevToken.Type == token.FLOAT ||
-			l.prevToken.Type == token.INT {
+			l.prevToken.Type == token.INT ||
+			l.prevToken.Type == token.DURATION {
 
 			if l.peekChar() == rune('=') {
 				ch := l.ch
@@ -397,15 +399,44 @@ func (l *Lexer) readDecimal() token.Token {
 
 		// Get the float-component.
 		fraction := l.readNumber()
+
+		//
+		// A unit makes this a duration, "1.5h", etc.
+		//
+		if unicode.IsLetter(l.ch) {
+			return l.readDuration(integer + "." + fraction)
+		}
 		return token.Token{Type: token.FLOAT, Literal: integer + "." + fraction}
 	}
 
+	//
+	// A unit makes this a duration, "2h", "30s", etc.
+	//
+	if unicode.IsLetter(l.ch) {
+		return l.readDuration(integer)
+	}
+
 	//
 	// Just an integer.
 	//
 	return token.Token{Type: token.INT, Literal: integer}
 }
 
+// readDuration reads the remainder of a duration, such as "1h30m", given
+// the number which started it.
+//
+// We accept any letters as units, the parser will reject the invalid ones.
+func (l *Lexer) readDuration(number string) token.Token {
+
+	out := number
+	for unicode.IsLetter(l.ch) || isDigit(l.ch) || (l.ch == rune('.') && isDigit(l.peekChar())) {
+		out += string(l.ch)
+		l.readChar()
+	}
+
+	return token.Token{Type: token.DURATION, Literal: out}
+}
+
 // read a string, deliminated by the given character.
 func (l *Lexer) readString(delim rune) (string, error) {
 	out := ""
@@ -477,9 +508,11 @@ func (l *Lexer) readRegexp() (string, error) {
 			// prepare to look for flags
 			flags := ""
 
-			// two flags are supported:
+			// four flags are supported:
 			//   i -> Ignore-case
 			//   m -> Multiline
+			//   s -> Let . match newlines
+			//   w -> Match the whole input, not each line
 			//
 			// We need to consume all letters, so we can
 			// alert on illegal ones.
@@ -501,7 +534,7 @@ func (l *Lexer) readRegexp() (string, error) {
 
 			for _, c := range flags {
 				switch c {
-				case 'i', 'm':
+				case 'i', 'm', 's', 'w':
 					// nop
 				default:
 					return "", fmt.Errorf("illegal regexp flag '%c' in string '%s'", c, flags)
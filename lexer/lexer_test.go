@@ -243,6 +243,37 @@ func TestWhile(t *testing.T) {
 	}
 }
 
+func TestLoopControl(t *testing.T) {
+	input := `while ( true ) { continue; break; }`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.TRUE, "true"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.CONTINUE, "continue"},
+		{token.SEMICOLON, ";"},
+		{token.BREAK, "break"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 func TestNextToken1(t *testing.T) {
 	input := `-=*=..=+√%(){},;~= !~"`
 
@@ -472,6 +503,38 @@ func TestIntegers(t *testing.T) {
 	}
 }
 
+// TestDurations ensures that numbers followed by units are durations.
+func TestDurations(t *testing.T) {
+	input := `2h 1h30m 1.5s 500ms 2x 2h / 4 3m;`
+
+	tests := []struct {
+		expectedType    token.Type
+		expectedLiteral string
+	}{
+		{token.DURATION, "2h"},
+		{token.DURATION, "1h30m"},
+		{token.DURATION, "1.5s"},
+		{token.DURATION, "500ms"},
+		{token.DURATION, "2x"},
+		{token.DURATION, "2h"},
+		{token.SLASH, "/"},
+		{token.INT, "4"},
+		{token.DURATION, "3m"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
 // TestMoreHandling does nothing real, but it bumps our coverage!
 func TestMoreHandling(t *testing.T) {
 	input := `
@@ -566,6 +629,8 @@ func TestRegexp(t *testing.T) {
 if ( f ~= /steve/m )
 if ( f ~= /steve\//m )
 if ( f ~= /steve/mi )
+if ( f ~= /steve/is )
+if ( f ~= /steve/w )
 if ( f ~= /steve/miiiiiiiiiiiiiiiiimmmmmmmmmmmmmiiiii )
 if ( f ~= /steve/fx )`
 
@@ -605,6 +670,22 @@ if ( f ~= /steve/fx )`
 		{token.REGEXP, "(?mi)steve"},
 		{token.RPAREN, ")"},
 
+		// if ( f ~= /steve/is )
+		{token.IF, "if"},
+		{token.LPAREN, "("},
+		{token.IDENT, "f"},
+		{token.CONTAINS, "~="},
+		{token.REGEXP, "(?is)steve"},
+		{token.RPAREN, ")"},
+
+		// if ( f ~= /steve/w )
+		{token.IF, "if"},
+		{token.LPAREN, "("},
+		{token.IDENT, "f"},
+		{token.CONTAINS, "~="},
+		{token.REGEXP, "(?w)steve"},
+		{token.RPAREN, ")"},
+
 		//if ( f ~= /steve/miiiiiiiiiiiiiiiiimmmmmmmmmmmmmiiiii )`
 		{token.IF, "if"},
 		{token.LPAREN, "("},
@@ -0,0 +1,478 @@
+// This file contains the code which allows a prepared program to be
+// serialized to a portable binary format, and later loaded again.
+//
+// This allows the cost of compilation to be avoided when the same
+// scripts are used by many processes.
+//
+// The format is simple, all integers are stored in big-endian order:
+//
+//   magic      "EFC\x00"
+//   version    uint16
+//   optimize   byte, 1 if the optimizer should run
+//   naming     byte, the vm.FieldNaming to use
+//   writeBack  byte, 1 if assignments update the fields of the object
+//   script     string, the source of the program
+//   constants  uint32 count, then a type-tag & value for each, with
+//              anonymous functions stored as their arguments, bytecode
+//              and source-positions
+//   program    the main bytecode, and its source-positions
+//   functions  uint32 count, then the name, arguments, bytecode and
+//              source-positions for each user-defined function
+//
+// Strings and bytecode are stored as a uint32 length, then the data.
+
+package evalfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/skx/evalfilter/v2/code"
+	"github.com/skx/evalfilter/v2/environment"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/vm"
+)
+
+// magic is the header which identifies a serialized program.
+const magic = "EFC\x00"
+
+// version is the version of the format we read and write.
+//
+// This must be bumped whenever the format, or the instruction-set,
+// changes incompatibly.
+const version = 4
+
+// Type-tags for the constants we serialize.
+const (
+	tagString   byte = 'S'
+	tagInteger  byte = 'I'
+	tagFloat    byte = 'F'
+	tagDuration byte = 'D'
+	tagRegexp   byte = 'R'
+	tagFunction byte = 'U'
+)
+
+// Marshal serializes the prepared program, so that it may be loaded
+// again via Unmarshal without the need to compile it.
+//
+// Prepare must have been called before Marshal.
+func (e *Eval) Marshal() ([]byte, error) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.machine == nil {
+		return nil, fmt.Errorf("the program has not been prepared")
+	}
+
+	w := &encoder{}
+
+	// Header
+	w.buf.WriteString(magic)
+	w.uint16(version)
+	if e.optimize {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+	w.byte(byte(e.naming))
+	if e.writeBack {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+	w.string(e.Script)
+
+	// Constants
+	w.uint32(len(e.constants))
+	for _, c := range e.constants {
+		switch c := c.(type) {
+		case *object.String:
+			w.byte(tagString)
+			w.string(c.Value)
+		case *object.Integer:
+			w.byte(tagInteger)
+			w.uint64(uint64(c.Value))
+		case *object.Float:
+			w.byte(tagFloat)
+			w.uint64(math.Float64bits(c.Value))
+		case *object.Duration:
+			w.byte(tagDuration)
+			w.uint64(uint64(c.Value))
+		case *object.Regexp:
+			w.byte(tagRegexp)
+			w.string(c.Value)
+		case *object.Function:
+			w.byte(tagFunction)
+			w.uint32(len(c.Arguments))
+			for _, arg := range c.Arguments {
+				w.string(arg)
+			}
+			w.bytes(c.Bytecode)
+			w.positions(c.Positions)
+		default:
+			return nil, fmt.Errorf("cannot serialize constant of type %s", c.Type())
+		}
+	}
+
+	// The main program
+	w.bytes(e.instructions)
+	w.positions(e.positions)
+
+	// User-defined functions, sorted so that our output is stable.
+	names := []string{}
+	for name := range e.functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.uint32(len(names))
+	for _, name := range names {
+		fn := e.functions[name]
+
+		w.string(name)
+		w.uint32(len(fn.Arguments))
+		for _, arg := range fn.Arguments {
+			w.string(arg)
+		}
+		w.bytes(fn.Bytecode)
+		w.positions(fn.Positions)
+	}
+
+	return w.buf.Bytes(), nil
+}
+
+// Unmarshal loads a program which was previously serialized via Marshal.
+//
+// This may be used instead of Prepare, and like Prepare any variables or
+// context should be set before it is invoked.
+//
+// The data is validated as it is loaded, so that corrupt input results
+// in an error rather than a failure at run-time.
+func (e *Eval) Unmarshal(data []byte) error {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	r := &decoder{data: data}
+
+	// Header
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return fmt.Errorf("not a compiled evalfilter program")
+	}
+	r.data = r.data[len(magic):]
+
+	v := r.uint16()
+	if r.err == nil && v != version {
+		return fmt.Errorf("unsupported format version %d, expected %d", v, version)
+	}
+	optimize := r.byte() == 1
+	naming := vm.FieldNaming(r.byte())
+	writeBack := r.byte() == 1
+	script := r.string()
+
+	// Constants
+	var constants []object.Object
+	count := r.count()
+	for i := 0; i < count && r.err == nil; i++ {
+		switch tag := r.byte(); tag {
+		case tagString:
+			constants = append(constants, &object.String{Value: r.string()})
+		case tagInteger:
+			constants = append(constants, &object.Integer{Value: int64(r.uint64())})
+		case tagFloat:
+			constants = append(constants, &object.Float{Value: math.Float64frombits(r.uint64())})
+		case tagDuration:
+			constants = append(constants, &object.Duration{Value: time.Duration(r.uint64())})
+		case tagRegexp:
+			reg, err := object.NewRegexp(r.string())
+			if err != nil {
+				r.fail(fmt.Errorf("invalid regular expression constant: %s", err.Error()))
+				break
+			}
+			constants = append(constants, reg)
+		case tagFunction:
+			fn := &object.Function{}
+			args := r.count()
+			for j := 0; j < args && r.err == nil; j++ {
+				fn.Arguments = append(fn.Arguments, r.string())
+			}
+			fn.Bytecode = code.Instructions(r.bytes())
+			fn.Positions = r.positions()
+			constants = append(constants, fn)
+		default:
+			r.fail(fmt.Errorf("unknown constant type 0x%02X", tag))
+		}
+	}
+
+	// The main program
+	instructions := code.Instructions(r.bytes())
+	positions := r.positions()
+
+	// User-defined functions
+	functions := make(map[string]environment.UserFunction)
+	count = r.count()
+	for i := 0; i < count && r.err == nil; i++ {
+		name := r.string()
+
+		fn := environment.UserFunction{}
+		args := r.count()
+		for j := 0; j < args && r.err == nil; j++ {
+			fn.Arguments = append(fn.Arguments, r.string())
+		}
+		fn.Bytecode = code.Instructions(r.bytes())
+		fn.Positions = r.positions()
+
+		functions[name] = fn
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return fmt.Errorf("found %d bytes of trailing data", len(r.data))
+	}
+
+	// Ensure the bytecode is sane.
+	err := validate(instructions, len(constants))
+	if err != nil {
+		return err
+	}
+	for name, fn := range functions {
+		err = validate(fn.Bytecode, len(constants))
+		if err != nil {
+			return fmt.Errorf("function %s: %s", name, err.Error())
+		}
+	}
+	for i, c := range constants {
+		if fn, ok := c.(*object.Function); ok {
+			err = validate(fn.Bytecode, len(constants))
+			if err != nil {
+				return fmt.Errorf("constant %d: %s", i, err.Error())
+			}
+		}
+	}
+
+	// Now we can replace our state.
+	e.Script = script
+	e.constants = constants
+	e.instructions = instructions
+	e.positions = positions
+	e.functions = functions
+	e.optimize = optimize
+	e.naming = naming
+	e.writeBack = writeBack
+
+	e.createMachine()
+	return nil
+}
+
+// validate ensures that the given bytecode contains only known opcodes,
+// that each has its operand, and that the operands which refer to
+// constants, or jump targets, are in range.
+func validate(bytecode code.Instructions, constants int) error {
+
+	ip := 0
+	ln := len(bytecode)
+
+	for ip < ln {
+
+		op, arg, opLen := code.Read(bytecode, ip)
+		if int(op) >= len(code.OpCodeNames) || code.OpCodeNames[op] == "" {
+			return fmt.Errorf("unknown opcode 0x%02X at offset %d", byte(op), ip)
+		}
+
+		if ip+opLen > ln {
+			return fmt.Errorf("truncated %s instruction at offset %d", code.String(op), ip)
+		}
+
+		// OpWide may only prefix an instruction with an argument.
+		if bytecode[ip] == byte(code.OpWide) && code.Length(op) == 1 {
+			return fmt.Errorf("invalid %s prefix at offset %d", code.String(code.OpWide), ip)
+		}
+
+		if code.Length(op) > 1 {
+			switch op {
+			case code.OpConstant, code.OpLookup, code.OpInc, code.OpDec, code.OpClosure:
+				if arg >= constants {
+					return fmt.Errorf("%s at offset %d refers to missing constant %d", code.String(op), ip, arg)
+				}
+			case code.OpJump, code.OpJumpIfFalse:
+				if arg > ln {
+					return fmt.Errorf("%s at offset %d has an invalid target %d", code.String(op), ip, arg)
+				}
+			}
+		}
+
+		ip += opLen
+	}
+	return nil
+}
+
+// encoder is a helper for writing our serialized format.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// byte writes a single byte.
+func (w *encoder) byte(v byte) {
+	w.buf.WriteByte(v)
+}
+
+// uint16 writes a 16-bit integer.
+func (w *encoder) uint16(v int) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	w.buf.Write(b)
+}
+
+// uint32 writes a 32-bit integer.
+func (w *encoder) uint32(v int) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	w.buf.Write(b)
+}
+
+// uint64 writes a 64-bit integer.
+func (w *encoder) uint64(v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	w.buf.Write(b)
+}
+
+// bytes writes a length-prefixed series of bytes.
+func (w *encoder) bytes(v []byte) {
+	w.uint32(len(v))
+	w.buf.Write(v)
+}
+
+// string writes a length-prefixed string.
+func (w *encoder) string(v string) {
+	w.bytes([]byte(v))
+}
+
+// positions writes a table of source-positions, ordered by offset.
+func (w *encoder) positions(p code.Positions) {
+	offsets := []int{}
+	for offset := range p {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	w.uint32(len(offsets))
+	for _, offset := range offsets {
+		w.uint32(offset)
+		w.uint32(p[offset].Line)
+		w.uint32(p[offset].Column)
+	}
+}
+
+// decoder is a helper for reading our serialized format.
+//
+// The first error encountered is recorded, after which all reads
+// return zero-values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+// fail records an error, if we've not already seen one.
+func (r *decoder) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// next returns the next n bytes of input.
+func (r *decoder) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.fail(fmt.Errorf("unexpected end of input"))
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+// byte reads a single byte.
+func (r *decoder) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// uint16 reads a 16-bit integer.
+func (r *decoder) uint16() int {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// uint32 reads a 32-bit integer.
+func (r *decoder) uint32() int {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(b))
+}
+
+// uint64 reads a 64-bit integer.
+func (r *decoder) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// count reads the number of items which follow.
+//
+// Each item occupies at least one byte, so a count larger than the
+// remaining input is an error - this avoids huge allocations when
+// reading corrupt data.
+func (r *decoder) count() int {
+	n := r.uint32()
+	if n > len(r.data) {
+		r.fail(fmt.Errorf("unexpected end of input"))
+		return 0
+	}
+	return n
+}
+
+// bytes reads a length-prefixed series of bytes.
+func (r *decoder) bytes() []byte {
+	b := r.next(r.uint32())
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+// string reads a length-prefixed string.
+func (r *decoder) string() string {
+	return string(r.bytes())
+}
+
+// positions reads a table of source-positions.
+func (r *decoder) positions() code.Positions {
+	p := make(code.Positions)
+	count := r.count()
+	for i := 0; i < count && r.err == nil; i++ {
+		offset := r.uint32()
+		line := r.uint32()
+		column := r.uint32()
+		p[offset] = code.Position{Line: line, Column: column}
+	}
+	return p
+}
@@ -29,7 +29,9 @@
 
 (defvar evalfilter-keywords
   '(
+    "break"
     "case"
+    "continue"
     "default"
     "else"
     "for"
@@ -19,7 +19,7 @@ export default function(hljs) {
         keywords: {
             $pattern: hljs.UNDERSCORE_IDENT_RE,
             literal: "true false nil",
-            keyword: "case default else for foreach function if in local return switch while",
+            keyword: "break case continue default else for foreach function if in local return switch while",
             built_in: "between day float getenv hour int keys len lower match max min minute month now panic printf print reverse seconds sort split sprintf string time trim type upper weekday year",
         },
         contains: [
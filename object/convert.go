@@ -0,0 +1,579 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// The types we handle specially.
+var (
+	objectType   = reflect.TypeOf((*Object)(nil)).Elem()
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Converter converts golang values to objects, and decodes objects into
+// golang values, via reflection.
+//
+// Booleans, numbers of any width, strings, times, durations, slices,
+// arrays, maps, structures, and pointers to any of those, are supported.
+// Values which are already objects are used as-is.
+type Converter struct {
+	// FieldName returns the name the given structure-field is known
+	// by, along with false if it should be hidden.
+	//
+	// If this is nil exported fields are known by their Go names,
+	// unless they have the tag `evalfilter:"-"`, which hides them.
+	// To match the names scripts see use the Name method of the
+	// appropriate vm.FieldNaming, such as vm.JSONNames.Name.
+	FieldName func(field reflect.StructField) (string, bool)
+
+	// Lenient causes values which can't be converted to an object,
+	// such as channels, to become null rather than an error.
+	Lenient bool
+}
+
+// FromGo converts the given golang value to an object, using the default
+// Converter.
+//
+// Structures become hashes of their fields, and self-referential values
+// become null where they refer to themselves.
+func FromGo(value interface{}) (Object, error) {
+	return (&Converter{}).FromGo(value)
+}
+
+// Decode stores the given object in the value the target points to, using
+// the default Converter.
+//
+// Hashes may be decoded into maps, or structures, and the values they
+// contain are converted to the type of the field they're stored in.  Keys
+// which have no corresponding field are ignored.  Integers are accepted as
+// epoch seconds for times, and a number of seconds for durations.
+func Decode(obj Object, target interface{}) error {
+	return (&Converter{}).Decode(obj, target)
+}
+
+// FromGo converts the given golang value to an object.
+func (c *Converter) FromGo(value interface{}) (Object, error) {
+	return c.FromValue(reflect.ValueOf(value))
+}
+
+// FromValue converts the given reflected value to an object.
+func (c *Converter) FromValue(value reflect.Value) (Object, error) {
+	return c.fromValue(value, make(map[uintptr]bool))
+}
+
+// Decode stores the given object in the value the target points to.
+func (c *Converter) Decode(obj Object, target interface{}) error {
+	val := reflect.ValueOf(target)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return fmt.Errorf("cannot decode into %T, it must be a non-nil pointer", target)
+	}
+	return c.DecodeValue(obj, val.Elem())
+}
+
+// DecodeValue stores the given object in the given reflected value, which
+// must be settable.
+func (c *Converter) DecodeValue(obj Object, val reflect.Value) error {
+	if !val.CanSet() {
+		return fmt.Errorf("cannot decode into an unsettable %s", val.Type())
+	}
+	return c.decode(obj, val)
+}
+
+// fieldName returns the name the given structure-field is known by.
+func (c *Converter) fieldName(field reflect.StructField) (string, bool) {
+	if c.FieldName != nil {
+		return c.FieldName(field)
+	}
+
+	// Embedded structures may have their fields promoted, even
+	// if they're unexported themselves.
+	if (field.PkgPath != "" && !field.Anonymous) || field.Tag.Get("evalfilter") == "-" {
+		return "", false
+	}
+	return field.Name, true
+}
+
+// walkStruct invokes the given callback for each field in the structure,
+// including the fields promoted from any embedded structures.
+//
+// As in Go itself the fields of the outer structure take precedence over
+// those which are promoted from an embedded one.
+func (c *Converter) walkStruct(val reflect.Value, callback func(name string, field reflect.Value)) {
+
+	// Names we've already handled.
+	found := make(map[string]bool)
+
+	// Embedded structures we'll handle after the direct fields.
+	var embedded []reflect.Value
+
+	for i := 0; i < val.NumField(); i++ {
+
+		// Get the field
+		field := val.Field(i)
+
+		// Get the name, skipping fields which are hidden.
+		typeField := val.Type().Field(i)
+		name, ok := c.fieldName(typeField)
+		if !ok {
+			continue
+		}
+
+		// Embedded structures, or pointers to them, have
+		// their fields promoted once we're done here - unless
+		// they were explicitly given a name via a tag.
+		if typeField.Anonymous && name == typeField.Name {
+			inner := field
+			if inner.Kind() == reflect.Ptr && !inner.IsNil() {
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct && inner.Type() != timeType {
+				embedded = append(embedded, inner)
+			}
+
+			// An unexported embedded structure has its
+			// fields promoted, but isn't visible itself.
+			if typeField.PkgPath != "" {
+				continue
+			}
+		}
+
+		found[name] = true
+		callback(name, field)
+	}
+
+	// Now promote the fields of embedded structures, unless they
+	// were shadowed by the outer one.
+	for _, inner := range embedded {
+		c.walkStruct(inner, func(name string, field reflect.Value) {
+			if !found[name] {
+				found[name] = true
+				callback(name, field)
+			}
+		})
+	}
+}
+
+// Field returns the field of the given structure which is known by the
+// given name, including those promoted from embedded structures.
+func (c *Converter) Field(val reflect.Value, name string) (reflect.Value, bool) {
+	var out reflect.Value
+	c.walkStruct(val, func(n string, field reflect.Value) {
+		if n == name && !out.IsValid() {
+			out = field
+		}
+	})
+	return out, out.IsValid()
+}
+
+// cycle returns the result of converting a map or slice which contains
+// itself, which is null if we're lenient.
+func (c *Converter) cycle(val reflect.Value) (Object, error) {
+	if c.Lenient {
+		return &Null{}, nil
+	}
+	return nil, fmt.Errorf("%s contains itself", val.Type())
+}
+
+// fromValue converts a value to an object.
+//
+// This may well recurse, the `seen` map is used to record the pointers
+// we're in the process of following so that cycles become null.  Maps and
+// slices which contain themselves are recorded too, and are an error
+// unless we're lenient.
+func (c *Converter) fromValue(val reflect.Value, seen map[uintptr]bool) (Object, error) {
+
+	// Invalid value?  Return null
+	if !val.IsValid() {
+		return &Null{}, nil
+	}
+
+	// Objects are used as-is.
+	if val.Type().Implements(objectType) && val.CanInterface() {
+		if (val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) && val.IsNil() {
+			return &Null{}, nil
+		}
+		return val.Interface().(Object), nil
+	}
+
+	switch val.Kind() {
+
+	case reflect.Interface:
+		if val.IsNil() {
+			return &Null{}, nil
+		}
+		return c.fromValue(val.Elem(), seen)
+
+	case reflect.Ptr:
+		if val.IsNil() {
+			return &Null{}, nil
+		}
+		ptr := val.Pointer()
+		if seen[ptr] {
+			return &Null{}, nil
+		}
+		seen[ptr] = true
+		defer delete(seen, ptr)
+		return c.fromValue(val.Elem(), seen)
+
+	case reflect.Struct:
+
+		// Time gets special handling
+		if val.Type() == timeType {
+			if !val.CanInterface() {
+				return &Null{}, nil
+			}
+			return &Time{Value: val.Interface().(time.Time)}, nil
+		}
+
+		hash := &Hash{Pairs: make(map[HashKey]HashPair)}
+
+		var err error
+		c.walkStruct(val, func(name string, field reflect.Value) {
+			if err != nil {
+				return
+			}
+			k := &String{Value: name}
+			v, e := c.fromValue(field, seen)
+			if e != nil {
+				err = fmt.Errorf("field %s: %s", name, e)
+				return
+			}
+			hash.Pairs[k.HashKey()] = HashPair{Key: k, Value: v}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return hash, nil
+
+	case reflect.Map:
+		if val.Len() > 0 {
+			ptr := val.Pointer()
+			if seen[ptr] {
+				return c.cycle(val)
+			}
+			seen[ptr] = true
+			defer delete(seen, ptr)
+		}
+
+		hash := &Hash{Pairs: make(map[HashKey]HashPair)}
+		for _, key := range val.MapKeys() {
+
+			k, err := c.fromValue(key, seen)
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := k.(Hashable)
+			if !ok {
+				if c.Lenient {
+					continue
+				}
+				return nil, fmt.Errorf("cannot use %s as a hash key", k.Type())
+			}
+
+			v, err := c.fromValue(val.MapIndex(key), seen)
+			if err != nil {
+				return nil, fmt.Errorf("value of %s: %s", k.Inspect(), err)
+			}
+
+			hash.Pairs[hashable.HashKey()] = HashPair{Key: k, Value: v}
+		}
+		return hash, nil
+
+	case reflect.Slice, reflect.Array:
+		if val.Kind() == reflect.Slice && val.Len() > 0 {
+			ptr := val.Pointer()
+			if seen[ptr] {
+				return c.cycle(val)
+			}
+			seen[ptr] = true
+			defer delete(seen, ptr)
+		}
+
+		array := &Array{Elements: make([]Object, val.Len())}
+		for i := range array.Elements {
+			el, err := c.fromValue(val.Index(i), seen)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %s", i, err)
+			}
+			array.Elements[i] = el
+		}
+		return array, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if val.Type() == durationType {
+			return &Duration{Value: time.Duration(val.Int())}, nil
+		}
+		return &Integer{Value: val.Int()}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if val.Uint() > math.MaxInt64 && !c.Lenient {
+			return nil, fmt.Errorf("%d overflows an integer", val.Uint())
+		}
+		return &Integer{Value: int64(val.Uint())}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &Float{Value: val.Float()}, nil
+
+	case reflect.String:
+		return &String{Value: val.String()}, nil
+
+	case reflect.Bool:
+		return &Boolean{Value: val.Bool()}, nil
+	}
+
+	if c.Lenient {
+		return &Null{}, nil
+	}
+	return nil, fmt.Errorf("cannot convert %s to an object", val.Type())
+}
+
+// decode stores an object in the given value.
+func (c *Converter) decode(obj Object, val reflect.Value) error {
+
+	t := val.Type()
+	mismatch := fmt.Errorf("expected %s, got %s", t, obj.Type())
+
+	// Objects are stored as-is, if they're the right kind.
+	if t.Implements(objectType) {
+		if !reflect.TypeOf(obj).AssignableTo(t) {
+			return mismatch
+		}
+		val.Set(reflect.ValueOf(obj))
+		return nil
+	}
+
+	// Null becomes the zero-value of pointers, maps, slices and
+	// interfaces.
+	if obj.Type() == NULL {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+			val.Set(reflect.Zero(t))
+			return nil
+		}
+		return mismatch
+	}
+
+	// Integers are accepted as epoch seconds, or a number of
+	// seconds, as they are by our built-in functions.
+	switch t {
+	case timeType:
+		switch o := obj.(type) {
+		case *Time:
+			val.Set(reflect.ValueOf(o.Value))
+		case *Integer:
+			val.Set(reflect.ValueOf(time.Unix(o.Value, 0)))
+		default:
+			return mismatch
+		}
+		return nil
+	case durationType:
+		switch o := obj.(type) {
+		case *Duration:
+			val.SetInt(int64(o.Value))
+		case *Integer:
+			val.SetInt(int64(time.Duration(o.Value) * time.Second))
+		default:
+			return mismatch
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+
+	case reflect.Ptr:
+		ptr := reflect.New(t.Elem())
+		err := c.decode(obj, ptr.Elem())
+		if err != nil {
+			return err
+		}
+		val.Set(ptr)
+
+	case reflect.Interface:
+		if t.NumMethod() != 0 {
+			return mismatch
+		}
+		native, err := c.native(obj)
+		if err != nil {
+			return err
+		}
+		if native != nil {
+			val.Set(reflect.ValueOf(native))
+		}
+
+	case reflect.Bool:
+		b, ok := obj.(*Boolean)
+		if !ok {
+			return mismatch
+		}
+		val.SetBool(b.Value)
+
+	case reflect.String:
+		s, ok := obj.(*String)
+		if !ok {
+			return mismatch
+		}
+		val.SetString(s.Value)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return mismatch
+		}
+		if val.OverflowInt(i.Value) {
+			return fmt.Errorf("%d overflows %s", i.Value, t)
+		}
+		val.SetInt(i.Value)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return mismatch
+		}
+		if i.Value < 0 || val.OverflowUint(uint64(i.Value)) {
+			return fmt.Errorf("%d overflows %s", i.Value, t)
+		}
+		val.SetUint(uint64(i.Value))
+
+	case reflect.Float32, reflect.Float64:
+		switch o := obj.(type) {
+		case *Float:
+			val.SetFloat(o.Value)
+		case *Integer:
+			val.SetFloat(float64(o.Value))
+		default:
+			return mismatch
+		}
+		if t.Kind() == reflect.Float32 && !math.IsInf(val.Float(), 0) && val.OverflowFloat(val.Float()) {
+			return fmt.Errorf("%s overflows %s", obj.Inspect(), t)
+		}
+
+	case reflect.Slice, reflect.Array:
+		a, ok := obj.(*Array)
+		if !ok {
+			return mismatch
+		}
+		if t.Kind() == reflect.Slice {
+			val.Set(reflect.MakeSlice(t, len(a.Elements), len(a.Elements)))
+		} else if len(a.Elements) > val.Len() {
+			return fmt.Errorf("%d elements overflow %s", len(a.Elements), t)
+		}
+		for i, el := range a.Elements {
+			err := c.decode(el, val.Index(i))
+			if err != nil {
+				return fmt.Errorf("element %d: %s", i, err)
+			}
+		}
+
+	case reflect.Map:
+		h, ok := obj.(*Hash)
+		if !ok {
+			return mismatch
+		}
+		val.Set(reflect.MakeMapWithSize(t, len(h.Pairs)))
+		for _, pair := range h.Entries() {
+			k := reflect.New(t.Key()).Elem()
+			err := c.decode(pair.Key, k)
+			if err != nil {
+				return fmt.Errorf("key %s: %s", pair.Key.Inspect(), err)
+			}
+			v := reflect.New(t.Elem()).Elem()
+			err = c.decode(pair.Value, v)
+			if err != nil {
+				return fmt.Errorf("value of %s: %s", pair.Key.Inspect(), err)
+			}
+			val.SetMapIndex(k, v)
+		}
+
+	case reflect.Struct:
+		h, ok := obj.(*Hash)
+		if !ok {
+			return mismatch
+		}
+		return c.decodeStruct(h, val)
+
+	default:
+		return fmt.Errorf("cannot decode into %s", t)
+	}
+
+	return nil
+}
+
+// decodeStruct stores the contents of a hash in the fields of a structure.
+func (c *Converter) decodeStruct(h *Hash, val reflect.Value) error {
+
+	// Allocate any embedded pointers, so that their fields may
+	// be set.
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Field(i)
+		typeField := val.Type().Field(i)
+		if typeField.Anonymous && field.Kind() == reflect.Ptr && field.IsNil() && field.CanSet() &&
+			field.Type().Elem().Kind() == reflect.Struct {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+	}
+
+	var err error
+	c.walkStruct(val, func(name string, field reflect.Value) {
+		if err != nil || !field.CanSet() {
+			return
+		}
+
+		key := &String{Value: name}
+		pair, ok := h.Pairs[key.HashKey()]
+		if !ok {
+			return
+		}
+
+		e := c.decode(pair.Value, field)
+		if e != nil {
+			err = fmt.Errorf("field %s: %s", name, e)
+		}
+	})
+	return err
+}
+
+// native converts an object to the golang value which is most natural for
+// it, for storing in an interface.
+func (c *Converter) native(obj Object) (interface{}, error) {
+	switch o := obj.(type) {
+	case *Null:
+		return nil, nil
+	case *Boolean:
+		return o.Value, nil
+	case *Integer:
+		return o.Value, nil
+	case *Float:
+		return o.Value, nil
+	case *String:
+		return o.Value, nil
+	case *Time:
+		return o.Value, nil
+	case *Duration:
+		return o.Value, nil
+	case *Array:
+		out := make([]interface{}, len(o.Elements))
+		for i, el := range o.Elements {
+			v, err := c.native(el)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %s", i, err)
+			}
+			out[i] = v
+		}
+		return out, nil
+	case *Hash:
+		out := make(map[string]interface{}, len(o.Pairs))
+		for _, pair := range o.Pairs {
+			v, err := c.native(pair.Value)
+			if err != nil {
+				return nil, fmt.Errorf("value of %s: %s", pair.Key.Inspect(), err)
+			}
+			out[pair.Key.Inspect()] = v
+		}
+		return out, nil
+	}
+	return obj, nil
+}
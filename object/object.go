@@ -5,12 +5,15 @@
 //
 // * Arrays.
 // * Boolean values.
+// * Durations.
 // * Floating-point numbers.
+// * Functions.
 // * Hashes.
 // * Integer numbers.
 // * Null
 // * String values.
 // * Regular-expression objects.
+// * Times.
 //
 // To allow these objects to be used interchanagably each kind of object
 // must implement the same simple interface.
@@ -25,15 +28,18 @@ type Type string
 
 // pre-defined object types.
 const (
-	ARRAY   = "ARRAY"
-	BOOLEAN = "BOOLEAN"
-	FLOAT   = "FLOAT"
-	HASH    = "HASH"
-	INTEGER = "INTEGER"
-	NULL    = "NULL"
-	REGEXP  = "REGEXP"
-	STRING  = "STRING"
-	VOID    = "VOID"
+	ARRAY    = "ARRAY"
+	BOOLEAN  = "BOOLEAN"
+	DURATION = "DURATION"
+	FLOAT    = "FLOAT"
+	FUNCTION = "FUNCTION"
+	HASH     = "HASH"
+	INTEGER  = "INTEGER"
+	NULL     = "NULL"
+	REGEXP   = "REGEXP"
+	STRING   = "STRING"
+	TIME     = "TIME"
+	VOID     = "VOID"
 )
 
 // Object is the interface that all of our various object-types must implement.
@@ -93,12 +99,47 @@ type JSONAble interface {
 	JSON() (string, error)
 }
 
-// Iterable is an interface that some objects might wish to support.
+// Iterator holds the state of a single iteration over an object.
+type Iterator interface {
+
+	// Get the next "thing" from the object being iterated
+	// over.
+	//
+	// The return values are the item which is to be returned
+	// next, the index of that object, and finally a boolean
+	// to say whether the function succeeded.
+	//
+	// If the boolean value returned is false then that
+	// means the iteration has completed and no further
+	// items are available.
+	Next() (Object, Object, bool)
+}
+
+// IteratorProvider is an interface that some objects might wish to
+// support.
 //
 // If this interface is implemented then it will be possible to
 // use the `foreach` function to iterate over the object.  If
 // the interface is not implemented then a run-time error will
 // be generated instead.
+//
+// Each iteration uses a new Iterator, so loops over the same object
+// are independent, and the object itself is never modified.
+type IteratorProvider interface {
+
+	// Iterator returns a new iterator, positioned before the
+	// first item of the object.
+	Iterator() Iterator
+}
+
+// Iterable is an interface that some objects might wish to support.
+//
+// If this interface is implemented then it will be possible to
+// use the `foreach` function to iterate over the object.
+//
+// Deprecated: Iterable stores the state of the iteration within the
+// object itself, so nested loops over the same object don't work.
+// Implement IteratorProvider instead.
 type Iterable interface {
 
 	// Reset the state of any previous iteration.
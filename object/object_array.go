@@ -10,9 +10,6 @@ import (
 type Array struct {
 	// Elements holds the individual members of the array we're wrapping.
 	Elements []Object
-
-	// offset holds our iteration-offset.
-	offset int
 }
 
 // Type returns the type of this object.
@@ -55,20 +52,28 @@ func (ao *Array) ToInterface() interface{} {
 	return res
 }
 
-// Reset implements the Iterable interface, and allows the contents
-// of the array to be reset to allow re-iteration.
-func (ao *Array) Reset() {
-	ao.offset = 0
+// Iterator implements the IteratorProvider interface, and allows the
+// contents of our array to be iterated over.
+func (ao *Array) Iterator() Iterator {
+	return &arrayIterator{elements: ao.Elements}
+}
+
+// arrayIterator holds the state of an iteration over an array.
+type arrayIterator struct {
+	// elements holds the members of the array.
+	elements []Object
+
+	// offset holds our iteration-offset.
+	offset int
 }
 
-// Next implements the Iterable interface, and allows the contents
-// of our array to be iterated over.
-func (ao *Array) Next() (Object, Object, bool) {
-	if ao.offset < len(ao.Elements) {
-		ao.offset++
+// Next implements the Iterator interface.
+func (it *arrayIterator) Next() (Object, Object, bool) {
+	if it.offset < len(it.elements) {
+		it.offset++
 
-		element := ao.Elements[ao.offset-1]
-		return element, &Integer{Value: int64(ao.offset - 1)}, true
+		element := it.elements[it.offset-1]
+		return element, &Integer{Value: int64(it.offset - 1)}, true
 	}
 
 	return nil, &Integer{Value: 0}, false
@@ -101,5 +106,5 @@ func (ao *Array) JSON() (string, error) {
 }
 
 // Ensure this object implements the expected interfaces
-var _ Iterable = &Array{}
+var _ IteratorProvider = &Array{}
 var _ JSONAble = &String{}
@@ -0,0 +1,51 @@
+package object
+
+import (
+	"strconv"
+	"time"
+)
+
+// Duration wraps time.Duration and implements the Object interface.
+type Duration struct {
+	// Value holds the duration this object wraps.
+	Value time.Duration
+}
+
+// Inspect returns a string-representation of the given object.
+func (d *Duration) Inspect() string {
+	return d.Value.String()
+}
+
+// Type returns the type of this object.
+func (d *Duration) Type() Type {
+	return DURATION
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (d *Duration) True() bool {
+	return d.Value > 0
+}
+
+// ToInterface converts this object to a go-interface, which will allow
+// it to be used naturally in our sprintf/printf primitives.
+//
+// It might also be helpful for embedded users.
+func (d *Duration) ToInterface() interface{} {
+	return d.Value
+}
+
+// HashKey returns a hash key for the given object.
+func (d *Duration) HashKey() HashKey {
+	return HashKey{Type: d.Type(), Value: uint64(d.Value)}
+}
+
+// JSON converts this object to a JSON string.
+func (d *Duration) JSON() (string, error) {
+	return strconv.Quote(d.Inspect()), nil
+}
+
+// Ensure this object implements the expected interfaces.
+var _ Hashable = &Duration{}
+var _ JSONAble = &Duration{}
@@ -0,0 +1,57 @@
+package object
+
+import (
+	"strings"
+
+	"github.com/skx/evalfilter/v2/code"
+)
+
+// Function wraps a function which was defined within our scripting
+// language, and implements the Object interface.
+//
+// This allows functions to be stored in variables, arrays, and hashes,
+// and passed to other functions.
+type Function struct {
+	// Arguments holds the names of the function's parameters.
+	Arguments []string
+
+	// Bytecode holds the compiled body of the function.
+	Bytecode code.Instructions
+
+	// Positions maps the bytecode to the source which generated it.
+	Positions code.Positions
+
+	// Locals is the number of slots the function needs to hold its
+	// arguments, and other local variables.
+	Locals int
+
+	// Outer holds the local variables of the functions which enclosed
+	// this one when it was created, innermost last.  The function may
+	// read and update them.
+	Outer [][]Object
+}
+
+// Type returns the type of this object.
+func (f *Function) Type() Type {
+	return FUNCTION
+}
+
+// Inspect returns a string-representation of the given object.
+func (f *Function) Inspect() string {
+	return "function(" + strings.Join(f.Arguments, ", ") + ")"
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (f *Function) True() bool {
+	return true
+}
+
+// ToInterface converts this object to a go-interface, which will allow
+// it to be used naturally in our sprintf/printf primitives.
+//
+// It might also be helpful for embedded users.
+func (f *Function) ToInterface() interface{} {
+	return f.Inspect()
+}
@@ -36,9 +36,6 @@ func (a ByName) Less(i, j int) bool { return a[i].Key.Inspect() < a[j].Key.Inspe
 type Hash struct {
 	// Pairs holds the key/value pairs of the hash we wrap
 	Pairs map[HashKey]HashPair
-
-	// offset holds our iteration-offset.
-	offset int
 }
 
 // Type returns the type of this object.
@@ -92,30 +89,28 @@ func (h *Hash) True() bool {
 	return (len(h.Pairs) != 0)
 }
 
-// Reset implements the Iterable interface, and allows the contents
-// of the array to be reset to allow re-iteration.
-func (h *Hash) Reset() {
-	h.offset = 0
+// Iterator implements the IteratorProvider interface, and allows the
+// contents of our hash to be iterated over, sorted by key-name.
+func (h *Hash) Iterator() Iterator {
+	return &hashIterator{entries: h.Entries()}
 }
 
-// Next implements the Iterable interface, and allows the contents
-// of our array to be iterated over.
-func (h *Hash) Next() (Object, Object, bool) {
+// hashIterator holds the state of an iteration over a hash.
+type hashIterator struct {
+	// entries holds the sorted entries of the hash.
+	entries []HashPair
 
-	// Get the list of entries, sorted by key-name.
-	entries := h.Entries()
+	// offset holds our iteration-offset.
+	offset int
+}
 
-	// Now pick the next entry
-	if h.offset < len(entries) {
-		idx := 0
+// Next implements the Iterator interface.
+func (it *hashIterator) Next() (Object, Object, bool) {
+	if it.offset < len(it.entries) {
+		it.offset++
 
-		for _, pair := range entries {
-			if h.offset == idx {
-				h.offset++
-				return pair.Value, pair.Key, true
-			}
-			idx++
-		}
+		pair := it.entries[it.offset-1]
+		return pair.Value, pair.Key, true
 	}
 
 	return nil, &Integer{Value: 0}, false
@@ -165,5 +160,5 @@ func (h *Hash) JSON() (string, error) {
 }
 
 // Ensure this object implements the expected interfaces.
-var _ Iterable = &Hash{}
+var _ IteratorProvider = &Hash{}
 var _ JSONAble = &Hash{}
@@ -1,11 +1,83 @@
 package object
 
+import (
+	"regexp"
+	"strings"
+)
+
 // Regexp wraps string and implements the Object interface.
 type Regexp struct {
 	// Value holds the string value this object wraps.
 	//
 	// (Yes we're a regexp, but we pretend we're string!)
 	Value string
+
+	// compiled holds the compiled form of the regular expression,
+	// if it was created via NewRegexp.
+	compiled *regexp.Regexp
+
+	// whole is true if the expression has the "w" flag.
+	whole bool
+}
+
+// NewRegexp creates a new regular expression object, compiling the
+// given pattern so that it may be used without compiling it again.
+//
+// As well as the flags Go supports the pattern may start with the "w"
+// flag, such as "(?iw)", to match against the whole of the input rather
+// than each line of it.
+func NewRegexp(pattern string) (*Regexp, error) {
+	expr, whole := wholeInput(pattern)
+	r, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Regexp{Value: pattern, compiled: r, whole: whole}, nil
+}
+
+// Compiled returns the compiled form of the regular expression, or nil
+// if the object wasn't created via NewRegexp.
+func (r *Regexp) Compiled() *regexp.Regexp {
+	return r.compiled
+}
+
+// Whole returns true if the regular expression should be matched against
+// the whole of the input, rather than each line of it.
+func (r *Regexp) Whole() bool {
+	return r.whole
+}
+
+// wholeInput removes the "w" flag from the flags at the start of the
+// given pattern, returning the pattern which Go should compile, and
+// whether the flag was present.
+func wholeInput(pattern string) (string, bool) {
+
+	end := strings.Index(pattern, ")")
+	if !strings.HasPrefix(pattern, "(?") || end < 0 {
+		return pattern, false
+	}
+
+	// Only flags which are being set count, and the group must
+	// not be something else, such as "(?i:..)" or "(?P<name>..)".
+	flags := pattern[2:end]
+	set := flags
+	if i := strings.Index(flags, "-"); i >= 0 {
+		set = flags[:i]
+	}
+	for _, c := range flags {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != '-' {
+			return pattern, false
+		}
+	}
+	if !strings.Contains(set, "w") {
+		return pattern, false
+	}
+
+	flags = strings.Replace(flags, "w", "", -1)
+	if flags == "" {
+		return pattern[end+1:], true
+	}
+	return "(?" + flags + ")" + pattern[end+1:], true
 }
 
 // Type returns the type of this object.
@@ -3,16 +3,12 @@ package object
 import (
 	"hash/fnv"
 	"strconv"
-	"unicode/utf8"
 )
 
 // String wraps string and implements the Object interface.
 type String struct {
 	// Value holds the string value this object wraps.
 	Value string
-
-	// Offset holds our iteration-offset
-	offset int
 }
 
 // Type returns the type of this object.
@@ -40,26 +36,28 @@ func (s *String) ToInterface() interface{} {
 	return s.Value
 }
 
-// Reset implements the Iterable interface, and allows the contents
-// of the string to be reset to allow re-iteration.
-func (s *String) Reset() {
-	s.offset = 0
+// Iterator implements the IteratorProvider interface, and allows the
+// characters of our string to be iterated over.
+func (s *String) Iterator() Iterator {
+	return &stringIterator{chars: []rune(s.Value)}
 }
 
-// Next implements the Iterable interface, and allows the contents
-// of our string to be iterated over.
-func (s *String) Next() (Object, Object, bool) {
-
-	if s.offset < utf8.RuneCountInString(s.Value) {
-		s.offset++
+// stringIterator holds the state of an iteration over a string.
+type stringIterator struct {
+	// chars holds the characters of the string.
+	chars []rune
 
-		// Get the characters as an array of runes
-		chars := []rune(s.Value)
+	// offset holds our iteration-offset.
+	offset int
+}
 
-		// Now index
-		val := String{Value: string(chars[s.offset-1])}
+// Next implements the Iterator interface.
+func (it *stringIterator) Next() (Object, Object, bool) {
+	if it.offset < len(it.chars) {
+		it.offset++
 
-		return &val, &Integer{Value: int64(s.offset - 1)}, true
+		val := &String{Value: string(it.chars[it.offset-1])}
+		return val, &Integer{Value: int64(it.offset - 1)}, true
 	}
 
 	return nil, &Integer{Value: 0}, false
@@ -79,5 +77,5 @@ func (s *String) JSON() (string, error) {
 
 // Ensure this object implements the expected interfaces
 var _ Hashable = &String{}
-var _ Iterable = &String{}
+var _ IteratorProvider = &String{}
 var _ JSONAble = &String{}
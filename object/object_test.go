@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 // TestArray tests our Array object a little
@@ -90,8 +91,8 @@ func TestArrayIteration(t *testing.T) {
 	//
 	for range []int{0, 1, 2} {
 
-		// Reset the iteration and count of loops.
-		arr.Reset()
+		// Start the iteration and count of loops.
+		it := arr.Iterator()
 		count := 0
 
 		// For each of the known array-values we expect
@@ -99,7 +100,7 @@ func TestArrayIteration(t *testing.T) {
 
 			// Get the next-value from the array, via the
 			// iterator.
-			obj, offset, more := arr.Next()
+			obj, offset, more := it.Next()
 
 			// Ensure the offset matches what we expect
 			if int(offset.(*Integer).Value) != count {
@@ -119,7 +120,7 @@ func TestArrayIteration(t *testing.T) {
 		}
 
 		// Now we've exhausted our iteration
-		obj, offset, more := arr.Next()
+		obj, offset, more := it.Next()
 		if more {
 			t.Fatalf("We didn't expect more text, but found it")
 		}
@@ -233,6 +234,31 @@ func TestFloat(t *testing.T) {
 }
 
 // TestHash tests our hash object in a basic way
+func TestFunction(t *testing.T) {
+
+	f := &Function{Arguments: []string{"a", "b"}}
+
+	// Inspect
+	if f.Inspect() != "function(a, b)" {
+		t.Fatalf("Invalid value: %s", f.Inspect())
+	}
+
+	// Type
+	if f.Type() != FUNCTION {
+		t.Fatalf("Wrong type")
+	}
+
+	// True
+	if !f.True() {
+		t.Fatalf("Function object should always be True")
+	}
+
+	x := f.ToInterface()
+	if x.(string) != "function(a, b)" {
+		t.Fatalf("interface usage failed")
+	}
+}
+
 func TestHash(t *testing.T) {
 	tmp := &Hash{}
 
@@ -268,12 +294,12 @@ func TestHash(t *testing.T) {
 		t.Fatalf("Got %s for hash", tmp.Inspect())
 	}
 
-	// Reset the iteration
-	tmp.Reset()
+	// Start the iteration
+	it := tmp.Iterator()
 
 	// Get the next-value from the array, via the
 	// iterator.
-	v1, k1, more1 := tmp.Next()
+	v1, k1, more1 := it.Next()
 
 	if !more1 {
 		t.Fatalf("we expect more iterations")
@@ -288,7 +314,7 @@ func TestHash(t *testing.T) {
 
 	// Get the next-value from the array, via the
 	// iterator.
-	v2, k2, more2 := tmp.Next()
+	v2, k2, more2 := it.Next()
 	if !more2 {
 		t.Fatalf("we expect more iterations")
 	}
@@ -299,7 +325,7 @@ func TestHash(t *testing.T) {
 		t.Fatalf("wrong key")
 	}
 
-	_, _, more3 := tmp.Next()
+	_, _, more3 := it.Next()
 	if more3 {
 		t.Fatalf("iteration should be over now")
 	}
@@ -365,6 +391,41 @@ func TestInt(t *testing.T) {
 	}
 }
 
+// TestDuration tests our Duration-object in a basic way.
+func TestDuration(t *testing.T) {
+
+	tmp := &Duration{Value: 90 * time.Minute}
+	nul := &Duration{Value: 0}
+
+	if tmp.Inspect() != "1h30m0s" {
+		t.Fatalf("Invalid value: %s", tmp.Inspect())
+	}
+	if tmp.Type() != DURATION {
+		t.Fatalf("Wrong type")
+	}
+	if !tmp.True() {
+		t.Fatalf("Non-zero duration should be true")
+	}
+	if nul.True() {
+		t.Fatalf("zero-value should be false")
+	}
+	if tmp.ToInterface().(time.Duration) != 90*time.Minute {
+		t.Fatalf("interface usage failed")
+	}
+
+	if tmp.HashKey() != (&Duration{Value: 90 * time.Minute}).HashKey() {
+		t.Fatalf("two identical values should have the same hash")
+	}
+	if tmp.HashKey() == (&Integer{Value: int64(90 * time.Minute)}).HashKey() {
+		t.Fatalf("a duration and an integer should have different hashes")
+	}
+
+	out, err := tmp.JSON()
+	if err != nil || out != `"1h30m0s"` {
+		t.Fatalf("unexpected JSON: %s %v", out, err)
+	}
+}
+
 // TestNull tests our Null-object in a basic way.
 func TestNull(t *testing.T) {
 
@@ -422,6 +483,40 @@ func TestRegexp(t *testing.T) {
 
 }
 
+// TestRegexpWhole tests which patterns match against the whole input.
+func TestRegexpWhole(t *testing.T) {
+
+	tests := []struct {
+		Pattern string
+		Go      string
+		Whole   bool
+	}{
+		{Pattern: "steve", Go: "steve"},
+		{Pattern: "(?w)steve", Go: "steve", Whole: true},
+		{Pattern: "(?iw)steve", Go: "(?i)steve", Whole: true},
+		{Pattern: "(?w-s)steve", Go: "(?-s)steve", Whole: true},
+		{Pattern: "(?s)steve", Go: "(?s)steve"},
+		{Pattern: "(?P<w>steve)", Go: "(?P<w>steve)"},
+		{Pattern: "steve(?w)", Go: "steve(?w)"},
+		{Pattern: "(?", Go: "(?"},
+	}
+
+	for _, test := range tests {
+		expr, whole := wholeInput(test.Pattern)
+		if expr != test.Go || whole != test.Whole {
+			t.Errorf("wrong result for %s: got %s %t", test.Pattern, expr, whole)
+		}
+	}
+
+	reg, err := NewRegexp("(?iw)^steve$")
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	if !reg.Whole() || reg.Inspect() != "(?iw)^steve$" || !reg.Compiled().MatchString("STEVE") {
+		t.Errorf("unexpected regexp %s", reg.Inspect())
+	}
+}
+
 // TestString tests our String-object in a basic way.
 func TestString(t *testing.T) {
 
@@ -466,8 +561,8 @@ func TestStringIteration(t *testing.T) {
 	//
 	for range []int{0, 1, 2} {
 
-		// Reset the iteration and count of loops.
-		tmp.Reset()
+		// Start the iteration and count of loops.
+		it := tmp.Iterator()
 		count := 0
 
 		// For each of the known string-characters we expect
@@ -475,7 +570,7 @@ func TestStringIteration(t *testing.T) {
 
 			// Get the next-value from the array, via the
 			// iterator.
-			obj, offset, more := tmp.Next()
+			obj, offset, more := it.Next()
 
 			// Ensure the offset matches what we expect
 			if int(offset.(*Integer).Value) != count {
@@ -493,7 +588,7 @@ func TestStringIteration(t *testing.T) {
 		}
 
 		// Now we've exhausted our iteration
-		obj, offset, more := tmp.Next()
+		obj, offset, more := it.Next()
 		if more {
 			t.Fatalf("We didn't expect more text, but found it")
 		}
@@ -525,6 +620,45 @@ func TestStringHash(t *testing.T) {
 	}
 }
 
+// TestTime tests our Time-object in a basic way.
+func TestTime(t *testing.T) {
+
+	loc := time.FixedZone("CET", 3600)
+	when := time.Date(2024, 3, 10, 14, 15, 16, 500000000, loc)
+
+	tmp := &Time{Value: when}
+	nul := &Time{}
+
+	if tmp.Inspect() != "2024-03-10T14:15:16.5+01:00" {
+		t.Fatalf("Invalid value: %s", tmp.Inspect())
+	}
+	if tmp.Type() != TIME {
+		t.Fatalf("Wrong type")
+	}
+	if !tmp.True() {
+		t.Fatalf("Non-zero time should be true")
+	}
+	if nul.True() {
+		t.Fatalf("zero-value should be false")
+	}
+	if !tmp.ToInterface().(time.Time).Equal(when) {
+		t.Fatalf("interface usage failed")
+	}
+
+	// The same instant hashes the same, regardless of location.
+	if tmp.HashKey() != (&Time{Value: when.UTC()}).HashKey() {
+		t.Fatalf("two identical instants should have the same hash")
+	}
+	if tmp.HashKey() == (&Time{Value: when.Add(time.Second)}).HashKey() {
+		t.Fatalf("two different values should have different hashes")
+	}
+
+	out, err := tmp.JSON()
+	if err != nil || out != `"2024-03-10T14:15:16.5+01:00"` {
+		t.Fatalf("unexpected JSON: %s %v", out, err)
+	}
+}
+
 // TestVoid tests our Void-object in a basic way.
 func TestVoid(t *testing.T) {
 
@@ -736,3 +870,224 @@ func TestArrayJSON(t *testing.T) {
 	}
 
 }
+
+// TestIterators ensures that iterations over the same object are
+// independent of each other.
+func TestIterators(t *testing.T) {
+
+	arr := &Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}}}
+
+	outer := arr.Iterator()
+	count := 0
+	for {
+		_, _, more := outer.Next()
+		if !more {
+			break
+		}
+
+		inner := arr.Iterator()
+		for {
+			_, _, more := inner.Next()
+			if !more {
+				break
+			}
+			count++
+		}
+	}
+
+	if count != 4 {
+		t.Fatalf("expected four iterations, got %d", count)
+	}
+}
+
+// TestFromGo tests converting golang values to objects.
+func TestFromGo(t *testing.T) {
+
+	type Base struct {
+		ID     int
+		hidden string
+	}
+	type Node struct {
+		Base
+		Name    string
+		Secret  string `evalfilter:"-"`
+		Weight  float32
+		Tags    []string
+		Meta    map[string]interface{}
+		Created time.Time
+		TTL     time.Duration
+		Next    *Node
+		Value   Object
+	}
+
+	node := &Node{
+		Base:    Base{ID: 3, hidden: "x"},
+		Name:    "steve",
+		Secret:  "password",
+		Weight:  1.5,
+		Tags:    []string{"a", "b"},
+		Meta:    map[string]interface{}{"score": uint8(7), "ok": true, "nil": nil},
+		Created: time.Unix(0, 0).UTC(),
+		TTL:     time.Minute,
+		Value:   &String{Value: "object"},
+	}
+	node.Next = node
+
+	// Maps and slices which contain themselves.
+	loop := map[string]interface{}{"name": "steve"}
+	loop["self"] = loop
+	list := []interface{}{1, nil}
+	list[1] = list
+
+	tests := []struct {
+		Input  interface{}
+		Result string
+	}{
+		{Input: nil, Result: "null"},
+		{Input: int8(-3), Result: "-3"},
+		{Input: uint16(3), Result: "3"},
+		{Input: "steve", Result: "\"steve\""},
+		{Input: []interface{}{1, "two", nil}, Result: "[1, \"two\", null]"},
+		{Input: [2]bool{true, false}, Result: "[true, false]"},
+		{Input: map[int]string{1: "one"}, Result: "{\"1\": \"one\"}"},
+		{Input: node, Result: `{"Base": {"ID": 3}, "Created": "1970-01-01T00:00:00Z", "ID": 3, "Meta": {"nil": null, "ok": true, "score": 7}, "Name": "steve", "Next": null, "TTL": "1m0s", "Tags": ["a", "b"], "Value": "object", "Weight": 1.500000}`},
+	}
+
+	for _, test := range tests {
+		obj, err := FromGo(test.Input)
+		if err != nil {
+			t.Fatalf("failed to convert %v: %s", test.Input, err)
+		}
+		out, err := obj.(JSONAble).JSON()
+		if err != nil {
+			t.Fatalf("failed to get JSON for %v: %s", test.Input, err)
+		}
+		if out != test.Result {
+			t.Errorf("wrong result for %v: got %s, expected %s", test.Input, out, test.Result)
+		}
+	}
+
+	// Errors
+	errors := []struct {
+		Input interface{}
+		Error string
+	}{
+		{Input: make(chan int), Error: "cannot convert chan int to an object"},
+		{Input: map[string]interface{}{"f": func() {}}, Error: "value of f: cannot convert func()"},
+		{Input: uint64(1 << 63), Error: "overflows an integer"},
+		{Input: map[bool]int{true: 1}, Error: "cannot use BOOLEAN as a hash key"},
+		{Input: loop, Error: "value of self: map[string]interface {} contains itself"},
+		{Input: list, Error: "element 1: []interface {} contains itself"},
+	}
+
+	for _, test := range errors {
+		_, err := FromGo(test.Input)
+		if err == nil || !strings.Contains(err.Error(), test.Error) {
+			t.Errorf("unexpected error for %T: %v", test.Input, err)
+		}
+	}
+
+	// A lenient converter ignores them.
+	lenient := &Converter{Lenient: true}
+	obj, err := lenient.FromGo(map[string]interface{}{"f": func() {}})
+	if err != nil || obj.Inspect() != "{f: null}" {
+		t.Errorf("unexpected result from lenient conversion: %v %v", obj, err)
+	}
+
+	// Or replaces cycles with null.
+	obj, err = lenient.FromGo(loop)
+	if err != nil || obj.Inspect() != "{name: steve, self: null}" {
+		t.Errorf("unexpected result from lenient conversion: %v %v", obj, err)
+	}
+	obj, err = lenient.FromGo(map[string]interface{}{"a": list, "b": list})
+	if err != nil || obj.Inspect() != "{a: [1, null], b: [1, null]}" {
+		t.Errorf("unexpected result from lenient conversion: %v %v", obj, err)
+	}
+}
+
+// TestDecode tests decoding objects into golang values.
+func TestDecode(t *testing.T) {
+
+	type Reason struct {
+		Code int
+	}
+	type Decision struct {
+		*Reason
+		Allow   bool
+		Score   float64
+		Tags    []string
+		Labels  map[string]int8
+		Until   time.Time
+		Delay   time.Duration
+		Extra   interface{}
+		Next    *Decision
+		Ignored string `evalfilter:"-"`
+		Raw     Object
+	}
+
+	str := func(s string) *String { return &String{Value: s} }
+	hash := func(kv ...Object) *Hash {
+		h := &Hash{Pairs: make(map[HashKey]HashPair)}
+		for i := 0; i < len(kv); i += 2 {
+			h.Pairs[kv[i].(Hashable).HashKey()] = HashPair{Key: kv[i], Value: kv[i+1]}
+		}
+		return h
+	}
+
+	input := hash(
+		str("Allow"), &Boolean{Value: true},
+		str("Score"), &Integer{Value: 3},
+		str("Tags"), &Array{Elements: []Object{str("a"), str("b")}},
+		str("Labels"), hash(str("x"), &Integer{Value: -1}),
+		str("Until"), &Integer{Value: 60},
+		str("Delay"), &Duration{Value: time.Second},
+		str("Extra"), &Array{Elements: []Object{&Integer{Value: 1}, hash(str("y"), &Null{})}},
+		str("Next"), hash(str("Allow"), &Boolean{Value: false}),
+		str("Ignored"), str("no"),
+		str("Code"), &Integer{Value: 403},
+		str("Raw"), str("raw"),
+		str("Unknown"), str("skipped"),
+	)
+
+	var decision Decision
+	err := Decode(input, &decision)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+
+	out := fmt.Sprintf("%v %v %v %v %v %v %v %v %v %q %v", decision.Allow, decision.Score, decision.Tags, decision.Labels,
+		decision.Until.Unix(), decision.Delay, decision.Extra, decision.Next.Allow, decision.Code, decision.Ignored, decision.Raw.Inspect())
+	if out != `true 3 [a b] map[x:-1] 60 1s [1 map[y:<nil>]] false 403 "" raw` {
+		t.Errorf("unexpected result: %s", out)
+	}
+
+	// Null clears pointers, maps, and slices.
+	err = Decode(hash(str("Next"), &Null{}, str("Tags"), &Null{}), &decision)
+	if err != nil || decision.Next != nil || decision.Tags != nil {
+		t.Errorf("failed to decode null: %v", err)
+	}
+
+	// Errors
+	errors := []struct {
+		Input  Object
+		Target interface{}
+		Error  string
+	}{
+		{Input: str("x"), Target: decision, Error: "must be a non-nil pointer"},
+		{Input: str("x"), Target: &decision, Error: "expected object.Decision, got STRING"},
+		{Input: hash(str("Allow"), str("yes")), Target: &decision, Error: "field Allow: expected bool, got STRING"},
+		{Input: hash(str("Labels"), hash(str("x"), &Integer{Value: 300})), Target: &decision, Error: "field Labels: value of x: 300 overflows int8"},
+		{Input: &Array{Elements: []Object{&Integer{Value: -1}}}, Target: &[]uint{}, Error: "element 0: -1 overflows uint"},
+		{Input: &Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}}}, Target: &[1]int{}, Error: "2 elements overflow [1]int"},
+		{Input: &Float{Value: 1.5}, Target: new(int), Error: "expected int, got FLOAT"},
+		{Input: &Null{}, Target: new(string), Error: "expected string, got NULL"},
+		{Input: &Integer{Value: 1}, Target: new(chan int), Error: "cannot decode into chan int"},
+	}
+
+	for _, test := range errors {
+		err := Decode(test.Input, test.Target)
+		if err == nil || !strings.Contains(err.Error(), test.Error) {
+			t.Errorf("unexpected error decoding %s into %T: %v", test.Input.Inspect(), test.Target, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package object
+
+import (
+	"strconv"
+	"time"
+)
+
+// Time wraps time.Time and implements the Object interface.
+type Time struct {
+	// Value holds the time this object wraps, along with its location.
+	Value time.Time
+}
+
+// Inspect returns a string-representation of the given object.
+func (t *Time) Inspect() string {
+	return t.Value.Format(time.RFC3339Nano)
+}
+
+// Type returns the type of this object.
+func (t *Time) Type() Type {
+	return TIME
+}
+
+// True returns whether this object wraps a true-like value.
+//
+// Used when this object is the conditional in a comparison, etc.
+func (t *Time) True() bool {
+	return !t.Value.IsZero()
+}
+
+// ToInterface converts this object to a go-interface, which will allow
+// it to be used naturally in our sprintf/printf primitives.
+//
+// It might also be helpful for embedded users.
+func (t *Time) ToInterface() interface{} {
+	return t.Value
+}
+
+// HashKey returns a hash key for the given object.
+//
+// Times which represent the same instant have the same key, regardless
+// of their location.
+func (t *Time) HashKey() HashKey {
+	return HashKey{Type: t.Type(), Value: uint64(t.Value.UnixNano())}
+}
+
+// JSON converts this object to a JSON string.
+func (t *Time) JSON() (string, error) {
+	return strconv.Quote(t.Inspect()), nil
+}
+
+// Ensure this object implements the expected interfaces.
+var _ Hashable = &Time{}
+var _ JSONAble = &Time{}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/lexer"
@@ -117,6 +118,11 @@ type Parser struct {
 
 	// Are we inside a function?
 	function bool
+
+	// How many loops are we nested within?
+	//
+	// `break` and `continue` may only be used inside a loop.
+	loops int
 }
 
 // New returns a new parser.
@@ -130,6 +136,7 @@ func New(l *lexer.Lexer) *Parser {
 
 	p.prefixParseFns = make(map[token.Type]prefixParseFn)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
+	p.registerPrefix(token.DURATION, p.parseDurationLiteral)
 	p.registerPrefix(token.EOF, p.parseEOF)
 	p.registerPrefix(token.FALSE, p.parseBooleanLiteral)
 	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
@@ -265,6 +272,10 @@ func (p *Parser) ParseProgram() *ast.Program {
 // parseStatement parses a single statement.
 func (p *Parser) parseStatement() ast.Statement {
 	switch p.curToken.Type {
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
 	case token.RETURN:
 		r := p.parseReturnStatement()
 		if r == nil {
@@ -294,6 +305,36 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+// parseBreakStatement parses a break-statement.
+func (p *Parser) parseBreakStatement() ast.Statement {
+	if p.loops == 0 {
+		msg := fmt.Sprintf("'break' may only be used inside a loop, around %s", p.curToken.Position())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	stmt := &ast.BreakStatement{Token: p.curToken}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseContinueStatement parses a continue-statement.
+func (p *Parser) parseContinueStatement() ast.Statement {
+	if p.loops == 0 {
+		msg := fmt.Sprintf("'continue' may only be used inside a loop, around %s", p.curToken.Position())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
 // Function called on error if there is no prefix-based parsing method
 // for the given token.
 func (p *Parser) noPrefixParseFnError(t token.Type) {
@@ -410,6 +451,19 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+// parseDurationLiteral parses a duration-literal, such as "2h".
+func (p *Parser) parseDurationLiteral() ast.Expression {
+	dur := &ast.DurationLiteral{Token: p.curToken}
+	value, err := time.ParseDuration(p.curToken.Literal)
+	if err != nil {
+		msg := fmt.Sprintf("could not parse %q as duration around %s", p.curToken.Literal, p.curToken.Position())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+	dur.Value = value
+	return dur
+}
+
 // parseFloatLiteral parses a float-literal
 func (p *Parser) parseFloatLiteral() ast.Expression {
 	flo := &ast.FloatLiteral{Token: p.curToken}
@@ -800,7 +854,9 @@ func (p *Parser) parseForEach() ast.Expression {
 
 	// parse the block
 	p.nextToken()
+	p.loops++
 	expression.Body = p.parseBlockStatement()
+	p.loops--
 
 	return expression
 }
@@ -808,9 +864,18 @@ func (p *Parser) parseForEach() ast.Expression {
 // parseFunctionDefinition parses the definition of a function.
 func (p *Parser) parseFunctionDefinition() ast.Expression {
 
+	// An anonymous function?
+	if p.peekTokenIs(token.LPAREN) {
+		return p.parseFunctionLiteral()
+	}
+
 	// We're inside a function
 	p.function = true
 
+	// Loops outside the function can't be exited from within it.
+	loops := p.loops
+	p.loops = 0
+
 	// skip the `function` keyword
 	p.nextToken()
 
@@ -840,6 +905,44 @@ func (p *Parser) parseFunctionDefinition() ast.Expression {
 
 	// We're no longer inside a function
 	p.function = false
+	p.loops = loops
+
+	return lit
+}
+
+// parseFunctionLiteral parses an anonymous function.
+func (p *Parser) parseFunctionLiteral() ast.Expression {
+
+	lit := &ast.FunctionLiteral{Token: p.curToken}
+
+	// We're inside a function, which might itself be inside
+	// another function.
+	function := p.function
+	p.function = true
+
+	// Loops outside the function can't be exited from within it.
+	loops := p.loops
+	p.loops = 0
+
+	// Move to the "("
+	p.nextToken()
+
+	// Swallow all arguments until the closing ")"
+	lit.Parameters = p.parseFunctionParameters()
+
+	// Now we want "{"
+	if !p.expectPeek(token.LBRACE) {
+		msg := fmt.Sprintf("expected { but got %s around %s", p.curToken.Literal, p.curToken.Position())
+		p.errors = append(p.errors, msg)
+		return nil
+	}
+
+	// And consume the function-body including the
+	// closing "}".
+	lit.Body = p.parseBlockStatement()
+
+	p.function = function
+	p.loops = loops
 
 	return lit
 }
@@ -907,7 +1010,9 @@ func (p *Parser) parseWhileStatement() ast.Expression {
 		p.errors = append(p.errors, msg)
 		return nil
 	}
+	p.loops++
 	expression.Body = p.parseBlockStatement()
+	p.loops--
 	return expression
 }
 
@@ -1036,6 +1141,23 @@ func (p *Parser) parseExpressionList(end token.Type) []ast.Expression {
 
 // parseAssignExpression parses an assignment-statement.
 func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
+
+	// Assigning to an element of an array/hash?
+	if isIndexTarget(name) {
+		stmt := &ast.IndexAssignStatement{Token: p.curToken, Target: name}
+
+		// Skip over the `=`
+		p.nextToken()
+
+		stmt.Value = p.parseExpression(LOWEST)
+		if stmt.Value == nil {
+			msg := fmt.Sprintf("unexpected nil statement around %s", p.curToken.Position())
+			p.errors = append(p.errors, msg)
+			return nil
+		}
+		return stmt
+	}
+
 	stmt := &ast.AssignStatement{Token: p.curToken}
 	if n, ok := name.(*ast.Identifier); ok {
 		stmt.Name = n
@@ -1056,6 +1178,18 @@ func (p *Parser) parseAssignExpression(name ast.Expression) ast.Expression {
 	return stmt
 }
 
+// isIndexTarget returns true if the given expression refers to an element
+// of an array or hash, which may be assigned to, such as `a[1]` or `h.name`.
+func isIndexTarget(exp ast.Expression) bool {
+	switch exp := exp.(type) {
+	case *ast.IndexExpression:
+		return true
+	case *ast.InfixExpression:
+		return exp.Operator == "."
+	}
+	return false
+}
+
 // parseCallExpression parses a function-call expression.
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/skx/evalfilter/v2/ast"
 	"github.com/skx/evalfilter/v2/lexer"
@@ -51,6 +52,11 @@ func TestAssign(t *testing.T) {
 	for _, test := range []TestCase{
 		{input: "a = 3;", error: false},
 		{input: "3 = 3;", error: true},
+		{input: "a[1] = 3;", error: false},
+		{input: "a[1][\"b\"] = 3;", error: false},
+		{input: "a.b = 3;", error: false},
+		{input: "a + b = 3;", error: true},
+		{input: "f(1) = 3;", error: true},
 	} {
 
 		l := lexer.New(test.input)
@@ -98,6 +104,41 @@ func TestFloatLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestDurationLiteralExpression(t *testing.T) {
+	input := `1h30m;`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d",
+			len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T",
+			program.Statements[0])
+	}
+	dur, ok := stmt.Expression.(*ast.DurationLiteral)
+	if !ok {
+		t.Fatalf("exp is not *ast.DurationLiteral. got=%T", stmt.Expression)
+	}
+	if dur.Value != 90*time.Minute {
+		t.Errorf("duration.Value not %s. got=%s", 90*time.Minute, dur.Value)
+	}
+	if dur.String() != "1h30m" {
+		t.Errorf("duration.String not %s. got=%s", "1h30m", dur.String())
+	}
+
+	// Invalid units are an error
+	l = lexer.New(`2x;`)
+	p = New(l)
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || !strings.Contains(p.Errors()[0], `could not parse "2x" as duration`) {
+		t.Errorf("expected an error parsing an invalid duration, got %v", p.Errors())
+	}
+}
+
 func testFloatLiteral(t *testing.T, exp ast.Expression, v float64) bool {
 	float, ok := exp.(*ast.FloatLiteral)
 	if !ok {
@@ -464,6 +505,74 @@ func TestParseLocal(t *testing.T) {
 	}
 }
 
+func TestParseLoopControl(t *testing.T) {
+
+	type TestCase struct {
+		input string
+		error bool
+	}
+
+	for _, test := range []TestCase{{input: "while ( true ) { break; }", error: false},
+		{input: "foreach x in y { continue }", error: false},
+		{input: "while ( a ) { if ( b ) { break; } else { continue; } }", error: false},
+		{input: "function foo() { while ( a ) { break; } }", error: false},
+		{input: "break;", error: true},
+		{input: "if ( a ) { continue; }", error: true},
+		{input: "while ( a ) { function foo() { break; } }", error: true},
+		{input: "function foo() { break; } while ( a ) { }", error: true}} {
+
+		l := lexer.New(test.input)
+		p := New(l)
+		_, err := p.Parse()
+
+		if test.error {
+			if err == nil {
+				t.Fatalf("expected to see an error parsing %s, but didn't", test.input)
+			}
+		} else {
+
+			if err != nil {
+				t.Fatalf("shouldn't have seen an error parsing %s, but did: %s", test.input, err.Error())
+			}
+		}
+	}
+}
+
+func TestParseFunctionLiteral(t *testing.T) {
+
+	type TestCase struct {
+		input  string
+		output string
+		error  bool
+	}
+
+	for _, test := range []TestCase{{input: "f = function(a, b) { return a; };", output: "function(a, b)", error: false},
+		{input: "apply(function() { return 1; }, 2);", output: "apply(function()"},
+		{input: "h[\"f\"](3);", output: "(h[\"f\"])(3)"},
+		{input: "f = function(a { return a; };", error: true},
+		{input: "f = function(a) return a;", error: true},
+		{input: "while ( a ) { f = function() { break; }; }", error: true}} {
+
+		l := lexer.New(test.input)
+		p := New(l)
+		program, err := p.Parse()
+
+		if test.error {
+			if err == nil {
+				t.Fatalf("expected to see an error parsing %s, but didn't", test.input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("shouldn't have seen an error parsing %s, but did: %s", test.input, err.Error())
+		}
+		if !strings.Contains(program.String(), test.output) {
+			t.Fatalf("wrong output parsing %s: %s", test.input, program.String())
+		}
+	}
+}
+
 func TestParseMissingPrefix(t *testing.T) {
 	incomplete := `?`
 	l := lexer.New(incomplete)
@@ -0,0 +1,92 @@
+package evalfilter
+
+import "github.com/skx/evalfilter/v2/vm"
+
+// Policy declares which built-in, and host, functions scripts may call,
+// along with the resources they may consume.
+//
+// A policy is passed to New.  Scripts which call a denied function by
+// name fail to compile, and calls which can only be resolved at run-time,
+// such as `h["fn"]()`, fail when they are made.  Stubbed functions may be
+// called, but do nothing and return null.
+//
+// Functions defined by the script itself may always be called.
+type Policy struct {
+	// Default is the access granted to functions which are not
+	// listed in Functions.
+	Default vm.Access
+
+	// Functions holds the access granted to individual functions,
+	// by name.
+	Functions map[string]vm.Access
+
+	// Limits restrict the resources which each execution of a
+	// script may consume, as with SetLimits.
+	Limits vm.Limits
+}
+
+// Access returns the access the policy grants to the named function.
+func (p Policy) Access(name string) vm.Access {
+	access, ok := p.Functions[name]
+	if !ok {
+		return p.Default
+	}
+	return access
+}
+
+// Untrusted returns a policy suitable for running scripts written by
+// people you don't trust.
+//
+// Scripts may not read the environment via `getenv`, their output is
+// discarded, and they are limited to a modest amount of time and memory.
+// Host functions are permitted, as you've chosen to add them.
+func Untrusted() Policy {
+	return Policy{
+		Default: vm.Allow,
+		Functions: map[string]vm.Access{
+			"getenv": vm.Deny,
+			"print":  vm.Stub,
+			"printf": vm.Stub,
+		},
+		Limits: vm.Limits{
+			Instructions: 1000000,
+			StackDepth:   1024,
+			CallDepth:    64,
+			Size:         1024 * 1024,
+		},
+	}
+}
+
+// denied returns true if the policy forbids the script from calling the
+// named function, which must be a built-in or host function, or be
+// explicitly denied.
+//
+// Functions defined by the script itself are never denied.
+func (e *Eval) denied(name string) bool {
+	if _, ok := e.functions[name]; ok {
+		return false
+	}
+	if e.policy == nil || e.policy.Access(name) != vm.Deny {
+		return false
+	}
+
+	if _, ok := e.policy.Functions[name]; ok {
+		return true
+	}
+	_, ok := e.environment.GetFunction(name)
+	return ok
+}
+
+// checkDenied returns an error for the first call the script makes to a
+// function the policy forbids.
+//
+// This is done once the whole script has been compiled, as the functions
+// it defines may follow the calls made to them.
+func (e *Eval) checkDenied() error {
+	for _, call := range e.deniedCalls {
+		if e.denied(call.Err.(*vm.DeniedError).Function) {
+			return e.runError(call)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,536 @@
+// This file contains the code which allows a script to be checked, at
+// compile-time, against a description of the object it will be run against.
+//
+// Without a schema a typo in a field-name, such as `Mesage ~= /panic/`,
+// silently evaluates against Null.  With one we can report the unknown
+// field, along with its position, before the script is ever executed.
+
+package evalfilter
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/skx/evalfilter/v2/ast"
+	"github.com/skx/evalfilter/v2/object"
+	"github.com/skx/evalfilter/v2/token"
+	"github.com/skx/evalfilter/v2/vm"
+)
+
+// schemaType describes a value which a script might access.
+//
+// It is derived from either a Go type, or from a sample value.  When we
+// have a sample we can use it to discover the keys present in maps, and
+// the contents of interfaces, which the type alone cannot tell us.
+//
+// A schemaType with a nil type describes a value we know nothing about,
+// and which we therefore cannot check.
+type schemaType struct {
+	// typ is the Go type of the value.
+	typ reflect.Type
+
+	// val is the sample value, if we were given one.
+	val reflect.Value
+}
+
+// newSchemaType creates a schemaType from either a reflect.Type, or
+// a sample value.
+func newSchemaType(schema interface{}) *schemaType {
+
+	if typ, ok := schema.(reflect.Type); ok {
+		return &schemaType{typ: typ}
+	}
+
+	val := reflect.ValueOf(schema)
+	return &schemaType{typ: val.Type(), val: val}
+}
+
+// resolve follows any pointers and interfaces, returning the schemaType
+// of the value they refer to.
+func (s *schemaType) resolve() *schemaType {
+
+	typ := s.typ
+	val := s.val
+
+	for typ != nil && (typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Interface) {
+
+		// If we have a sample we can follow it.
+		if val.IsValid() && !val.IsNil() {
+			val = val.Elem()
+			typ = val.Type()
+			continue
+		}
+
+		// Otherwise we only know the type; an interface could
+		// contain anything at all.
+		val = reflect.Value{}
+		if typ.Kind() == reflect.Interface {
+			return &schemaType{}
+		}
+		typ = typ.Elem()
+	}
+
+	return &schemaType{typ: typ, val: val}
+}
+
+// objectType returns the type of the object a script will see when it
+// accesses this value, or the empty string if that cannot be known.
+func (s *schemaType) objectType() object.Type {
+
+	r := s.resolve()
+	if r.typ == nil {
+		return ""
+	}
+
+	// time.Duration values are exposed as durations.
+	if r.typ == reflect.TypeOf(time.Duration(0)) {
+		return object.DURATION
+	}
+
+	switch r.typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return object.INTEGER
+	case reflect.Float32, reflect.Float64:
+		return object.FLOAT
+	case reflect.String:
+		return object.STRING
+	case reflect.Bool:
+		return object.BOOLEAN
+	case reflect.Slice, reflect.Array:
+		return object.ARRAY
+	case reflect.Map:
+		return object.HASH
+	case reflect.Struct:
+		// time.Time values are exposed as times.
+		if r.typ == reflect.TypeOf(time.Time{}) {
+			return object.TIME
+		}
+		return object.HASH
+	}
+	return ""
+}
+
+// member returns the schemaType of the named member of this value.
+//
+// The boolean result is false if the member definitely doesn't exist,
+// when we cannot tell we return a schemaType describing an unknown value.
+func (s *schemaType) member(name string, naming vm.FieldNaming) (*schemaType, bool) {
+
+	r := s.resolve()
+	if r.typ == nil {
+		return &schemaType{}, true
+	}
+
+	switch r.typ.Kind() {
+
+	case reflect.Map:
+
+		// We can only reason about maps with string-keys.
+		if r.typ.Key().Kind() != reflect.String {
+			return &schemaType{}, true
+		}
+
+		// A sample tells us exactly which keys are present.
+		if r.val.IsValid() && !r.val.IsNil() {
+			key := reflect.ValueOf(name).Convert(r.typ.Key())
+			val := r.val.MapIndex(key)
+			if !val.IsValid() {
+				return nil, false
+			}
+			return &schemaType{typ: val.Type(), val: val}, true
+		}
+
+		// Otherwise any key might be present.
+		return &schemaType{typ: r.typ.Elem()}, true
+
+	case reflect.Struct:
+		if r.typ == reflect.TypeOf(time.Time{}) {
+			return nil, false
+		}
+		return r.field(name, naming)
+	}
+
+	// Other values have no members.
+	return nil, false
+}
+
+// field looks up the named field of a structure, including those which
+// are promoted from embedded structures.
+//
+// This mirrors the way the virtual machine exposes structure-fields.
+func (s *schemaType) field(name string, naming vm.FieldNaming) (*schemaType, bool) {
+
+	// Embedded structures we'll search after the direct fields.
+	var embedded []*schemaType
+
+	for i := 0; i < s.typ.NumField(); i++ {
+
+		// Get the name, skipping fields which are hidden.
+		typeField := s.typ.Field(i)
+		fieldName, ok := naming.Name(typeField)
+		if !ok {
+			continue
+		}
+
+		member := &schemaType{typ: typeField.Type}
+		if s.val.IsValid() {
+			member.val = s.val.Field(i)
+		}
+
+		// Embedded structures have their fields promoted.
+		if typeField.Anonymous && fieldName == typeField.Name {
+			inner := member.resolve()
+			if inner.typ != nil && inner.typ != s.typ &&
+				inner.typ.Kind() == reflect.Struct &&
+				inner.typ != reflect.TypeOf(time.Time{}) {
+				embedded = append(embedded, inner)
+			}
+
+			// An unexported embedded structure isn't
+			// visible itself.
+			if typeField.PkgPath != "" {
+				continue
+			}
+		}
+
+		if fieldName == name {
+			return member, true
+		}
+	}
+
+	// The outer fields take precedence over promoted ones.
+	for _, inner := range embedded {
+		if member, ok := inner.field(name, naming); ok {
+			return member, true
+		}
+	}
+
+	return nil, false
+}
+
+// element returns the schemaType of the members of an array.
+func (s *schemaType) element() *schemaType {
+
+	r := s.resolve()
+	if r.typ == nil {
+		return &schemaType{}
+	}
+	if r.typ.Kind() != reflect.Slice && r.typ.Kind() != reflect.Array {
+		return &schemaType{}
+	}
+
+	// Use the first member of a sample, if there is one.
+	if r.val.IsValid() && r.val.Len() > 0 {
+		val := r.val.Index(0)
+		return &schemaType{typ: val.Type(), val: val}
+	}
+	return &schemaType{typ: r.typ.Elem()}
+}
+
+// assignRoot returns the name of the variable which is updated when the
+// given target is assigned to, i.e. `a` for `a[1]["name"]`.
+func assignRoot(target ast.Expression) (string, bool) {
+	switch node := target.(type) {
+	case *ast.Identifier:
+		return node.Value, true
+	case *ast.IndexExpression:
+		return assignRoot(node.Left)
+	case *ast.InfixExpression:
+		if node.Operator == "." {
+			return assignRoot(node.Left)
+		}
+	}
+	return "", false
+}
+
+// collectVariables records the names of all the variables which the
+// given program assigns to, or declares.
+//
+// References to these names are not field-lookups, so they are never
+// checked against the schema.
+func (e *Eval) collectVariables(node ast.Node) {
+
+	// Record a variable, removing the legacy "$" prefix.
+	add := func(name string) {
+		e.variables[strings.TrimPrefix(name, "$")] = true
+	}
+
+	switch node := node.(type) {
+
+	case *ast.Program:
+		for _, s := range node.Statements {
+			e.collectVariables(s)
+		}
+	case *ast.BlockStatement:
+		if node == nil {
+			return
+		}
+		for _, s := range node.Statements {
+			e.collectVariables(s)
+		}
+	case *ast.ExpressionStatement:
+		e.collectVariables(node.Expression)
+	case *ast.ReturnStatement:
+		e.collectVariables(node.ReturnValue)
+	case *ast.AssignStatement:
+		add(node.Name.Value)
+		e.collectVariables(node.Value)
+	case *ast.IndexAssignStatement:
+		if root, ok := assignRoot(node.Target); ok {
+			add(root)
+		}
+		e.collectVariables(node.Target)
+		e.collectVariables(node.Value)
+	case *ast.LocalVariable:
+		add(node.Token.Literal)
+	case *ast.PostfixExpression:
+		add(node.Token.Literal)
+	case *ast.InfixExpression:
+		switch node.Operator {
+		case "+=", "-=", "*=", "/=":
+			if root, ok := assignRoot(node.Left); ok {
+				add(root)
+			}
+		}
+		e.collectVariables(node.Left)
+		e.collectVariables(node.Right)
+	case *ast.PrefixExpression:
+		e.collectVariables(node.Right)
+	case *ast.ForeachStatement:
+		add(node.Index)
+		add(node.Ident)
+		e.collectVariables(node.Value)
+		e.collectVariables(node.Body)
+	case *ast.WhileStatement:
+		e.collectVariables(node.Condition)
+		e.collectVariables(node.Body)
+	case *ast.FunctionDefinition:
+		add(node.Token.Literal)
+		for _, p := range node.Parameters {
+			add(p.Value)
+		}
+		e.collectVariables(node.Body)
+	case *ast.FunctionLiteral:
+		for _, p := range node.Parameters {
+			add(p.Value)
+		}
+		e.collectVariables(node.Body)
+	case *ast.IfExpression:
+		e.collectVariables(node.Condition)
+		e.collectVariables(node.Consequence)
+		e.collectVariables(node.Alternative)
+	case *ast.TernaryExpression:
+		e.collectVariables(node.Condition)
+		e.collectVariables(node.IfTrue)
+		e.collectVariables(node.IfFalse)
+	case *ast.SwitchExpression:
+		e.collectVariables(node.Value)
+		for _, opt := range node.Choices {
+			for _, val := range opt.Expr {
+				e.collectVariables(val)
+			}
+			e.collectVariables(opt.Block)
+		}
+	case *ast.CallExpression:
+		e.collectVariables(node.Function)
+		for _, a := range node.Arguments {
+			e.collectVariables(a)
+		}
+	case *ast.IndexExpression:
+		e.collectVariables(node.Left)
+		e.collectVariables(node.Index)
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			e.collectVariables(el)
+		}
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			e.collectVariables(k)
+			e.collectVariables(v)
+		}
+	}
+}
+
+// isVariable returns true if the given name refers to a variable, rather
+// than a field of the object the script is run against.
+//
+// `null` is treated as a variable too, as scripts use it to test for
+// missing values, rather than to refer to a field of that name.
+func (e *Eval) isVariable(name string) bool {
+	if _, ok := vm.CaptureGroup(name); ok {
+		return true
+	}
+	name = strings.TrimPrefix(name, "$")
+	if name == "null" {
+		return true
+	}
+	if e.variables[name] {
+		return true
+	}
+	_, ok := e.environment.Get(name)
+	return ok
+}
+
+// fieldType returns the schemaType of the given expression, if it refers
+// to a field of the object the script will be run against.
+//
+// nil is returned if the expression is something else, or refers to a
+// field which doesn't exist.
+func (e *Eval) fieldType(node ast.Expression) *schemaType {
+
+	switch node := node.(type) {
+
+	case *ast.Identifier:
+		if e.isVariable(node.Value) {
+			return nil
+		}
+		member, ok := e.schema.member(strings.TrimPrefix(node.Value, "$"), e.naming)
+		if ok {
+			return member
+		}
+
+	case *ast.InfixExpression:
+		if node.Operator != "." {
+			return nil
+		}
+		left := e.fieldType(node.Left)
+		name, ok := node.Right.(*ast.StringLiteral)
+		if left == nil || !ok {
+			return nil
+		}
+		member, ok := left.member(name.Value, e.naming)
+		if ok {
+			return member
+		}
+
+	case *ast.IndexExpression:
+		left := e.fieldType(node.Left)
+		if left == nil {
+			return nil
+		}
+		switch index := node.Index.(type) {
+		case *ast.StringLiteral:
+			member, ok := left.member(index.Value, e.naming)
+			if ok {
+				return member
+			}
+		case *ast.IntegerLiteral:
+			return left.element()
+		}
+	}
+
+	return nil
+}
+
+// expressionType returns the type of object the given expression will
+// produce, if it is a literal or a field-reference, otherwise the empty
+// string.
+func (e *Eval) expressionType(node ast.Expression) object.Type {
+
+	switch node.(type) {
+	case *ast.IntegerLiteral:
+		return object.INTEGER
+	case *ast.DurationLiteral:
+		return object.DURATION
+	case *ast.FloatLiteral:
+		return object.FLOAT
+	case *ast.StringLiteral:
+		return object.STRING
+	case *ast.BooleanLiteral:
+		return object.BOOLEAN
+	case *ast.RegexpLiteral:
+		return object.REGEXP
+	}
+
+	if field := e.fieldType(node); field != nil {
+		return field.objectType()
+	}
+	return ""
+}
+
+// checkMember records an error if the named member of the given
+// expression is known not to exist.
+func (e *Eval) checkMember(left ast.Expression, name string, tok token.Token) {
+
+	parent := e.fieldType(left)
+	if parent == nil {
+		return
+	}
+	if _, ok := parent.member(name, e.naming); !ok {
+		e.schemaError(tok, "unknown field '%s.%s'", left.String(), name)
+	}
+}
+
+// checkInfix records an error if the operands of the given expression
+// are obviously of the wrong types.
+func (e *Eval) checkInfix(node *ast.InfixExpression) {
+
+	switch node.Operator {
+
+	case "~=", "!~":
+		left := e.fieldType(node.Left)
+		if left == nil {
+			return
+		}
+		typ := left.objectType()
+		if typ != "" && typ != object.STRING {
+			e.schemaError(node.Token, "regular expression match against %s field '%s'", typ, node.Left.String())
+		}
+
+	case "+", "-", "*", "/", "%", "**", "<", "<=", ">", ">=", "==", "!=":
+
+		// We only care about comparisons involving a field.
+		if e.fieldType(node.Left) == nil && e.fieldType(node.Right) == nil {
+			return
+		}
+
+		left := e.expressionType(node.Left)
+		right := e.expressionType(node.Right)
+		if left == "" || right == "" || left == right {
+			return
+		}
+
+		// Integers and floats may be mixed freely.
+		numeric := func(t object.Type) bool {
+			return t == object.INTEGER || t == object.FLOAT
+		}
+		if numeric(left) && numeric(right) {
+			return
+		}
+
+		// Times and durations may be combined with each other,
+		// and with numbers.
+		temporal := func(t object.Type) bool {
+			return t == object.TIME || t == object.DURATION
+		}
+		if (temporal(left) || temporal(right)) &&
+			(temporal(left) || numeric(left)) &&
+			(temporal(right) || numeric(right)) {
+			return
+		}
+
+		e.schemaError(node.Token, "type mismatch: %s %s %s", left, node.Operator, right)
+	}
+}
+
+// schemaError records an error found when checking the script against
+// the schema, along with its position.
+func (e *Eval) schemaError(tok token.Token, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	e.schemaErrors = append(e.schemaErrors, fmt.Sprintf("%s around %s", msg, tok.Position()))
+}
+
+// checkIdentifier records an error if the given identifier refers to a
+// field which doesn't exist.
+func (e *Eval) checkIdentifier(node *ast.Identifier) {
+
+	if e.isVariable(node.Value) {
+		return
+	}
+	if _, ok := e.schema.member(strings.TrimPrefix(node.Value, "$"), e.naming); !ok {
+		e.schemaError(node.Token, "unknown field '%s'", node.Value)
+	}
+}
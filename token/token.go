@@ -40,12 +40,15 @@ const (
 	ASTERISK       = "*"
 	ASTERISKEQUALS = "*="
 	BANG           = "!"
+	BREAK          = "BREAK"
 	CASE           = "case"
 	COLON          = ":"
 	COMMA          = ","
+	CONTINUE       = "CONTINUE"
 	CONTAINS       = "~="
 	DEFAULT        = "DEFAULT"
 	DOTDOT         = ".."
+	DURATION       = "DURATION"
 	ELSE           = "ELSE"
 	EOF            = "EOF"
 	EQ             = "=="
@@ -97,7 +100,9 @@ const (
 
 // reversed keywords
 var keywords = map[string]Type{
+	"break":    BREAK,
 	"case":     CASE,
+	"continue": CONTINUE,
 	"default":  DEFAULT,
 	"else":     ELSE,
 	"false":    FALSE,
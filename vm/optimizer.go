@@ -104,8 +104,21 @@ func (vm *VM) optimizeMaths() (bool, error) {
 	//
 	// Walk over the bytecode
 	//
+	//
+	// The offsets which are jumped to.
+	//
+	targets := vm.jumpTargets()
+
 	err := vm.WalkBytecode(func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
 
+		//
+		// If we can jump here then the constants we've
+		// seen might not be on the stack, so forget them.
+		//
+		if targets[offset] {
+			args = nil
+		}
+
 		//
 		// Now we do the magic.
 		//
@@ -117,6 +130,13 @@ func (vm *VM) optimizeMaths() (bool, error) {
 			// If we see a constant being pushed we
 			// add that to our list tracking such things.
 			//
+			// We only rewrite those with 16-bit arguments,
+			// which is all our compiler generates.
+			//
+			if vm.bytecode[offset] == byte(code.OpWide) {
+				args = nil
+				break
+			}
 			args = append(args, Constants{offset: offset, value: opArg.(int)})
 
 		case code.OpSquareRoot:
@@ -363,8 +383,29 @@ func (vm *VM) optimizeJumps() bool {
 	//
 	// Walk the bytecode.
 	//
+	//
+	// The offsets which are jumped to.
+	//
+	targets := vm.jumpTargets()
+
 	err := vm.WalkBytecode(func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
 
+		//
+		// If we can jump here then we might not have
+		// arrived from the previous instruction.
+		//
+		// For example `a && b` leads to code like this:
+		//
+		//   OpTrue
+		//   OpJump END
+		//   OpFalse
+		// END:
+		//   OpJumpIfFalse 0x1234
+		//
+		if targets[offset] {
+			prevOp = code.OpNop
+		}
+
 		//
 		// Now we do the magic.
 		//
@@ -381,10 +422,12 @@ func (vm *VM) optimizeJumps() bool {
 				// wipe the previous instruction, (OpTrue)
 				vm.bytecode[offset-1] = byte(code.OpNop)
 
-				// wipe this jump
-				vm.bytecode[offset] = byte(code.OpNop)
-				vm.bytecode[offset+1] = byte(code.OpNop)
-				vm.bytecode[offset+2] = byte(code.OpNop)
+				// wipe this jump, which might have
+				// an OpWide prefix.
+				_, _, opLen := code.Read(vm.bytecode, offset)
+				for i := 0; i < opLen; i++ {
+					vm.bytecode[offset+i] = byte(code.OpNop)
+				}
 
 				// We made a change
 				changed = true
@@ -472,6 +515,11 @@ func (vm *VM) removeNOPs() {
 	//
 	rewrite := make(map[int]int)
 
+	//
+	// The source-positions of the rewritten instructions.
+	//
+	positions := make(code.Positions)
+
 	//
 	// Walk the bytecode.
 	//
@@ -509,19 +557,24 @@ func (vm *VM) removeNOPs() {
 			rewrite[offset] = len(tmp)
 
 			//
-			// Copy the instruction.
+			// The instruction keeps its source-position.
 			//
-			tmp = append(tmp, byte(opCode))
+			if pos, ok := vm.positions[offset]; ok {
+				positions[len(tmp)] = pos
+			}
 
 			//
-			// Copy any argument.
+			// Copy the instruction, and any argument.
 			//
+			// We keep any OpWide prefix, so that the
+			// updated jump-targets are sure to fit.
+			//
+			arg := 0
 			if opArg != nil {
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg.(int)))
-
-				tmp = append(tmp, b...)
+				arg = opArg.(int)
 			}
+			wide := vm.bytecode[offset] == byte(code.OpWide)
+			tmp = append(tmp, code.Make(opCode, arg, wide)...)
 		}
 
 		// No error, keep going
@@ -552,17 +605,8 @@ func (vm *VM) removeNOPs() {
 	ln := len(tmp)
 	for ip < ln {
 
-		// Get the instruction.
-		op := code.Opcode(tmp[ip])
-
-		// And its length
-		opLen := code.Length(op)
-
-		// Get the optional argument
-		opArg := 0
-		if opLen > 1 {
-			opArg = int(binary.BigEndian.Uint16(tmp[ip+1 : ip+3]))
-		}
+		// Get the instruction, its argument, and its length.
+		op, opArg, opLen := code.Read(tmp, ip)
 
 		//
 		// Now we do the magic.
@@ -592,13 +636,10 @@ func (vm *VM) removeNOPs() {
 				return
 			}
 
-			// Make into a two-byte pair.
-			b := make([]byte, 2)
-			binary.BigEndian.PutUint16(b, uint16(newDst))
-
-			// Update in-place
-			tmp[ip+1] = b[0]
-			tmp[ip+2] = b[1]
+			// Update in-place, keeping the width of
+			// the argument.
+			wide := tmp[ip] == byte(code.OpWide)
+			copy(tmp[ip:], code.Make(op, newDst, wide))
 
 		}
 
@@ -609,9 +650,10 @@ func (vm *VM) removeNOPs() {
 	}
 
 	//
-	// Replace the instructions.
+	// Replace the instructions, and their positions.
 	//
 	vm.bytecode = tmp
+	vm.positions = positions
 }
 
 // removeDeadCode does the bare minimum of dead-code removal:
@@ -651,16 +693,12 @@ func (vm *VM) removeDeadCode() {
 			return false, nil
 		default:
 
-			tmp = append(tmp, byte(opCode))
+			arg := 0
 			if opArg != nil {
-
-				// Make a buffer for the arg
-				b := make([]byte, 2)
-				binary.BigEndian.PutUint16(b, uint16(opArg.(int)))
-
-				// append
-				tmp = append(tmp, b...)
+				arg = opArg.(int)
 			}
+			wide := vm.bytecode[offset] == byte(code.OpWide)
+			tmp = append(tmp, code.Make(opCode, arg, wide)...)
 		}
 
 		// keep walking
@@ -678,3 +716,26 @@ func (vm *VM) removeDeadCode() {
 		vm.bytecode = tmp
 	}
 }
+
+// jumpTargets returns the offsets which are the destination of a jump.
+//
+// Our optimizations look at adjacent instructions, and they're only
+// safe when nothing can jump into the middle of them.
+func (vm *VM) jumpTargets() map[int]bool {
+
+	targets := make(map[int]bool)
+
+	err := vm.WalkBytecode(func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
+		switch opCode {
+		case code.OpJump, code.OpJumpIfFalse:
+			targets[opArg.(int)] = true
+		}
+		return true, nil
+	})
+
+	if err != nil {
+		fmt.Printf("jumpTargets:%s\n", err)
+	}
+
+	return targets
+}
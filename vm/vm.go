@@ -10,10 +10,10 @@ package vm
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"math"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -45,12 +45,246 @@ var Null = &object.Null{}
 // Void is our global "void" object.
 var Void = &object.Void{}
 
-// VM is the structure which holds our state.
+// FieldNaming controls the names which structure-fields are made
+// available to scripts under.
+type FieldNaming int
+
+const (
+	// GoNames exposes fields using the name they have in the Go
+	// structure.  This is the default.
+	GoNames FieldNaming = iota
+
+	// JSONNames exposes fields using the name from their `json`
+	// tag, falling back to the Go name if there is no such tag.
+	JSONNames
+
+	// TagNames exposes fields using the name from their `evalfilter`
+	// tag, falling back to the Go name if there is no such tag.
+	TagNames
+)
+
+// Name returns the name the given structure-field should be exposed to
+// scripts as, along with a boolean which is false if the field should
+// be hidden entirely.
+//
+// Unexported fields are always hidden, as are fields which have the tag
+// `evalfilter:"-"`.
+func (n FieldNaming) Name(field reflect.StructField) (string, bool) {
+
+	// Unexported fields cannot be read safely.
+	if field.PkgPath != "" && !field.Anonymous {
+		return "", false
+	}
+
+	// Fields may always be hidden via our own tag.
+	tag := field.Tag.Get("evalfilter")
+	if tag == "-" {
+		return "", false
+	}
+
+	switch n {
+	case JSONNames:
+		tag = field.Tag.Get("json")
+		if tag == "-" {
+			return "", false
+		}
+	case TagNames:
+		// nop: we already have the tag.
+	default:
+		tag = ""
+	}
+
+	// Strip any options, such as `json:"name,omitempty"`.
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+
+	if tag != "" {
+		return tag, true
+	}
+	return field.Name, true
+}
+
+// Error is the type of the errors returned by Run, it records the position
+// of the source which generated the instruction that failed.
+type Error struct {
+	// Position is the location of the failing source.
+	Position code.Position
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the error-message, along with the position.
+func (e *Error) Error() string {
+	if e.Position.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s around line %d, column %d", e.Err.Error(), e.Position.Line, e.Position.Column)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// The names of the limits which may be exceeded, as reported by LimitError.
+const (
+	// InstructionLimit is the name of Limits.Instructions.
+	InstructionLimit = "instruction"
+
+	// StackLimit is the name of Limits.StackDepth.
+	StackLimit = "stack depth"
+
+	// CallLimit is the name of Limits.CallDepth.
+	CallLimit = "call depth"
+
+	// SizeLimit is the name of Limits.Size.
+	SizeLimit = "size"
+)
+
+// DefaultCallDepth is the maximum nesting of calls to user-defined
+// functions, if Limits.CallDepth is not set.
+//
+// Exceeding it results in a "stack overflow" error.
+const DefaultCallDepth = 10000
+
+// Limits controls the resources which a single run of a script may
+// consume, to protect the host application from malicious, or buggy,
+// scripts.
+//
+// Any limit which is zero is not enforced, except CallDepth which
+// defaults to DefaultCallDepth.
+type Limits struct {
+	// Instructions is the maximum number of instructions which
+	// may be executed.
+	Instructions int
+
+	// StackDepth is the maximum number of entries upon the stack.
+	StackDepth int
+
+	// CallDepth is the maximum nesting of calls to user-defined
+	// functions.
+	CallDepth int
+
+	// Size is the maximum number of elements in an array or hash,
+	// or bytes in a string, which a script may create.
+	Size int
+}
+
+// LimitError is the error which is returned when a script exceeds one
+// of its Limits.
+type LimitError struct {
+	// Limit is the name of the limit which was exceeded, for example
+	// InstructionLimit.
+	Limit string
+
+	// Max is the value of the limit.
+	Max int
+}
+
+// Error returns the error-message.
+func (e *LimitError) Error() string {
+	if e.Limit == CallLimit {
+		return fmt.Sprintf("stack overflow: %s limit of %d exceeded", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// Access describes whether scripts may call a built-in, or host, function.
+type Access int
+
+const (
+	// Allow permits calls to the function.
+	Allow Access = iota
+
+	// Deny forbids calls to the function, they result in an error.
+	Deny
+
+	// Stub replaces the function with one which does nothing, and
+	// returns null.
+	Stub
+)
+
+// String returns the name of the access.
+func (a Access) String() string {
+	switch a {
+	case Deny:
+		return "deny"
+	case Stub:
+		return "stub"
+	default:
+		return "allow"
+	}
+}
+
+// DeniedError is the error which is returned when a script calls a
+// function which it is not permitted to call.
+type DeniedError struct {
+	// Function is the name of the function.
+	Function string
+}
+
+// Error returns the error-message.
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("the function %s is not permitted", e.Function)
+}
+
+// FunctionError is the error which is returned when a built-in, or host,
+// function fails.
+type FunctionError struct {
+	// Function is the name of the function.
+	Function string
+
+	// Err is the error the function returned.
+	Err error
+}
+
+// Error returns the error-message.
+func (e *FunctionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Function, e.Err.Error())
+}
+
+// Unwrap returns the error the function returned.
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is the error which is returned when a script fails to update
+// a field of the object it is run against.
+type FieldError struct {
+	// Field is the name of the field.
+	Field string
+
+	// Err describes the failure.
+	Err error
+}
+
+// Error returns the error-message.
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("cannot write to field %s: %s", e.Field, e.Err.Error())
+}
+
+// Unwrap returns the error which describes the failure.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// VM is the structure which holds our compiled program.
+//
+// Once constructed the VM is not modified by running the program, so
+// Run may be invoked concurrently from multiple goroutines.  Each run
+// has its own execution-state, holding its stack, local variables,
+// and the fields of the object it is run against.
 type VM struct {
 
 	// bytecode contains the actual series of instructions we'll execute.
 	bytecode code.Instructions
 
+	// positions maps the offsets of our bytecode to the position of
+	// the source which generated each instruction.
+	positions code.Positions
+
 	// constants is an array holding constants which were found in
 	// the script-source.  These constants include string-literals,
 	// numeric-literals, boolean values as well as variable names, the
@@ -68,8 +302,76 @@ type VM struct {
 
 	// environment holds the environment, which will allow variables
 	// and functions to be get/set.
+	//
+	// Each run uses a fork of this, so that local variables, and the
+	// global variables a run sets, are not shared between concurrent
+	// runs.
+	environment *environment.Environment
+
+	// functions that are defined in our scripting language
+	functions map[string]environment.UserFunction
+
+	// userFunctions holds our functions as function-values, which
+	// are created once rather than each time they're called.
+	userFunctions map[string]*object.Function
+
+	// slots is the number of local variables our main program uses.
+	slots int
+
+	// naming controls the names of structure-fields we discover
+	// via reflection.
+	naming FieldNaming
+
+	// limits controls the resources a run may consume.
+	limits Limits
+
+	// access determines whether built-in, and host, functions may
+	// be called.  If it is nil all functions may be called.
+	access func(name string) Access
+
+	// writeBack is true if assignments to the fields of the object
+	// we're run against should update that object.
+	writeBack bool
+}
+
+// frame records the state of a function which has called a user-defined
+// function, so that it may be resumed when the call returns.
+type frame struct {
+	// bytecode and positions are those of the caller.
+	bytecode  code.Instructions
+	positions code.Positions
+
+	// ip is the offset at which the caller resumes.
+	ip int
+
+	// stack is the caller's stack.
+	stack *stack.Stack
+
+	// locals and outer hold the caller's local variables, and
+	// those of the functions which enclosed it.
+	locals []object.Object
+	outer  [][]object.Object
+}
+
+// execution holds the state of a single run of our program.
+//
+// The program itself is embedded, so the methods which implement our
+// instructions can access both.
+type execution struct {
+	*VM
+
+	// environment is the fork of the program's environment which
+	// holds our global variables.
 	environment *environment.Environment
 
+	// locals holds the local variables of the function which is
+	// executing, or of our main program, indexed by slot.
+	locals []object.Object
+
+	// outer holds the local variables of the functions which
+	// enclosed the one which is executing, innermost last.
+	outer [][]object.Object
+
 	// fields contains the contents of all the fields in the object
 	// or map we're executing against.  We discover these via reflection
 	// at run-time.
@@ -78,14 +380,23 @@ type VM struct {
 	// the need to reparse the same object multiple times.
 	fields map[string]object.Object
 
-	// functions that are defined in our scripting language
-	functions map[string]environment.UserFunction
-
 	// stack holds a pointer to our stack-object.
 	//
 	// We're a stack-based virtual machine so this is used for
 	// much of our internal implementation.
 	stack *stack.Stack
+
+	// frames holds the callers of the user-defined function which
+	// is executing, if any.
+	frames []frame
+
+	// captures holds the text matched by the most recent regular
+	// expression test, and its capture groups, which scripts may
+	// access as `$0`, `$1`, etc.
+	captures []string
+
+	// instructions is the number of instructions executed.
+	instructions int
 }
 
 // New constructs a new virtual machine.
@@ -93,7 +404,7 @@ type VM struct {
 // If the value `OPTIMIZE` exists inside the environment we're passed
 // we'll also run a series of simple optimizer steps.  These are naive,
 // but do speedup carefully constructed test cases.
-func New(constants []object.Object, bytecode code.Instructions, functions map[string]environment.UserFunction, env *environment.Environment) *VM {
+func New(constants []object.Object, bytecode code.Instructions, positions code.Positions, functions map[string]environment.UserFunction, env *environment.Environment) *VM {
 
 	// If we have a `DEBUG` environment then we enable debugging.
 	_, debug := env.Get("DEBUG")
@@ -107,11 +418,11 @@ func New(constants []object.Object, bytecode code.Instructions, functions map[st
 	// Create the machine
 	vm := &VM{
 		bytecode:    bytecode,
+		positions:   positions,
 		constants:   constants,
 		debug:       debug,
 		environment: env,
 		functions:   functions,
-		stack:       stack.New(),
 	}
 
 	// Set a default context
@@ -132,32 +443,110 @@ func New(constants []object.Object, bytecode code.Instructions, functions map[st
 		tmp := make(map[string]environment.UserFunction)
 		for name, fun := range functions {
 
-			// Save the main bytecode away
-			safe := vm.bytecode
-
-			// Replace it with the bytecode from the function
-			vm.bytecode = fun.Bytecode
-
 			// Tweak it
-			saved := vm.optimizeBytecode()
+			saved := 0
+			fun.Bytecode, fun.Positions, saved = vm.optimizeFunction(fun.Bytecode, fun.Positions)
 
 			if debug && optimize {
 				fmt.Printf("Bytecode optimizer saved %d bytes for function %s\n", saved, name)
 			}
 
 			// Save it away
-			fun.Bytecode = vm.bytecode
 			tmp[name] = fun
-
-			// And reset the saved vm-bytecode
-			vm.bytecode = safe
 		}
 		vm.functions = tmp
+
+		//
+		// And anonymous functions, which are stored as
+		// constants.  We take a copy so that we don't
+		// modify the constants we were given.
+		//
+		consts := make([]object.Object, len(constants))
+		for i, c := range constants {
+			if fun, ok := c.(*object.Function); ok {
+				cp := *fun
+				cp.Bytecode, cp.Positions, _ = vm.optimizeFunction(fun.Bytecode, fun.Positions)
+				c = &cp
+			}
+			consts[i] = c
+		}
+		vm.constants = consts
+	}
+
+	//
+	// Record the number of local variables each function needs.
+	//
+	// Function constants are copied first, so that we don't modify
+	// the constants we were given.
+	//
+	vm.slots = countSlots(vm.bytecode, 0)
+
+	vm.userFunctions = make(map[string]*object.Function)
+	for name, fun := range vm.functions {
+		vm.userFunctions[name] = &object.Function{
+			Arguments: fun.Arguments,
+			Bytecode:  fun.Bytecode,
+			Positions: fun.Positions,
+			Locals:    countSlots(fun.Bytecode, len(fun.Arguments)),
+		}
+	}
+
+	consts := make([]object.Object, len(vm.constants))
+	for i, c := range vm.constants {
+		if fun, ok := c.(*object.Function); ok {
+			cp := *fun
+			cp.Locals = countSlots(fun.Bytecode, len(fun.Arguments))
+			c = &cp
+		}
+		consts[i] = c
 	}
+	vm.constants = consts
 
 	return vm
 }
 
+// countSlots returns the number of local variables used by the given
+// bytecode, which is at least the number of arguments it is passed.
+func countSlots(bytecode code.Instructions, args int) int {
+	slots := args
+	for ip := 0; ip < len(bytecode); {
+		op, slot, opLen := code.Read(bytecode, ip)
+
+		switch op {
+		case code.OpLocal, code.OpGetLocal, code.OpSetLocal:
+			if slot >= slots {
+				slots = slot + 1
+			}
+		}
+		ip += opLen
+	}
+	return slots
+}
+
+// optimizeFunction runs our optimizer against the bytecode of a function,
+// returning the updated bytecode, positions, and the number of bytes saved.
+func (vm *VM) optimizeFunction(bytecode code.Instructions, positions code.Positions) (code.Instructions, code.Positions, int) {
+
+	// Save the main bytecode away
+	safe := vm.bytecode
+	safePositions := vm.positions
+
+	// Replace it with the bytecode from the function
+	vm.bytecode = bytecode
+	vm.positions = positions
+
+	// Tweak it
+	saved := vm.optimizeBytecode()
+	bytecode = vm.bytecode
+	positions = vm.positions
+
+	// And reset the saved vm-bytecode
+	vm.bytecode = safe
+	vm.positions = safePositions
+
+	return bytecode, positions, saved
+}
+
 // SetContext allows a context to be used as our virtual machine is
 // running. This is most used to allow our caller to setup a
 // timeout/deadline which will avoid denial-of-service problems if
@@ -166,6 +555,33 @@ func (vm *VM) SetContext(ctx context.Context) {
 	vm.context = ctx
 }
 
+// SetLimits sets the resource-limits which each run must respect.
+func (vm *VM) SetLimits(limits Limits) {
+	vm.limits = limits
+}
+
+// SetAccess sets the function which determines whether scripts may call
+// each built-in, or host, function.  Functions defined by the script may
+// always be called.
+func (vm *VM) SetAccess(access func(name string) Access) {
+	vm.access = access
+}
+
+// SetFieldNaming controls the names which the fields of any structure
+// we're run against are exposed to scripts as.
+func (vm *VM) SetFieldNaming(naming FieldNaming) {
+	vm.naming = naming
+}
+
+// SetWriteBack controls whether assignments to the fields of the object
+// we're run against update that object, rather than setting a variable.
+//
+// Structure-fields may only be updated if a pointer to the structure is
+// passed to Run.
+func (vm *VM) SetWriteBack(enabled bool) {
+	vm.writeBack = enabled
+}
+
 // Run launches our virtual machine, interpreting the bytecode-program we were
 // constructed with.
 //
@@ -176,43 +592,94 @@ func (vm *VM) SetContext(ctx context.Context) {
 // (Our compiler only implements the 'while' loop for control-flow, but it
 // is possible  a hand-created program could build such a things via the
 // instruction-set.)
+//
+// Any error returned will be of type *Error, recording the position of
+// the source which failed.
+//
+// Run may be called concurrently.
 func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 	//
 	// Sanity-check the bytecode program is non-empty
 	//
 	if len(vm.bytecode) < 1 {
-		return nil, fmt.Errorf("the bytecode program is empty")
+		return nil, &Error{Err: fmt.Errorf("the bytecode program is empty")}
 	}
 
 	//
-	// Make an empty map to store field/map contents.
+	// Create the state for this run, and go.
 	//
-	vm.fields = make(map[string]object.Object)
+	exec := vm.newExecution()
+	out, err := exec.run(obj, vm.bytecode, vm.positions)
 
 	//
-	// When built-in functions are invoked their return value is stored
-	// upon the stack.  Usually this is OK because the return value will
-	// be used for something, and thus popped-off.
-	//
-	// However it is possible that user-added functions place their
-	// return value upon the stack, where it is never used.  This will
-	// cause the stack to needlessly grow, so we ensure that we
-	// reset it between runs here to avoid unbounded growth.
+	// The global variables the script set are only visible to it
+	// while it runs, now make them visible to our caller, and to
+	// later runs.
 	//
-	// (This used to be the case with the built-in functions `print`
-	// and `printf`.  They would always store a value upon the stack
-	// which no user would ever test/use/care-about.  This was resolved
-	// via the addition of the &object.Void{} type.   However we
-	// cannot assume everybody remember to use that.)
-	//
-	vm.stack.Clear()
+	exec.environment.Commit()
+
+	return out, err
+}
+
+// newExecution creates the state for a new run of our program.
+//
+// Each run has its own stack, and its own fork of our environment so
+// that local variables, and the global variables it sets, are not shared
+// with concurrent runs.
+//
+// When built-in functions are invoked their return value is stored
+// upon the stack.  Usually this is OK because the return value will
+// be used for something, and thus popped-off.
+//
+// However it is possible that user-added functions place their
+// return value upon the stack, where it is never used.  Using a new
+// stack for each run avoids that causing unbounded growth.
+func (vm *VM) newExecution() *execution {
+	return &execution{
+		VM:          vm,
+		environment: vm.environment.Fork(),
+		locals:      make([]object.Object, vm.slots),
+		fields:      make(map[string]object.Object),
+		stack:       stack.New(),
+	}
+}
+
+// run interprets the given bytecode.
+//
+// Calls to user-defined functions don't recurse, instead we save the
+// state of the caller in a frame, and switch to the bytecode of the
+// function.  When it returns we switch back again.
+func (vm *execution) run(obj interface{}, bytecode code.Instructions, positions code.Positions) (out object.Object, err error) {
 
 	//
 	// Instruction pointer and length of bytecode.
 	//
+	// We also record the offset of the instruction we're
+	// executing, as ip is updated as we proceed.
+	//
 	ip := 0
-	ln := len(vm.bytecode)
+	ln := len(bytecode)
+	start := 0
+
+	//
+	// If we return an error then record the position of the
+	// source which caused it.
+	//
+	// Panics, such as those raised by the `panic` function,
+	// are handled the same way.
+	//
+	defer func() {
+		if r := recover(); r != nil {
+			out = Null
+			err = fmt.Errorf("error during Run: %s", r)
+		}
+		if err == nil {
+			return
+		}
+		pos, _ := positions.Find(start)
+		err = &Error{Position: pos, Err: err}
+	}()
 
 	//
 	// Loop over all the bytecode.
@@ -221,7 +688,20 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 	// is possible this function will run forever, and never terminate.
 	// This is why we allow `SetContext` to setup a timeout-period.
 	//
-	for ip < ln {
+	for {
+
+		//
+		// If we've hit the end of the bytecode then we're done,
+		// unless we're in a function which didn't return.
+		//
+		if ip >= ln {
+			if len(vm.frames) == 0 {
+				break
+			}
+			caller := vm.leave(Null)
+			bytecode, positions, ip, ln = caller.bytecode, caller.positions, caller.ip, len(caller.bytecode)
+			continue
+		}
 
 		//
 		// We've been given a context, which we'll test at every
@@ -239,28 +719,27 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 		}
 
 		//
-		// Get the next opcode
+		// Ensure we've not executed too many instructions.
 		//
-		op := code.Opcode(vm.bytecode[ip])
+		if vm.limits.Instructions > 0 {
+			vm.instructions++
+			if vm.instructions > vm.limits.Instructions {
+				return Null, &LimitError{Limit: InstructionLimit, Max: vm.limits.Instructions}
+			}
+		}
 
 		//
-		// Find out how long it is.
+		// Get the next opcode
 		//
-		opLen := code.Length(op)
+		start = ip
 
 		//
-		// If the opcode is more than a single byte long
-		// we read the argument here.
+		// Along with its argument, if any, and its length
+		// which depends upon whether it has an OpWide prefix.
 		//
-		opArg := 0
-		if opLen > 1 {
-
-			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
-			//
-			opArg = int(binary.BigEndian.Uint16(vm.bytecode[ip+1 : ip+3]))
+		op, opArg, opLen := code.Read(bytecode, ip)
+		if ip+opLen > ln {
+			return nil, fmt.Errorf("truncated %s instruction", code.String(op))
 		}
 
 		if vm.debug {
@@ -310,15 +789,58 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			val := vm.lookup(obj, name)
 			vm.stack.Push(val)
 
-			// Setup a local variable, by name
+			// Declare a local variable, by slot
 		case code.OpLocal:
-			name, err := vm.stack.Pop()
+			if opArg >= len(vm.locals) {
+				return nil, fmt.Errorf("local variable %d doesn't exist", opArg)
+			}
+			vm.locals[opArg] = Null
+
+			// Get a local variable, by slot
+		case code.OpGetLocal:
+			if opArg >= len(vm.locals) {
+				return nil, fmt.Errorf("local variable %d doesn't exist", opArg)
+			}
+			val := vm.locals[opArg]
+			if val == nil {
+				val = Null
+			}
+			vm.stack.Push(val)
+
+			// Set a local variable, by slot
+		case code.OpSetLocal:
+			if opArg >= len(vm.locals) {
+				return nil, fmt.Errorf("local variable %d doesn't exist", opArg)
+			}
+			val, err := vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
+			vm.locals[opArg] = val
+
+			// Get a local variable of an enclosing function
+		case code.OpGetOuter:
+			locals, err := vm.outerLocals(opArg)
+			if err != nil {
+				return nil, err
+			}
+			val := locals[opArg&0xFFFF]
+			if val == nil {
+				val = Null
+			}
+			vm.stack.Push(val)
 
-			// now set the value
-			vm.environment.SetLocal(name.Inspect(), Null)
+			// Set a local variable of an enclosing function
+		case code.OpSetOuter:
+			locals, err := vm.outerLocals(opArg)
+			if err != nil {
+				return nil, err
+			}
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			locals[opArg&0xFFFF] = val
 
 			// Set a variable by name
 		case code.OpSet:
@@ -335,7 +857,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				return nil, err
 			}
 
-			vm.environment.Set(name.Inspect(), val)
+			err = vm.store(obj, name.Inspect(), val)
+			if err != nil {
+				return nil, err
+			}
 
 			// maths & comparisons
 		case code.OpAdd, // addition
@@ -370,6 +895,12 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			// array elements we're going to expect
 			// to be present upon the stack.
 
+			// Ensure it isn't too large.
+			err := vm.checkSize(opArg)
+			if err != nil {
+				return nil, err
+			}
+
 			// Make the array of the appropriate size
 			elements := make([]object.Object, opArg)
 
@@ -390,6 +921,13 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			// Store a hash
 		case code.OpHash:
 
+			// The argument is the number of keys and
+			// values, so ensure that isn't too large.
+			err := vm.checkSize(opArg / 2)
+			if err != nil {
+				return nil, err
+			}
+
 			hashedPairs := make(map[object.HashKey]object.HashPair)
 
 			for i := 0; i < opArg; i += 2 {
@@ -433,15 +971,11 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				vm.stack.Push(True)
 			} else if caseVal.Type() == object.REGEXP {
 
-				// Horrid - invoke Matches() to run the test.
-				args := []object.Object{val, caseVal}
-				fn, ok := vm.environment.GetFunction("match")
-				if !ok {
-					return nil, fmt.Errorf("failed to lookup match-function")
+				matched, err := vm.match(val, caseVal)
+				if err != nil {
+					return nil, err
 				}
-				out := fn.(func(args []object.Object) object.Object)
-				ret := out(args)
-				vm.stack.Push(ret)
+				vm.stack.Push(vm.nativeBoolToBooleanObject(matched))
 
 			} else {
 				vm.stack.Push(False)
@@ -463,6 +997,26 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				return nil, err
 			}
 
+			// Update an element of an array/hash.
+		case code.OpSetIndex:
+			index, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			left, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+			val, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
+			}
+
+			err = vm.executeSetIndex(left, index, val)
+			if err != nil {
+				return nil, err
+			}
+
 			// !true -> false
 		case code.OpBang:
 
@@ -499,7 +1053,19 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			// return from script
 		case code.OpReturn:
 			result, err := vm.stack.Pop()
-			return result, err
+			if err != nil {
+				return result, err
+			}
+
+			// Returning from our main program?
+			if len(vm.frames) == 0 {
+				return result, nil
+			}
+
+			// Otherwise resume our caller.
+			caller := vm.leave(result)
+			bytecode, positions, ip, ln = caller.bytecode, caller.positions, caller.ip, len(caller.bytecode)
+			continue
 
 			// flow-control: unconditional jump
 		case code.OpJump:
@@ -510,7 +1076,7 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			ip = opArg - opLen
 
-			if opArg >= len(vm.bytecode) {
+			if opArg >= len(bytecode) {
 				return nil, fmt.Errorf("instruction pointer is out of bounds")
 			}
 
@@ -532,26 +1098,30 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 				ip = opArg - opLen
 
-				if opArg >= len(vm.bytecode) {
+				if opArg >= len(bytecode) {
 					return nil, fmt.Errorf("instruction pointer is out of bounds")
 				}
 			}
 
 			// function-call: This is messy.
 			//
-			// Handles builtins and user-defined functions.
+			// Handles builtins and user-defined functions, the
+			// latter by pushing a new frame.
 		case code.OpCall:
 
 			// The OpCall instruction is followed by an
 			// argument describing the number of args the
 			// function we're calling should be invoked with.
 
-			// get the name of the function from the stack.
-			fName, err := vm.stack.Pop()
+			// get the function to call from the stack.
+			//
+			// This is either the name of a function, or
+			// a function-value.
+			callee, err := vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
-			name := fName.Inspect()
+			name := callee.Inspect()
 
 			//
 			// The argument to the call-instruction is the
@@ -572,13 +1142,46 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				opArg--
 			}
 
-			// Get the function we're to invoke.
-			fn, ok := vm.environment.GetFunction(name)
-			if ok {
+			// The user-defined function we're to call, if any.
+			//
+			// Calling a function-value, such as `h["fn"](3)`?
+			fn, _ := callee.(*object.Function)
 
-				// Cast the function & call it
-				out := fn.(func(args []object.Object) object.Object)
-				ret := out(fnArgs)
+			// Get the built-in function we're to invoke.
+			builtin, ok := vm.environment.GetFunction(name)
+
+			// Ensure we're permitted to call it.
+			access := Allow
+			if ok && vm.access != nil {
+				access = vm.access(name)
+			}
+
+			// If we're not, a user-defined function of the
+			// same name is called instead.
+			if _, found := vm.userFunctions[name]; found && access != Allow {
+				ok = false
+			}
+
+			if ok && fn == nil {
+				if access == Deny {
+					return nil, &DeniedError{Function: name}
+				}
+				if access == Stub {
+					vm.stack.Push(Null)
+					break
+				}
+
+				// Call the function.
+				ret, err := vm.callBuiltin(name, builtin, fnArgs)
+				if err != nil {
+					return nil, err
+				}
+
+				// Ensure the result isn't too large.
+				err = vm.checkSize(sizeOf(ret))
+				if err != nil {
+					return nil, err
+				}
 
 				// store the result back on the stack - unless
 				// it's a weird one.
@@ -590,109 +1193,121 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			// Function isn't a built-in, so now we need to see
 			// if it is a user-defined function.
-			val, ok2 := vm.functions[name]
-			if !ok2 {
-				return nil, fmt.Errorf("the function %s does not exist", name)
+			if f, ok := vm.userFunctions[name]; fn == nil && ok {
+				fn = f
 			}
 
-			// Save IP + bytecode
-			oldIP := ip
-			oldBytecode := vm.bytecode
-			oldStack := vm.stack
-
-			vm.stack = stack.New()
-			vm.environment.AddScope()
+			// Finally it might be a global variable which holds
+			// a function-value.
+			if v, ok := vm.environment.Get(name); fn == nil && ok {
+				fn, _ = v.(*object.Function)
+			}
 
-			// switch so that we're interpreting the bytecode
-			// of the compiled function-body.
-			vm.bytecode = val.Bytecode
+			if fn == nil {
+				return nil, fmt.Errorf("the function %s does not exist", name)
+			}
 
-			// Sanity-check we have enough arguments
-			if len(val.Arguments) != len(fnArgs) {
-				return nil, fmt.Errorf("mismatch in argument-counts for %s, expected %d but got %d", name, len(val.Arguments), len(fnArgs))
+			// Ensure we've not nested too deeply.
+			depth := vm.limits.CallDepth
+			if depth <= 0 {
+				depth = DefaultCallDepth
+			}
+			if len(vm.frames) >= depth {
+				return nil, &LimitError{Limit: CallLimit, Max: depth}
 			}
 
-			// Now for each arg we set the value
-			for i, name := range val.Arguments {
-				vm.environment.SetLocal(name, fnArgs[i])
+			// Sanity-check we have enough arguments
+			if len(fn.Arguments) != len(fnArgs) {
+				return nil, fmt.Errorf("mismatch in argument-counts for %s, expected %d but got %d", name, len(fn.Arguments), len(fnArgs))
 			}
 
-			// Run ourselves against that new bytecode.
+			// Save our state, so we can resume after the
+			// call returns.
+			vm.frames = append(vm.frames, frame{
+				bytecode:  bytecode,
+				positions: positions,
+				ip:        ip + opLen,
+				stack:     vm.stack,
+				locals:    vm.locals,
+				outer:     vm.outer,
+			})
+
+			// The function gets its own stack, and its own
+			// local variables - the first of which are its
+			// arguments.
 			//
-			// This is a bit horrid.
-			out, err := vm.Run(obj)
-
-			// Did we get an error?  If so return it
-			if err != nil {
-				return nil, err
+			// It can also see the local variables it captured
+			// when it was created, if any.
+			locals := fn.Locals
+			if locals < len(fnArgs) {
+				locals = len(fnArgs)
 			}
+			vm.stack = stack.New()
+			vm.locals = make([]object.Object, locals)
+			copy(vm.locals, fnArgs)
+			vm.outer = fn.Outer
 
-			// Otherwise we're going to keep running from
-			// where we left off - resetting the state of
-			// our stack, instruction-pointer, and bytecode.
-			ip = oldIP
-			vm.bytecode = oldBytecode
-			vm.stack = oldStack
+			// Now run the compiled function-body.
+			bytecode, positions, ip, ln = fn.Bytecode, fn.Positions, 0, len(fn.Bytecode)
+			continue
+
+			// Create a function-value, capturing the local
+			// variables which are currently visible.
+		case code.OpClosure:
 
-			// Put the return-value on the stack
-			if out.Type() != object.VOID {
-				vm.stack.Push(out)
+			if opArg >= len(vm.constants) {
+				return nil, fmt.Errorf("access to constant which doesn't exist")
 			}
 
-			// Drop the scope which means function-arguments
-			// are dropped.
-			err = vm.environment.RemoveScope()
-			if err != nil {
-				return nil, err
+			fn, ok := vm.constants[opArg].(*object.Function)
+			if !ok {
+				return nil, fmt.Errorf("%s requires a function, got %s", code.String(op), vm.constants[opArg].Type())
 			}
 
-			// reset the state of an object which is to be iterated upon
+			// The function can see our local variables, and
+			// those we can see ourselves.
+			outer := make([][]object.Object, len(vm.outer), len(vm.outer)+1)
+			copy(outer, vm.outer)
+
+			vm.stack.Push(&object.Function{
+				Arguments: fn.Arguments,
+				Bytecode:  fn.Bytecode,
+				Positions: fn.Positions,
+				Locals:    fn.Locals,
+				Outer:     append(outer, vm.locals),
+			})
+
+			// create an iterator over an object
 		case code.OpIterationReset:
 
-			// Create a scoped environment
-			vm.environment.AddScope()
 			// get object we're iterating over..
 			out, err := vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
 
-			// Cast it to the interface.
-			helper, ok := out.(object.Iterable)
-			if !ok {
-				return nil, fmt.Errorf("%s object doesn't implement the Iterable interface", out.Type())
+			// Create a new iterator, so that the object
+			// itself isn't changed, and place that upon
+			// the stack.
+			it, err := newIterator(out)
+			if err != nil {
+				return nil, err
 			}
+			vm.stack.Push(it)
 
-			// Reset it, and place back upon the stack.
-			helper.Reset()
-			vm.stack.Push(out)
-
-			// Iterate over an object that implements the Iterable interface.
+			// Advance the iterator of a foreach-loop.
 		case code.OpIterationNext:
 			//
-			// There should be three values on the stack
+			// The iterator should be upon the stack.
 			//
-			//   variable name
-			//   index name
-			//   item
-			//
-			varName, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
-			idxName, err := vm.stack.Pop()
-			if err != nil {
-				return nil, err
-			}
 			obj, err := vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
 
-			// Ensure that it is an iterable thing.
-			helper, ok := obj.(object.Iterable)
+			helper, ok := obj.(*iterator)
 			if !ok {
-				return nil, fmt.Errorf("%s object doesn't implement the Iterable interface", obj.Type())
+				return nil, fmt.Errorf("%s object is not an iterator", obj.Type())
 			}
 
 			// Get the next value, it's index, and a
@@ -701,17 +1316,12 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			if ok {
 
-				// Set the index + name
-				vm.environment.SetLocal(varName.Inspect(), ret)
-
-				idxName := idxName.Inspect()
-				if idxName != "" {
-					vm.environment.SetLocal(idxName, idx)
-				}
-
-				// Push the iterable object back upon the
-				// stack for the next loop.
+				// Push the iterator back upon the
+				// stack for the next loop, then the index
+				// and item which are to be stored.
 				vm.stack.Push(obj)
+				vm.stack.Push(idx)
+				vm.stack.Push(ret)
 
 				// And also push `True` so our loop will
 				// continue.
@@ -724,15 +1334,15 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 				// the foreach-loop.
 				//
 				vm.stack.Push(False)
+			}
 
-				// Remove our scoped environment now to
-				// discard the name/index values that
-				// might have been set.
-				err := vm.environment.RemoveScope()
-				if err != nil {
-					return nil, err
-				}
+			// A foreach-loop has been exited early.
+		case code.OpIterationEnd:
 
+			// Drop the iterator.
+			_, err := vm.stack.Pop()
+			if err != nil {
+				return nil, err
 			}
 
 			// Create an array of numbers.
@@ -767,6 +1377,11 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			// length
 			l := maxI - minI + 1
 
+			// Ensure it isn't too large, before we allocate.
+			if vm.limits.Size > 0 && l > int64(vm.limits.Size) {
+				return nil, &LimitError{Limit: SizeLimit, Max: vm.limits.Size}
+			}
+
 			// holder for elements of the correct size
 			elements := make([]object.Object, l)
 
@@ -795,7 +1410,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			name := vm.constants[opArg].Inspect()
 
 			// Lookup the current value of that object.
-			val := vm.lookup(obj, name)
+			//
+			// Numbers are mutated in-place, so work upon a copy
+			// in case the value is shared with another run.
+			val := numberCopy(vm.lookup(obj, name))
 
 			// Can we use our interface?
 			helper, ok := val.(object.Increment)
@@ -805,10 +1423,13 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			// Mutate & store
 			helper.Increase()
-			vm.environment.Set(name, val)
+			err := vm.store(obj, name, val)
+			if err != nil {
+				return nil, err
+			}
 
 			// OpInc follows OpLookup, so we can drop the value we were given
-			_, err := vm.stack.Pop()
+			_, err = vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
@@ -826,7 +1447,10 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			name := vm.constants[opArg].Inspect()
 
 			// Lookup the current value of that object.
-			val := vm.lookup(obj, name)
+			//
+			// Numbers are mutated in-place, so work upon a copy
+			// in case the value is shared with another run.
+			val := numberCopy(vm.lookup(obj, name))
 
 			// Can we use our interface?
 			helper, ok := val.(object.Decrement)
@@ -836,10 +1460,13 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 
 			// Mutate & store
 			helper.Decrease()
-			vm.environment.Set(name, val)
+			err := vm.store(obj, name, val)
+			if err != nil {
+				return nil, err
+			}
 
 			// OpDec follows OpLookup, so we can drop the value we were given
-			_, err := vm.stack.Pop()
+			_, err = vm.stack.Pop()
 			if err != nil {
 				return nil, err
 			}
@@ -852,6 +1479,11 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 			return nil, fmt.Errorf("unhandled opcode: %v %s", op, code.String(op))
 		}
 
+		// Ensure the stack hasn't grown too large.
+		if vm.limits.StackDepth > 0 && vm.stack.Size() > vm.limits.StackDepth {
+			return nil, &LimitError{Limit: StackLimit, Max: vm.limits.StackDepth}
+		}
+
 		ip += opLen
 	}
 
@@ -872,7 +1504,7 @@ func (vm *VM) Run(obj interface{}) (object.Object, error) {
 // This method is called the first time any reference is made to a field
 // value - which means we don't eat the cost unless we need it, and we
 // don't have to call reflection more than once.  (Reflection is s-l-o-w.)
-func (vm *VM) inspectObject(obj interface{}) {
+func (vm *execution) inspectObject(obj interface{}) {
 
 	//
 	// If the reference is nil we have nothing to walk.
@@ -887,214 +1519,228 @@ func (vm *VM) inspectObject(obj interface{}) {
 	val := reflect.Indirect(reflect.ValueOf(obj))
 
 	//
-	// Is this a map?
+	// A nil-pointer has nothing inside it.
 	//
-	if val.Kind() == reflect.Map {
-
-		//
-		// Get all keys in the map.
-		//
-		for _, key := range val.MapKeys() {
-
-			// The name of the key.
-			name := key.Interface().(string)
-
-			// The actual thing inside it
-			field := val.MapIndex(key).Elem()
-
-			// Convert to an object
-			ret := vm.primitiveToObject(field)
-
-			// Store it in our map
-			vm.fields[name] = ret
-		}
+	if !val.IsValid() {
 		return
 	}
 
 	//
-	// OK this is an object, so we walk over the fields within it.
+	// If this isn't a map, or a structure, there are no fields
+	// to find.
 	//
-	for i := 0; i < val.NumField(); i++ {
-
-		// Get the field
-		field := val.Field(i)
+	if val.Kind() != reflect.Map && val.Kind() != reflect.Struct {
+		return
+	}
 
-		// Get the name
-		typeField := val.Type().Field(i)
-		name := typeField.Name
+	//
+	// Convert it to a hash, including the fields that are promoted
+	// from embedded structures, and each of its entries is a field.
+	//
+	converter := &object.Converter{FieldName: vm.naming.Name, Lenient: true}
+	out, err := converter.FromValue(val)
+	if err != nil {
+		return
+	}
+	hash, ok := out.(*object.Hash)
+	if !ok {
+		return
+	}
+	for _, pair := range hash.Pairs {
+		vm.fields[pair.Key.Inspect()] = pair.Value
+	}
+}
 
-		// Convert the value to one of our objects
-		ret := vm.primitiveToObject(field)
+// callBuiltin invokes a built-in, or host, function, passing our context to
+// those which accept it.
+func (vm *execution) callBuiltin(name string, builtin interface{}, args []object.Object) (object.Object, error) {
 
-		// Store it in our map
-		vm.fields[name] = ret
+	switch fn := builtin.(type) {
+	case func(args []object.Object) object.Object:
+		return fn(args), nil
+	case func(ctx context.Context, args []object.Object) (object.Object, error):
+		ret, err := fn(vm.context, args)
+		if err != nil {
+			return nil, &FunctionError{Function: name, Err: err}
+		}
+		if ret == nil {
+			ret = Null
+		}
+		return ret, nil
 	}
+	return nil, fmt.Errorf("the function %s has an unsupported type %T", name, builtin)
 }
 
-// convert a primitive into one of our internal objects.
-func (vm *VM) primitiveToObject(field reflect.Value) object.Object {
+// leave returns from a user-defined function, restoring the state of
+// the caller and pushing the result onto its stack.
+//
+// The frame of the caller is returned, so that it may be resumed.
+func (vm *execution) leave(result object.Object) frame {
 
-	var ret object.Object
+	caller := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
 
-	//
-	// Time gets special handling
-	//
-	timeKind := reflect.TypeOf(time.Time{}).Kind()
+	// The local variables of the function are discarded, unless
+	// they were captured by a function-value it created.
+	vm.stack = caller.stack
+	vm.locals = caller.locals
+	vm.outer = caller.outer
 
-	//
-	// Invalid value?  Return null
-	//
-	if !field.IsValid() {
-		return &object.Null{}
-	}
-
-	switch field.Kind() {
-
-	case reflect.Map:
-		ret = vm.createHash(field)
-	case reflect.Slice:
-		ret = vm.createArrayFromSlice(field)
-	case reflect.Int, reflect.Int64:
-		ret = &object.Integer{Value: field.Int()}
-	case reflect.Float32, reflect.Float64:
-		ret = &object.Float{Value: field.Float()}
-	case reflect.String:
-		ret = &object.String{Value: field.String()}
-	case reflect.Bool:
-		ret = &object.Boolean{Value: field.Bool()}
-	case timeKind:
-		time, ok := field.Interface().(time.Time)
-		if ok {
-			ret = &object.Integer{Value: time.Unix()}
-		}
-	default:
-		fmt.Printf("Failed to reflect on %T\n", field.Interface())
+	// Put the return-value on the stack
+	if result.Type() != object.VOID {
+		vm.stack.Push(result)
 	}
+	return caller
+}
 
-	return ret
+// outerLocals returns the local variables of the enclosing function
+// which is referred to by the argument of OpGetOuter, or OpSetOuter.
+//
+// The depth is stored in the high 16-bits of the argument, and the slot
+// in the low 16-bits.
+func (vm *execution) outerLocals(arg int) ([]object.Object, error) {
+	depth := arg >> 16
+	slot := arg & 0xFFFF
+
+	if depth < 1 || depth > len(vm.outer) || slot >= len(vm.outer[len(vm.outer)-depth]) {
+		return nil, fmt.Errorf("local variable %d of enclosing function %d doesn't exist", slot, depth)
+	}
+	return vm.outer[len(vm.outer)-depth], nil
 }
 
-// create one of our internal hash-objects via reflection.
+// executeSetIndex pushes a copy of the given array or hash, with the
+// element at the given index replaced by the given value.
 //
-// This may well recurse.
-func (vm *VM) createHash(field reflect.Value) object.Object {
-	hashedPairs := make(map[object.HashKey]object.HashPair)
+// We update a copy, rather than the object itself, because it might be
+// shared with other variables, or with other runs of the script.
+func (vm *execution) executeSetIndex(left, index, value object.Object) error {
+
+	switch obj := left.(type) {
+	case *object.Array:
+		if index.Type() != object.INTEGER {
+			return fmt.Errorf("index operator must be given an integer, not %s", index.Type())
+		}
 
-	for _, key := range field.MapKeys() {
+		// bounds-check
+		idx := index.(*object.Integer).Value
+		if idx < 0 || idx >= int64(len(obj.Elements)) {
+			return fmt.Errorf("index %d is out of range for an array of length %d", idx, len(obj.Elements))
+		}
 
-		// Get the key value - note this supports way more
-		// than we allow here.  (As not all of our objects
-		// can be used as hash-keys.)
-		k := vm.primitiveToObject(key)
+		elements := make([]object.Object, len(obj.Elements))
+		copy(elements, obj.Elements)
+		elements[idx] = value
 
-		// The actual thing inside it.
-		val := field.MapIndex(key).Elem()
+		vm.stack.Push(&object.Array{Elements: elements})
 
-		// Get the value.
-		v := vm.primitiveToObject(val)
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
 
-		pair := object.HashPair{Key: k, Value: v}
-		hashedPairs[k.(object.Hashable).HashKey()] = pair
-	}
+		pairs := make(map[object.HashKey]object.HashPair, len(obj.Pairs)+1)
+		for k, v := range obj.Pairs {
+			pairs[k] = v
+		}
+		pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
 
-	return &object.Hash{Pairs: hashedPairs}
-}
+		// Ensure it isn't too large.
+		err := vm.checkSize(len(pairs))
+		if err != nil {
+			return err
+		}
 
-// createArrayFromSlice creates an object.Array value from the
-// given object/map slice
-//
-// This may well recurse.
-func (vm *VM) createArrayFromSlice(field reflect.Value) object.Object {
+		vm.stack.Push(&object.Hash{Pairs: pairs})
 
-	// Elements we've found
-	var el []object.Object
+	default:
+		return fmt.Errorf("index assignment can only be applied to arrays and hashes, not %s", left.Type())
+	}
 
-	// Find the length of the slice
-	l := field.Len()
+	return nil
+}
 
-	// For each entry
-	for i := 0; i < l; i++ {
+// checkSize ensures that an object of the given size, the number of
+// elements in an array or hash, or bytes in a string, doesn't exceed
+// our size-limit.
+func (vm *execution) checkSize(size int) error {
+	if vm.limits.Size > 0 && size > vm.limits.Size {
+		return &LimitError{Limit: SizeLimit, Max: vm.limits.Size}
+	}
+	return nil
+}
 
-		// Cast the array-member to an interface
-		in := field.Index(i).Interface()
+// sizeOf returns the size of the given object, as enforced by checkSize.
+func sizeOf(obj object.Object) int {
+	switch obj := obj.(type) {
+	case *object.Array:
+		return len(obj.Elements)
+	case *object.Hash:
+		return len(obj.Pairs)
+	case *object.String:
+		return len(obj.Value)
+	}
+	return 0
+}
 
-		//
-		// Now we're in horrible-land
-		//
-		// We want to work out the type of the
-		// array-member.  Of course every member
-		// will have the same type, unless we're
-		// in the case of an array of interfaces.
-		//
-		// The following code will try to cast
-		// to all "reasonable" values, which will
-		// cover either case.
-		//
-		// It is still horrible though, and that
-		// should be noted.
-		//
+// iterator holds the state of a foreach-loop, and is stored upon the
+// stack while the loop runs.
+type iterator struct {
+	object.Iterator
+}
 
-		// Is it a string?
-		s, ok := in.(string)
-		if ok {
-			el = append(el, &object.String{Value: s})
-			continue
-		}
+// newIterator creates an iterator over the given object.
+//
+// Objects which implement the deprecated Iterable interface are still
+// supported, but they're reset and iterated over in-place.
+func newIterator(obj object.Object) (*iterator, error) {
+	switch helper := obj.(type) {
+	case object.IteratorProvider:
+		return &iterator{Iterator: helper.Iterator()}, nil
+	case object.Iterable:
+		helper.Reset()
+		return &iterator{Iterator: helper}, nil
+	}
+	return nil, fmt.Errorf("%s object doesn't implement the Iterable interface", obj.Type())
+}
 
-		// Is it a bool?
-		b, ok := in.(bool)
-		if ok {
-			el = append(el, &object.Boolean{Value: b})
-			continue
-		}
+// Type returns the type of this object.
+func (it *iterator) Type() object.Type {
+	return "ITERATOR"
+}
 
-		// is it a float?
-		f, ok := in.(float32)
-		if ok {
-			el = append(el, &object.Float{Value: float64(f)})
-			continue
-		}
-		ff, ok := in.(float64)
-		if ok {
-			el = append(el, &object.Float{Value: ff})
-			continue
-		}
+// Inspect returns a string-representation of the given object.
+func (it *iterator) Inspect() string {
+	return "<iterator>"
+}
 
-		// is it an integer?
-		d, ok := in.(int)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(d)})
-			continue
-		}
-		dd, ok := in.(int32)
-		if ok {
-			el = append(el, &object.Integer{Value: int64(dd)})
-			continue
-		}
-		ddd, ok := in.(int64)
-		if ok {
-			el = append(el, &object.Integer{Value: ddd})
-			continue
-		}
+// True returns whether this object wraps a true-like value.
+func (it *iterator) True() bool {
+	return true
+}
 
-		// Is it a time value?
-		tm, ok := in.(time.Time)
-		if ok {
-			el = append(el, &object.Integer{Value: tm.Unix()})
-			continue
-		}
+// ToInterface converts this object to a go-interface.
+func (it *iterator) ToInterface() interface{} {
+	return nil
+}
 
-		fmt.Printf("Failed to convert array-member to object")
+// numberCopy returns a copy of the given number, so that it may be
+// incremented or decremented without affecting other runs.
+func numberCopy(obj object.Object) object.Object {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: obj.Value}
+	case *object.Float:
+		return &object.Float{Value: obj.Value}
 	}
-
-	return &object.Array{Elements: el}
+	return obj
 }
 
 // Execute an operation against two arguments, i.e "foo == bar", "2 + 3", etc.
 //
 // This is a crazy-big function, because we have to cope with different operand
 // types and operators.
-func (vm *VM) executeBinaryOperation(op code.Opcode) error {
+func (vm *execution) executeBinaryOperation(op code.Opcode) error {
 	var left object.Object
 	var right object.Object
 	var err error
@@ -1171,6 +1817,10 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		vm.stack.Push(False)
 		return nil
 
+	case left.Type() == object.TIME || right.Type() == object.TIME:
+		return vm.evalTimeInfixExpression(op, left, right)
+	case left.Type() == object.DURATION || right.Type() == object.DURATION:
+		return vm.evalDurationInfixExpression(op, left, right)
 	case left.Type() == object.BOOLEAN && right.Type() == object.BOOLEAN:
 		return vm.evalBooleanInfixExpression(op, left, right)
 	case left.Type() != right.Type():
@@ -1183,7 +1833,7 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 }
 
 // integer OP integer
-func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
+func (vm *execution) evalIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
 
@@ -1223,7 +1873,7 @@ func (vm *VM) evalIntegerInfixExpression(op code.Opcode, left, right object.Obje
 }
 
 // float OP float
-func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
+func (vm *execution) evalFloatInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Float).Value
 	rightVal := right.(*object.Float).Value
 
@@ -1263,7 +1913,7 @@ func (vm *VM) evalFloatInfixExpression(op code.Opcode, left, right object.Object
 }
 
 // float OP int
-func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
+func (vm *execution) evalFloatIntegerInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := left.(*object.Float).Value
 	rightVal := float64(right.(*object.Integer).Value)
 
@@ -1303,7 +1953,7 @@ func (vm *VM) evalFloatIntegerInfixExpression(op code.Opcode, left, right object
 }
 
 // int OP float
-func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object.Object) error {
+func (vm *execution) evalIntegerFloatInfixExpression(op code.Opcode, left, right object.Object) error {
 	leftVal := float64(left.(*object.Integer).Value)
 	rightVal := right.(*object.Float).Value
 
@@ -1343,7 +1993,7 @@ func (vm *VM) evalIntegerFloatInfixExpression(op code.Opcode, left, right object
 }
 
 // string OP string
-func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
+func (vm *execution) evalStringInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
 	l := left.(*object.String)
 	r := right.(*object.String)
 
@@ -1361,6 +2011,10 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 	case code.OpLess:
 		vm.stack.Push(vm.nativeBoolToBooleanObject(l.Value < r.Value))
 	case code.OpAdd:
+		err := vm.checkSize(len(l.Value) + len(r.Value))
+		if err != nil {
+			return err
+		}
 		vm.stack.Push(&object.String{Value: l.Value + r.Value})
 	case code.OpArrayIn:
 		if strings.Contains(r.Value, l.Value) {
@@ -1375,48 +2029,288 @@ func (vm *VM) evalStringInfixExpression(op code.Opcode, left object.Object, righ
 	return nil
 }
 
-func (vm *VM) evalStringRegexpExpression(op code.Opcode, left object.Object, right object.Object) error {
+func (vm *execution) evalStringRegexpExpression(op code.Opcode, left object.Object, right object.Object) error {
 	l := left.(*object.String)
 	r := right.(*object.Regexp)
 
 	switch op {
 	case code.OpMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
+		matched, err := vm.match(l, r)
+		if err != nil {
+			return err
+		}
+		vm.stack.Push(vm.nativeBoolToBooleanObject(matched))
+	case code.OpNotMatches:
+		matched, err := vm.match(l, r)
+		if err != nil {
+			return err
 		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!matched))
+	default:
+		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+	}
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(True)
-		} else {
-			vm.stack.Push(False)
+	return nil
+}
+
+// match tests a string against a regular expression, for the `~=` and
+// `!~` operators and `case` statements, recording the text which matched
+// and that of each capture group.
+//
+// Our built-in `match` function finds the captures as it matches, but if
+// the host-application has replaced it we invoke the replacement, and
+// find the captures afterwards if it reports a match.
+func (vm *execution) match(str object.Object, reg object.Object) (bool, error) {
+
+	fn, ok := vm.environment.GetFunction("match")
+	if !ok {
+		return false, fmt.Errorf("failed to lookup match-function")
+	}
+
+	if vm.environment.Builtin("match") {
+		m, err := environment.Captures(str.Inspect(), reg)
+		if err != nil {
+			return false, &FunctionError{Function: "match", Err: err}
 		}
-	case code.OpNotMatches:
-		args := []object.Object{l, r}
-		fn, ok := vm.environment.GetFunction("match")
-		if !ok {
-			return (fmt.Errorf("failed to lookup match-function"))
+		vm.captures = m
+		return m != nil, nil
+	}
+
+	ret, err := vm.callBuiltin("match", fn, []object.Object{str, reg})
+	if err != nil {
+		return false, err
+	}
+	result, ok := ret.(*object.Boolean)
+	if !ok {
+		return false, fmt.Errorf("the function match returned %s, rather than a boolean", ret.Type())
+	}
+
+	vm.captures = nil
+	if result.Value {
+		vm.captures, err = environment.Captures(str.Inspect(), reg)
+		if err != nil {
+			return false, &FunctionError{Function: "match", Err: err}
 		}
-		out := fn.(func(args []object.Object) object.Object)
-		ret := out(args)
+	}
+	return result.Value, nil
+}
 
-		if ret.(*object.Boolean).Value {
-			vm.stack.Push(False)
-		} else {
-			vm.stack.Push(True)
+// time OP time, time OP duration, and time OP integer.
+//
+// Integers are treated as Unix epoch seconds, or as a number of seconds
+// when added or subtracted, for compatibility with scripts written when
+// times were represented that way.
+func (vm *execution) evalTimeInfixExpression(op code.Opcode, left, right object.Object) error {
+
+	switch l := left.(type) {
+
+	case *object.Time:
+		switch r := right.(type) {
+		case *object.Time:
+			if op == code.OpSub {
+				vm.stack.Push(&object.Duration{Value: l.Value.Sub(r.Value)})
+				return nil
+			}
+			if vm.evalComparison(op, compareTimes(l.Value, r.Value)) {
+				return nil
+			}
+		case *object.Duration:
+			switch op {
+			case code.OpAdd:
+				vm.stack.Push(&object.Time{Value: l.Value.Add(r.Value)})
+				return nil
+			case code.OpSub:
+				vm.stack.Push(&object.Time{Value: l.Value.Add(-r.Value)})
+				return nil
+			}
+		case *object.Integer:
+			switch op {
+			case code.OpAdd:
+				vm.stack.Push(&object.Time{Value: l.Value.Add(time.Duration(r.Value) * time.Second)})
+				return nil
+			case code.OpSub:
+				vm.stack.Push(&object.Time{Value: l.Value.Add(-time.Duration(r.Value) * time.Second)})
+				return nil
+			}
+			if vm.evalComparison(op, compareInts(l.Value.Unix(), r.Value)) {
+				return nil
+			}
+		}
+
+	case *object.Duration:
+		if r, ok := right.(*object.Time); ok && op == code.OpAdd {
+			vm.stack.Push(&object.Time{Value: r.Value.Add(l.Value)})
+			return nil
+		}
+
+	case *object.Integer:
+		if r, ok := right.(*object.Time); ok {
+			if op == code.OpAdd {
+				vm.stack.Push(&object.Time{Value: r.Value.Add(time.Duration(l.Value) * time.Second)})
+				return nil
+			}
+			if vm.evalComparison(op, compareInts(l.Value, r.Value.Unix())) {
+				return nil
+			}
+		}
+	}
+
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s", left.Type(), code.String(op), right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type())
+}
+
+// duration OP duration, and duration OP number.
+//
+// Durations may be scaled by numbers, and compared with integers which
+// are treated as a number of seconds.  Integers may also be Unix epoch
+// seconds which a duration is added to, or subtracted from.
+func (vm *execution) evalDurationInfixExpression(op code.Opcode, left, right object.Object) error {
+
+	switch l := left.(type) {
+
+	case *object.Duration:
+		switch r := right.(type) {
+		case *object.Duration:
+			switch op {
+			case code.OpAdd:
+				vm.stack.Push(&object.Duration{Value: l.Value + r.Value})
+				return nil
+			case code.OpSub:
+				vm.stack.Push(&object.Duration{Value: l.Value - r.Value})
+				return nil
+			case code.OpDiv:
+				if r.Value == 0 {
+					return fmt.Errorf("attempted division by zero: %s / %s", l.Inspect(), r.Inspect())
+				}
+				vm.stack.Push(&object.Float{Value: float64(l.Value) / float64(r.Value)})
+				return nil
+			case code.OpMod:
+				if r.Value == 0 {
+					return fmt.Errorf("attempted division by zero: %s %% %s", l.Inspect(), r.Inspect())
+				}
+				vm.stack.Push(&object.Duration{Value: l.Value % r.Value})
+				return nil
+			}
+			if vm.evalComparison(op, compareInts(int64(l.Value), int64(r.Value))) {
+				return nil
+			}
+		case *object.Integer:
+			switch op {
+			case code.OpMul:
+				vm.stack.Push(&object.Duration{Value: l.Value * time.Duration(r.Value)})
+				return nil
+			case code.OpDiv:
+				if r.Value == 0 {
+					return fmt.Errorf("attempted division by zero: %s / %d", l.Inspect(), r.Value)
+				}
+				vm.stack.Push(&object.Duration{Value: l.Value / time.Duration(r.Value)})
+				return nil
+			}
+			if vm.evalComparison(op, compareInts(int64(l.Value), int64(time.Duration(r.Value)*time.Second))) {
+				return nil
+			}
+		case *object.Float:
+			switch op {
+			case code.OpMul:
+				vm.stack.Push(&object.Duration{Value: time.Duration(float64(l.Value) * r.Value)})
+				return nil
+			case code.OpDiv:
+				if r.Value == 0 {
+					return fmt.Errorf("attempted division by zero: %s / %f", l.Inspect(), r.Value)
+				}
+				vm.stack.Push(&object.Duration{Value: time.Duration(float64(l.Value) / r.Value)})
+				return nil
+			}
+		}
+
+	case *object.Integer:
+		r := right.(*object.Duration)
+		switch op {
+		case code.OpMul:
+			vm.stack.Push(&object.Duration{Value: time.Duration(l.Value) * r.Value})
+			return nil
+		case code.OpAdd:
+			vm.stack.Push(&object.Integer{Value: l.Value + int64(r.Value/time.Second)})
+			return nil
+		case code.OpSub:
+			vm.stack.Push(&object.Integer{Value: l.Value - int64(r.Value/time.Second)})
+			return nil
+		}
+		if vm.evalComparison(op, compareInts(int64(time.Duration(l.Value)*time.Second), int64(r.Value))) {
+			return nil
+		}
+
+	case *object.Float:
+		if r, ok := right.(*object.Duration); ok && op == code.OpMul {
+			vm.stack.Push(&object.Duration{Value: time.Duration(l.Value * float64(r.Value))})
+			return nil
 		}
+	}
+
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s", left.Type(), code.String(op), right.Type())
+	}
+	return fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type())
+}
+
+// evalComparison pushes the result of a comparison, given the sign of
+// the difference between the two values being compared.
+//
+// If the operation isn't a comparison nothing is pushed, and we return
+// false.
+func (vm *execution) evalComparison(op code.Opcode, cmp int) bool {
+
+	var res bool
+
+	switch op {
+	case code.OpLess:
+		res = cmp < 0
+	case code.OpLessEqual:
+		res = cmp <= 0
+	case code.OpGreater:
+		res = cmp > 0
+	case code.OpGreaterEqual:
+		res = cmp >= 0
+	case code.OpEqual:
+		res = cmp == 0
+	case code.OpNotEqual:
+		res = cmp != 0
 	default:
-		return (fmt.Errorf("unknown operator: %s %s %s", left.Type(), code.String(op), right.Type()))
+		return false
 	}
 
-	return nil
+	vm.stack.Push(vm.nativeBoolToBooleanObject(res))
+	return true
+}
+
+// compareInts returns -1, 0, or 1 depending on whether a is less than,
+// equal to, or greater than b.
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareTimes returns -1, 0, or 1 depending on whether a is before, the
+// same instant as, or after b.
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
 }
 
 // bool OP bool
-func (vm *VM) evalBooleanInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
+func (vm *execution) evalBooleanInfixExpression(op code.Opcode, left object.Object, right object.Object) error {
 	// convert the bools to strings.
 	l := &object.String{Value: left.Inspect()}
 	r := &object.String{Value: right.Inspect()}
@@ -1430,18 +2324,18 @@ func (vm *VM) evalBooleanInfixExpression(op code.Opcode, left object.Object, rig
 }
 
 // Implement the "!" (prefix) operator.
-func (vm *VM) executeBangOperator() error {
+func (vm *execution) executeBangOperator() error {
 	operand, err := vm.stack.Pop()
 	if err != nil {
 		return err
 	}
 
-	switch operand {
-	case True:
-		vm.stack.Push(False)
-	case False:
-		vm.stack.Push(True)
-	case Null:
+	// Booleans, and null, may be created by host functions, or
+	// via reflection, so we can't just compare with our constants.
+	switch obj := operand.(type) {
+	case *object.Boolean:
+		vm.stack.Push(vm.nativeBoolToBooleanObject(!obj.Value))
+	case *object.Null:
 		vm.stack.Push(True)
 	default:
 		vm.stack.Push(False)
@@ -1450,7 +2344,7 @@ func (vm *VM) executeBangOperator() error {
 }
 
 // Allow negative numbers.
-func (vm *VM) executeMinusOperator() error {
+func (vm *execution) executeMinusOperator() error {
 	operand, err := vm.stack.Pop()
 	if err != nil {
 		return err
@@ -1462,6 +2356,8 @@ func (vm *VM) executeMinusOperator() error {
 		res = &object.Integer{Value: -obj.Value}
 	case *object.Float:
 		res = &object.Float{Value: -obj.Value}
+	case *object.Duration:
+		res = &object.Duration{Value: -obj.Value}
 	default:
 		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
@@ -1471,7 +2367,7 @@ func (vm *VM) executeMinusOperator() error {
 }
 
 // The square root operation is just too cute :).
-func (vm *VM) executeSquareRoot() error {
+func (vm *execution) executeSquareRoot() error {
 	operand, err := vm.stack.Pop()
 	if err != nil {
 		return err
@@ -1499,8 +2395,53 @@ func (vm *VM) nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return False
 }
 
+// CaptureGroup returns the number of the regular expression capture group
+// the given variable refers to, if it is one of `$0`, `$1`, etc.
+func CaptureGroup(name string) (int, bool) {
+
+	if len(name) < 2 || name[0] != '$' {
+		return 0, false
+	}
+	for _, c := range name[1:] {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.Atoi(name[1:])
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// store sets the value of a variable, by name, or updates the field of the
+// object we're run against if writing back is enabled.
+func (vm *execution) store(obj interface{}, name string, val object.Object) error {
+
+	if vm.writeBack {
+		written, err := vm.writeField(obj, name, val)
+		if err != nil || written {
+			return err
+		}
+	}
+
+	vm.environment.Set(name, val)
+	return nil
+}
+
 // lookup the name of the given field/map-member.
-func (vm *VM) lookup(obj interface{}, name string) object.Object {
+func (vm *execution) lookup(obj interface{}, name string) object.Object {
+
+	//
+	// "$0", "$1", etc, refer to the most recent regexp match.
+	//
+	if n, ok := CaptureGroup(name); ok {
+		if n < len(vm.captures) {
+			return &object.String{Value: vm.captures[n]}
+		}
+		return Null
+	}
 
 	//
 	// Remove legacy "$" prefix, if present.
@@ -1531,6 +2472,13 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 		return cached
 	}
 
+	//
+	// A user-defined function may be used as a value.
+	//
+	if fn, found := vm.userFunctions[name]; found {
+		return fn
+	}
+
 	//
 	// If it was not found it is an unknown/unset value.
 	//
@@ -1538,7 +2486,7 @@ func (vm *VM) lookup(obj interface{}, name string) object.Object {
 }
 
 // executeIndexExpression performs a string/array indexing operation.
-func (vm *VM) executeIndexExpression(left, index object.Object) error {
+func (vm *execution) executeIndexExpression(left, index object.Object) error {
 
 	// Check arguments
 	if left.Type() != object.ARRAY && left.Type() != object.HASH && left.Type() != object.STRING {
@@ -1591,7 +2539,7 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	return nil
 }
 
-func (vm *VM) executeHashIndex(hash, index object.Object) error {
+func (vm *execution) executeHashIndex(hash, index object.Object) error {
 	hashObject := hash.(*object.Hash)
 
 	key, ok := index.(object.Hashable)
@@ -1627,34 +2575,19 @@ func (vm *VM) walkBytecodeHelper(bytecode code.Instructions, callback BytecodeVi
 	for ip < ln {
 
 		//
-		// Get the next opcode
-		//
-		op := code.Opcode(bytecode[ip])
-
-		//
-		// Find out how long it is.
-		//
-		opLen := code.Length(op)
-
+		// Get the next opcode, its argument, and its length.
 		//
-		// If the opcode is more than a single byte long we read the argument here.
+		// An OpWide prefix is skipped over, so the callback
+		// sees the opcode which follows it along with the
+		// offset of the prefix.
 		//
-		opArg := 0
-		if opLen > 1 {
-
-			//
-			// Note in the future we might have to cope
-			// with opcodes with more than a single argument,
-			// and they might be different sizes.
-			//
-			opArg = int(binary.BigEndian.Uint16(bytecode[ip+1 : ip+3]))
-		}
+		op, opArg, opLen := code.Read(bytecode, ip)
 
 		var err error
 		var ret bool
 
 		// Pass either the argument, or nil.
-		if opLen > 1 {
+		if code.Length(op) > 1 {
 			ret, err = callback(ip, op, opArg)
 		} else {
 			ret, err = callback(ip, op, nil)
@@ -1706,3 +2639,22 @@ func (vm *VM) WalkFunctionBytecode(name string, callback BytecodeVisitor) error
 	//
 	return (vm.walkBytecodeHelper(fun.Bytecode, callback))
 }
+
+// WalkConstantBytecode invokes the specified callback function upon every
+// instruction in the bytecode of the anonymous function which is stored
+// in the given constant.
+//
+// This is primarily used for the implementation of the Dump command in our
+// evalfilter package.
+func (vm *VM) WalkConstantBytecode(index int, callback BytecodeVisitor) error {
+	if index < 0 || index >= len(vm.constants) {
+		return fmt.Errorf("constant not found %d", index)
+	}
+
+	fun, ok := vm.constants[index].(*object.Function)
+	if !ok {
+		return fmt.Errorf("constant %d is not a function", index)
+	}
+
+	return (vm.walkBytecodeHelper(fun.Bytecode, callback))
+}
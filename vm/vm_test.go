@@ -61,7 +61,7 @@ type TestCase struct {
 
 func TestBool(t *testing.T) {
 
-	vm := New(nil, nil, nil, environment.New())
+	vm := New(nil, nil, nil, nil, environment.New())
 	tb := vm.nativeBoolToBooleanObject(true)
 	fb := vm.nativeBoolToBooleanObject(false)
 
@@ -97,7 +97,7 @@ func TestContextTimeout(t *testing.T) {
 	defer cancel()
 
 	// Create
-	vm := New(constants, bytecode, functions, env)
+	vm := New(constants, bytecode, nil, functions, env)
 	vm.SetContext(ctx)
 
 	// Run
@@ -316,6 +316,19 @@ func TestOpBang(t *testing.T) {
 			error:  false,
 		},
 
+		// !false -> true, for a boolean which isn't our constant
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), // 0x00
+				byte(0),               // 0x01
+				byte(1),               // 0x02
+				byte(code.OpBang),     // 0x03
+				byte(code.OpReturn),   // 0x04
+			},
+			result: "true",
+			error:  false,
+		},
+
 		// Test empty stack
 		{
 			program: code.Instructions{
@@ -328,6 +341,7 @@ func TestOpBang(t *testing.T) {
 
 	constants := []object.Object{
 		&object.String{Value: "Steve"},
+		&object.Boolean{Value: false},
 	}
 
 	RunTestCases(tests, constants, t)
@@ -348,13 +362,9 @@ func TestOpCall(t *testing.T) {
 	// bang returns the inverse of the input value
 	functions["bang"] = environment.UserFunction{
 		Bytecode: code.Instructions{
-			byte(code.OpLookup),
+			byte(code.OpGetLocal),
 			byte(0),
-			byte(4), // "input"
-			byte(code.OpLocal),
-			byte(code.OpLookup),
-			byte(0),
-			byte(4), // "input"
+			byte(0), // "input"
 			byte(code.OpBang),
 			byte(code.OpReturn),
 		},
@@ -364,16 +374,27 @@ func TestOpCall(t *testing.T) {
 	// error tries to pop from an empty stack.
 	functions["error"] = environment.UserFunction{
 		Bytecode: code.Instructions{
-			byte(code.OpLocal),
+			byte(code.OpSetLocal),
+			byte(0),
+			byte(0),
 			byte(code.OpReturn),
 		},
 	}
 
+	// end has no return-statement, so gives null.
+	functions["end"] = environment.UserFunction{
+		Bytecode: code.Instructions{
+			byte(code.OpTrue),
+		},
+	}
+
 	tests := []TestCase{
 
 		// empty stack
 		{program: code.Instructions{
-			byte(code.OpLocal), // 0x00
+			byte(code.OpSetLocal), // 0x00
+			byte(0),               // 0x01
+			byte(0),               // 0x02 -> slot
 		}, result: "Pop from an empty stack", error: true},
 
 		// empty stack
@@ -516,6 +537,22 @@ func TestOpCall(t *testing.T) {
 			result:    "true",
 			error:     false,
 		},
+		// call: end(), then return the caller's value
+		{
+			program: code.Instructions{
+				byte(code.OpFalse),
+				byte(code.OpConstant), // "end"
+				byte(0),
+				byte(6),
+				byte(code.OpCall),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			functions: functions,
+			result:    "null",
+			error:     false,
+		},
 	}
 
 	// Constants
@@ -525,6 +562,7 @@ func TestOpCall(t *testing.T) {
 		&object.String{Value: "bang"},  // user defined fun
 		&object.String{Value: "input"}, // input param to bang()
 		&object.String{Value: "error"}, // user defined fun
+		&object.String{Value: "end"},   // user defined fun
 	}
 
 	RunTestCases(tests, constants, t)
@@ -648,6 +686,61 @@ func TestOpCase(t *testing.T) {
 	RunTestCases(tests, constants, t)
 }
 
+func TestOpClosure(t *testing.T) {
+
+	tests := []TestCase{
+
+		// missing constant
+		{
+			program: code.Instructions{
+				byte(code.OpClosure),
+				byte(0),
+				byte(10),
+				byte(code.OpReturn),
+			},
+			result: "access to constant which doesn't exist",
+			error:  true,
+		},
+
+		// not a function
+		{
+			program: code.Instructions{
+				byte(code.OpClosure),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			result: "OpClosure requires a function, got STRING",
+			error:  true,
+		},
+
+		// create a function, and call it
+		{
+			program: code.Instructions{
+				byte(code.OpClosure),
+				byte(0),
+				byte(1),
+				byte(code.OpCall),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			result: "true",
+			error:  false,
+		},
+	}
+
+	fn := &object.Function{
+		Bytecode: code.Instructions{
+			byte(code.OpTrue),
+			byte(code.OpReturn),
+		},
+	}
+	constants := []object.Object{&object.String{Value: "Steve"}, fn}
+
+	RunTestCases(tests, constants, t)
+}
+
 func TestOpConstant(t *testing.T) {
 
 	tests := []TestCase{
@@ -1200,47 +1293,24 @@ func TestOpIterationNext(t *testing.T) {
 
 	tests := []TestCase{
 
-		// OpIterationNext requires three stack entries: give it none
-		{
-			program: code.Instructions{
-				byte(code.OpIterationNext),
-			},
-			error:  true,
-			result: "Pop from an empty stack",
-		},
-
-		// OpIterationNext requires three stack entries: give it one
-		{
-			program: code.Instructions{
-				byte(code.OpTrue),
-				byte(code.OpIterationNext),
-			},
-			error:  true,
-			result: "Pop from an empty stack",
-		},
-
-		// OpIterationNext requires three stack entries: give it two
+		// OpIterationNext requires a stack entry: give it none
 		{
 			program: code.Instructions{
-				byte(code.OpTrue),
-				byte(code.OpTrue),
 				byte(code.OpIterationNext),
 			},
 			error:  true,
 			result: "Pop from an empty stack",
 		},
 
-		// OpIterationNext requires three stack entries: give it three,
-		// but not an iterable thing.
+		// OpIterationNext requires a stack entry: give it one,
+		// but not an iterator.
 		{
 			program: code.Instructions{
-				byte(code.OpTrue),
-				byte(code.OpTrue),
 				byte(code.OpTrue),
 				byte(code.OpIterationNext),
 			},
 			error:  true,
-			result: "object doesn't implement the Iterable interface",
+			result: "object is not an iterator",
 		},
 		// iterate over characters in a string
 		{
@@ -1249,25 +1319,25 @@ func TestOpIterationNext(t *testing.T) {
 				byte(0),                     // 0x01
 				byte(0),                     // 0x02 -> "Steve"
 				byte(code.OpIterationReset), // 0x03
-				byte(code.OpConstant),       // 0x04 XXXX:
-				byte(0),                     // 0x05
-				byte(1),                     // 0x06 -> "i"
-				byte(code.OpConstant),       // 0x07
-				byte(0),                     // 0x08
-				byte(2),                     // 0x09 -> "c"
-				byte(code.OpIterationNext),  // 0x0A
-				byte(code.OpJumpIfFalse),    // 0x0B
+				byte(code.OpIterationNext),  // 0x04 XXXX:
+				byte(code.OpJumpIfFalse),    // 0x05
+				byte(0),                     // 0x06
+				byte(32),                    // 0x07 -> YYYY
+				byte(code.OpSetLocal),       // 0x08
+				byte(0),                     // 0x09
+				byte(1),                     // 0x0A -> c
+				byte(code.OpSetLocal),       // 0x0B
 				byte(0),                     // 0x0C
-				byte(32),                    // 0x0D -> YYYY
+				byte(0),                     // 0x0D -> i
 				byte(code.OpConstant),       // 0x0E
 				byte(0),                     // 0x0F
 				byte(3),                     // 0x10 -> "%d: %s\n"
-				byte(code.OpLookup),         // 0x11
+				byte(code.OpGetLocal),       // 0x11
 				byte(0),                     // 0x12
-				byte(1),                     // 0x13 -> "lookup: i"
-				byte(code.OpLookup),         // 0x14
+				byte(0),                     // 0x13 -> i
+				byte(code.OpGetLocal),       // 0x14
 				byte(0),                     // 0x15
-				byte(2),                     // 0x16 -> "lookup: c"
+				byte(1),                     // 0x16 -> c
 				byte(code.OpConstant),       // 0x17
 				byte(0),                     // 0x18
 				byte(4),                     // 0x19 -> "printf"
@@ -1298,6 +1368,40 @@ func TestOpIterationNext(t *testing.T) {
 
 }
 
+func TestOpIterationEnd(t *testing.T) {
+
+	tests := []TestCase{
+
+		// empty stack
+		{
+			program: code.Instructions{
+				byte(code.OpIterationEnd),
+			},
+			result: "Pop from an empty stack",
+			error:  true,
+		},
+
+		// the iterated object is dropped
+		{
+			program: code.Instructions{
+				byte(code.OpFalse),
+				byte(code.OpConstant),
+				byte(0),
+				byte(0),
+				byte(code.OpIterationReset),
+				byte(code.OpIterationEnd),
+				byte(code.OpReturn),
+			},
+			result: "false",
+			error:  false,
+		},
+	}
+
+	constants := []object.Object{&object.String{Value: "Steve"}}
+
+	RunTestCases(tests, constants, t)
+}
+
 func TestOpIterationReset(t *testing.T) {
 
 	tests := []TestCase{
@@ -1330,9 +1434,98 @@ func TestOpIterationReset(t *testing.T) {
 				byte(code.OpIterationReset),
 				byte(code.OpReturn),
 			},
+			result: "<iterator>",
+			error:  false,
+		},
+	}
+
+	constants := []object.Object{&object.String{Value: "Steve"}}
+
+	RunTestCases(tests, constants, t)
+}
+
+func TestOpLocal(t *testing.T) {
+
+	tests := []TestCase{
+
+		// an unset local is null
+		{
+			program: code.Instructions{
+				byte(code.OpGetLocal),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			result: "null",
+			error:  false,
+		},
+
+		// set, then get
+		{
+			program: code.Instructions{
+				byte(code.OpConstant),
+				byte(0),
+				byte(0),
+				byte(code.OpSetLocal),
+				byte(0),
+				byte(1),
+				byte(code.OpGetLocal),
+				byte(0),
+				byte(1),
+				byte(code.OpReturn),
+			},
 			result: "Steve",
 			error:  false,
 		},
+
+		// declaring a local clears it
+		{
+			program: code.Instructions{
+				byte(code.OpConstant),
+				byte(0),
+				byte(0),
+				byte(code.OpSetLocal),
+				byte(0),
+				byte(0),
+				byte(code.OpLocal),
+				byte(0),
+				byte(0),
+				byte(code.OpGetLocal),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			result: "null",
+			error:  false,
+		},
+
+		// there is no enclosing function
+		{
+			program: code.Instructions{
+				byte(code.OpWide),
+				byte(code.OpGetOuter),
+				byte(0),
+				byte(1),
+				byte(0),
+				byte(0),
+				byte(code.OpReturn),
+			},
+			result: "local variable 0 of enclosing function 1 doesn't exist",
+			error:  true,
+		},
+		{
+			program: code.Instructions{
+				byte(code.OpTrue),
+				byte(code.OpWide),
+				byte(code.OpSetOuter),
+				byte(0),
+				byte(1),
+				byte(0),
+				byte(0),
+			},
+			result: "local variable 0 of enclosing function 1 doesn't exist",
+			error:  true,
+		},
 	}
 
 	constants := []object.Object{&object.String{Value: "Steve"}}
@@ -1464,7 +1657,7 @@ func TestOpLookup(t *testing.T) {
 			byte(0),
 			byte(2),
 			byte(code.OpReturn),
-		}, result: "1598613755", error: false},
+		}, result: "2020-08-28T11:22:35Z", error: false},
 
 		// lookup bool
 		{program: code.Instructions{
@@ -1512,7 +1705,7 @@ func TestOpLookup(t *testing.T) {
 	// The instance of that object.
 	in := Input{Name: "Steve Kemp",
 		Array: []string{"Bart", "Lisa", "Maggie"},
-		Time:  time.Unix(1598613755, 0),
+		Time:  time.Unix(1598613755, 0).UTC(),
 		True:  true,
 		Int:   17,
 		Float: 3.2}
@@ -1520,7 +1713,7 @@ func TestOpLookup(t *testing.T) {
 	m := make(map[string]interface{})
 	m["Name"] = "Steve Kemp"
 	m["Array"] = []string{"Bart", "Lisa", "Maggie"}
-	m["Time"] = time.Unix(1598613755, 0)
+	m["Time"] = time.Unix(1598613755, 0).UTC()
 	m["True"] = true
 	m["Int"] = 17
 	m["Float"] = 3.2
@@ -1547,7 +1740,7 @@ func TestOpLookup(t *testing.T) {
 		ctx := context.Background()
 
 		// Create
-		vm := New(constants, test.program, functions, env)
+		vm := New(constants, test.program, nil, functions, env)
 		vm.SetContext(ctx)
 
 		// Run - with the structure
@@ -1816,6 +2009,123 @@ func TestOpSet(t *testing.T) {
 
 // [Special]
 // [Optimize]
+func TestOpSetIndex(t *testing.T) {
+
+	tests := []TestCase{
+
+		// empty stack
+		{
+			program: code.Instructions{
+				byte(code.OpSetIndex),
+			},
+			result: "Pop from an empty stack",
+			error:  true,
+		},
+
+		// not enough values upon the stack
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpSetIndex),
+			},
+			result: "Pop from an empty stack",
+			error:  true,
+		},
+
+		// something that cannot be indexed
+		{
+			program: code.Instructions{
+				byte(code.OpTrue),
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpSetIndex),
+			},
+			result: "index assignment can only be applied to arrays and hashes, not STRING",
+			error:  true,
+		},
+
+		// array
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpConstant), byte(0), byte(2),
+				byte(code.OpArray), byte(0), byte(2),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpSetIndex),
+				byte(code.OpReturn),
+			},
+			result: "[1, Steve]",
+			error:  false,
+		},
+
+		// array out of range
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpConstant), byte(0), byte(2),
+				byte(code.OpArray), byte(0), byte(2),
+				byte(code.OpConstant), byte(0), byte(2),
+				byte(code.OpSetIndex),
+			},
+			result: "index 2 is out of range for an array of length 2",
+			error:  true,
+		},
+
+		// array with a non-integer index
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpArray), byte(0), byte(1),
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpSetIndex),
+			},
+			result: "index operator must be given an integer",
+			error:  true,
+		},
+
+		// hash
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpConstant), byte(0), byte(2),
+				byte(code.OpHash), byte(0), byte(2),
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpSetIndex),
+				byte(code.OpConstant), byte(0), byte(0),
+				byte(code.OpIndex),
+				byte(code.OpReturn),
+			},
+			result: "1",
+			error:  false,
+		},
+
+		// hash with an unhashable key
+		{
+			program: code.Instructions{
+				byte(code.OpConstant), byte(0), byte(1),
+				byte(code.OpHash), byte(0), byte(0),
+				byte(code.OpArray), byte(0), byte(0),
+				byte(code.OpSetIndex),
+			},
+			result: "unusable as hash key: ARRAY",
+			error:  true,
+		},
+	}
+
+	constants := []object.Object{
+		&object.String{Value: "Steve"},
+		&object.Integer{Value: 1},
+		&object.Integer{Value: 2},
+	}
+
+	RunTestCases(tests, constants, t)
+}
+
 func TestOpSquareRoot(t *testing.T) {
 
 	// A pair of constants
@@ -1877,7 +2187,7 @@ func TestOpSquareRoot(t *testing.T) {
 		ctx := context.Background()
 
 		// Create
-		vm := New(constants, test.program, functions, env)
+		vm := New(constants, test.program, nil, functions, env)
 		vm.SetContext(ctx)
 
 		// Run
@@ -2040,7 +2350,74 @@ func TestOptimizerJumps(t *testing.T) {
 			optimized: code.Instructions{
 				byte(code.OpTrue),
 				byte(code.OpReturn),
-			}}}
+			}},
+
+		// The conditional jump is itself a jump target,
+		// so the preceding OpFalse doesn't decide it.
+		{
+			program: code.Instructions{
+				byte(code.OpTrue),        // 0x00
+				byte(code.OpJump),        // 0x01
+				byte(0),                  // 0x02
+				byte(5),                  // 0x03
+				byte(code.OpFalse),       // 0x04
+				byte(code.OpJumpIfFalse), // 0x05 -> JumpTarget
+				byte(0),                  // 0x06
+				byte(9),                  // 0x07
+				byte(code.OpTrue),        // 0x08
+				byte(code.OpReturn),      // 0x09
+			},
+			result: "true", error: false,
+			optimized: code.Instructions{
+				byte(code.OpTrue),
+				byte(code.OpJump),
+				byte(0),
+				byte(5),
+				byte(code.OpFalse),
+				byte(code.OpJumpIfFalse),
+				byte(0),
+				byte(9),
+				byte(code.OpTrue),
+				byte(code.OpReturn),
+			}},
+
+		// Constants either side of a jump target are
+		// not folded together.
+		{
+			program: code.Instructions{
+				byte(code.OpPush),   // 0x00
+				byte(0),             // 0x01
+				byte(1),             // 0x02
+				byte(code.OpJump),   // 0x03
+				byte(0),             // 0x04
+				byte(9),             // 0x05
+				byte(code.OpPush),   // 0x06
+				byte(0),             // 0x07
+				byte(2),             // 0x08
+				byte(code.OpPush),   // 0x09 -> JumpTarget
+				byte(0),             // 0x0A
+				byte(3),             // 0x0B
+				byte(code.OpAdd),    // 0x0C
+				byte(code.OpReturn), // 0x0D
+			},
+			result: "4", error: false,
+			optimized: code.Instructions{
+				byte(code.OpPush),
+				byte(0),
+				byte(1),
+				byte(code.OpJump),
+				byte(0),
+				byte(9),
+				byte(code.OpPush),
+				byte(0),
+				byte(2),
+				byte(code.OpPush),
+				byte(0),
+				byte(3),
+				byte(code.OpAdd),
+				byte(code.OpReturn),
+			}},
+	}
 
 	constants := []object.Object{}
 
@@ -2162,6 +2539,59 @@ func TestOptimizerNops(t *testing.T) {
 	RunTestCases(tests, constants, t)
 }
 
+// TestOptimizerPositions ensures the source-positions of instructions
+// survive the removal of NOPs.
+//
+// [Optimize]
+func TestOptimizerPositions(t *testing.T) {
+
+	// No constants
+	constants := []object.Object{}
+
+	// The program we run - a call to a missing function
+	// after some NOPs.
+	bytecode := code.Instructions{
+		byte(code.OpNop),
+		byte(code.OpNop),
+		byte(code.OpNop),
+		byte(code.OpFalse),
+		byte(code.OpCall), byte(0), byte(0),
+	}
+
+	// Positions of the instructions
+	positions := code.Positions{
+		0: {Line: 1, Column: 1},
+		3: {Line: 2, Column: 4},
+		4: {Line: 3, Column: 9},
+	}
+
+	// No functions
+	functions := make(map[string]environment.UserFunction)
+
+	// Environment will enable the optimizer
+	env := environment.New()
+	env.Set("OPTIMIZE", &object.Boolean{Value: true})
+
+	// Create
+	vm := New(constants, bytecode, positions, functions, env)
+
+	// Run
+	_, err := vm.Run(nil)
+	if err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	vmErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("error has the wrong type: %T", err)
+	}
+	if vmErr.Position.Line != 3 || vmErr.Position.Column != 9 {
+		t.Fatalf("error has the wrong position: %v", vmErr.Position)
+	}
+	if !strings.Contains(err.Error(), "around line 3, column 9") {
+		t.Fatalf("error message is missing the position: %s", err.Error())
+	}
+}
+
 func TestUnknownOpcode(t *testing.T) {
 
 	tests := []TestCase{
@@ -2204,7 +2634,7 @@ func TestWalkFunctionBytecode(t *testing.T) {
 	ctx := context.Background()
 
 	// Create
-	vm := New(constants, bytecode, functions, env)
+	vm := New(constants, bytecode, nil, functions, env)
 	vm.SetContext(ctx)
 
 	err := vm.WalkFunctionBytecode("bob", func(offset int, opCode code.Opcode, opArg interface{}) (bool, error) {
@@ -2252,7 +2682,7 @@ func RunTestCases(tests []TestCase, objects []object.Object, t *testing.T) {
 		}
 
 		// Create
-		vm := New(objects, test.program, funs, env)
+		vm := New(objects, test.program, nil, funs, env)
 
 		if test.dropMatch {
 			vm.environment.DeleteFunction("match")
@@ -2454,7 +2884,7 @@ func TestBinOp(t *testing.T) {
 
 	for _, test := range tests {
 
-		vm := New(nil, nil, nil, environment.New())
+		vm := New(nil, nil, nil, nil, environment.New()).newExecution()
 		vm.stack.Push(test.left)
 		vm.stack.Push(test.right)
 
@@ -2487,13 +2917,13 @@ func TestBinOp(t *testing.T) {
 	}
 
 	// binops requires two values on the stack
-	vm := New(nil, nil, nil, environment.New())
+	vm := New(nil, nil, nil, nil, environment.New()).newExecution()
 	err := vm.executeBinaryOperation(code.OpEqual)
 	if err == nil {
 		t.Fatalf("expected error")
 	}
 
-	vm = New(nil, nil, nil, environment.New())
+	vm = New(nil, nil, nil, nil, environment.New()).newExecution()
 	vm.stack.Push(&object.Boolean{Value: true})
 	err = vm.executeBinaryOperation(code.OpEqual)
 	if err == nil {
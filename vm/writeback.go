@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/skx/evalfilter/v2/object"
+)
+
+// writeField stores the given value in the named field of the object we're
+// run against, returning false if the object has no such field.
+//
+// Only the values which the script has changed are written, so hashes
+// built from maps and structures update them in place, and the fields we
+// couldn't represent are left alone.
+func (vm *execution) writeField(obj interface{}, name string, val object.Object) (bool, error) {
+
+	name = strings.TrimPrefix(name, "$")
+
+	if obj == nil {
+		return false, nil
+	}
+	target := reflect.Indirect(reflect.ValueOf(obj))
+	if !target.IsValid() {
+		return false, nil
+	}
+
+	//
+	// Discover our fields, if we've not done so already, as we
+	// need to know what has changed.
+	//
+	if len(vm.fields) == 0 {
+		vm.inspectObject(obj)
+	}
+	old, found := vm.fields[name]
+
+	converter := &object.Converter{FieldName: vm.naming.Name, Lenient: true}
+
+	var err error
+	switch target.Kind() {
+	case reflect.Map:
+		if !found {
+			return false, nil
+		}
+		key := reflect.ValueOf(name)
+		if !key.Type().ConvertibleTo(target.Type().Key()) {
+			return false, nil
+		}
+		key = key.Convert(target.Type().Key())
+
+		err = vm.writeEntry(converter, target, key, val, old)
+		if err == nil {
+			vm.fields[name], err = converter.FromValue(target.MapIndex(key))
+		}
+
+	case reflect.Struct:
+		field, ok := converter.Field(target, name)
+		if !ok {
+			// Fields we can't see are an error, rather than
+			// being silently replaced by a variable.
+			if typeField, ok := target.Type().FieldByName(name); ok {
+				if typeField.PkgPath != "" {
+					return true, &FieldError{Field: name, Err: fmt.Errorf("the field is unexported")}
+				}
+				return true, &FieldError{Field: name, Err: fmt.Errorf("the field is hidden")}
+			}
+			return false, nil
+		}
+		if !field.CanSet() {
+			return true, &FieldError{Field: name, Err: fmt.Errorf("the structure must be passed to Run by pointer")}
+		}
+
+		err = vm.writeValue(converter, field, val, old)
+		if err == nil {
+			vm.fields[name], err = converter.FromValue(field)
+		}
+
+	default:
+		return false, nil
+	}
+
+	if err != nil {
+		return true, &FieldError{Field: name, Err: err}
+	}
+	return true, nil
+}
+
+// writeValue stores the given object in a value, which must be settable,
+// unless it is unchanged from the old object it was read as.
+func (vm *execution) writeValue(converter *object.Converter, val reflect.Value, obj object.Object, old object.Object) error {
+
+	if obj == old {
+		return nil
+	}
+
+	hash, isHash := obj.(*object.Hash)
+	oldHash, _ := old.(*object.Hash)
+
+	switch val.Kind() {
+	case reflect.Map:
+		// Update maps in place, so that everything which refers
+		// to them sees our changes.
+		if isHash && !val.IsNil() {
+			return vm.writeHash(converter, val, hash, oldHash)
+		}
+
+	case reflect.Ptr:
+		if isHash && !val.IsNil() && val.Elem().Kind() == reflect.Struct && val.Elem().Type() != reflect.TypeOf(time.Time{}) {
+			return vm.writeHash(converter, val.Elem(), hash, oldHash)
+		}
+
+	case reflect.Struct:
+		if isHash && val.Type() != reflect.TypeOf(time.Time{}) {
+			return vm.writeHash(converter, val, hash, oldHash)
+		}
+
+	case reflect.Interface:
+		if val.IsNil() {
+			break
+		}
+
+		// Keep the type of the existing value, if we can, so that
+		// an `int` isn't replaced by an `int64`, and hashes update
+		// the map or structure they were read from.
+		cur := val.Elem()
+		tmp := reflect.New(cur.Type()).Elem()
+		tmp.Set(cur)
+		err := vm.writeValue(converter, tmp, obj, old)
+		if err == nil {
+			val.Set(tmp)
+			return nil
+		}
+		if isHash {
+			return err
+		}
+	}
+
+	return converter.DecodeValue(obj, val)
+}
+
+// writeHash stores the entries of a hash, which differ from those of the
+// old hash, in a map or structure.
+func (vm *execution) writeHash(converter *object.Converter, val reflect.Value, hash *object.Hash, old *object.Hash) error {
+
+	for hashKey, pair := range hash.Pairs {
+
+		var prev object.Object
+		if old != nil {
+			if oldPair, ok := old.Pairs[hashKey]; ok {
+				prev = oldPair.Value
+			}
+		}
+		if pair.Value == prev {
+			continue
+		}
+
+		if val.Kind() == reflect.Map {
+			key := reflect.New(val.Type().Key()).Elem()
+			err := converter.DecodeValue(pair.Key, key)
+			if err != nil {
+				return fmt.Errorf("key %s: %s", pair.Key.Inspect(), err)
+			}
+			err = vm.writeEntry(converter, val, key, pair.Value, prev)
+			if err != nil {
+				return fmt.Errorf("key %s: %s", pair.Key.Inspect(), err)
+			}
+			continue
+		}
+
+		name := pair.Key.Inspect()
+		field, ok := converter.Field(val, name)
+		if !ok {
+			return fmt.Errorf("%s has no field %s", val.Type(), name)
+		}
+		if !field.CanSet() {
+			return fmt.Errorf("field %s is not settable", name)
+		}
+		err := vm.writeValue(converter, field, pair.Value, prev)
+		if err != nil {
+			return fmt.Errorf("field %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// writeEntry stores the given object in the entry of a map, unless it is
+// unchanged from the old object it was read as.
+func (vm *execution) writeEntry(converter *object.Converter, m reflect.Value, key reflect.Value, obj object.Object, old object.Object) error {
+
+	// Map entries can't be set directly, so we update a copy of the
+	// existing entry, if any.
+	val := reflect.New(m.Type().Elem()).Elem()
+	if cur := m.MapIndex(key); cur.IsValid() {
+		val.Set(cur)
+	}
+
+	err := vm.writeValue(converter, val, obj, old)
+	if err != nil {
+		return err
+	}
+	m.SetMapIndex(key, val)
+	return nil
+}